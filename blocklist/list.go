@@ -0,0 +1,300 @@
+package blocklist
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/carlos-marchal/shorty/logging"
+)
+
+// Format is the syntax of a blocklist file. Every format ignores empty lines
+// and lines starting with #.
+type Format int
+
+const (
+	// Hosts lists hostnames as a hosts file does, one or more per line after
+	// an optional IP, with # starting a comment anywhere. Subdomains of listed
+	// hosts are blocked too.
+	Hosts Format = iota
+	// Prefixes lists one URL prefix per line.
+	Prefixes
+	// Patterns lists one regular expression per line, matched against the
+	// whole URL.
+	Patterns
+	// HashPrefixes lists one hex encoded SHA-256 hash prefix per line, of the
+	// host suffix and path prefix expressions used by Safe Browsing.
+	HashPrefixes
+)
+
+type Source struct {
+	Format Format
+	Path   string
+}
+
+type Config struct {
+	Sources []Source
+	// ReloadInterval is how often the files are checked for changes.
+	ReloadInterval time.Duration
+}
+
+// rules are the parsed contents of every source.
+type rules struct {
+	hosts        map[string]string
+	prefixes     map[string]string
+	patterns     map[*regexp.Regexp]string
+	hashPrefixes map[string]string
+	hashLengths  map[int]bool
+}
+
+// fileState identifies a version of a file, to tell when it changes.
+type fileState struct {
+	modified time.Time
+	size     int64
+}
+
+type List struct {
+	config *Config
+	// rules holds the *rules in use. Reloads replace them as a whole, so
+	// that matching never waits for one.
+	rules atomic.Value
+	// mutex guards lastCheck and reloading, which decide when to reload.
+	mutex     sync.Mutex
+	lastCheck time.Time
+	reloading bool
+	// states is only used by the reload in progress.
+	states []fileState
+}
+
+func NewList(config *Config) (*List, error) {
+	list := &List{config: config}
+	states, err := list.stat()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := list.load()
+	if err != nil {
+		return nil, err
+	}
+	list.rules.Store(rules)
+	list.states, list.lastCheck = states, time.Now()
+	return list, nil
+}
+
+func (list *List) stat() ([]fileState, error) {
+	states := make([]fileState, len(list.config.Sources))
+	for i, source := range list.config.Sources {
+		info, err := os.Stat(source.Path)
+		if err != nil {
+			return nil, err
+		}
+		states[i] = fileState{info.ModTime(), info.Size()}
+	}
+	return states, nil
+}
+
+func (list *List) load() (*rules, error) {
+	loaded := &rules{
+		hosts:        make(map[string]string),
+		prefixes:     make(map[string]string),
+		patterns:     make(map[*regexp.Regexp]string),
+		hashPrefixes: make(map[string]string),
+		hashLengths:  make(map[int]bool),
+	}
+	for _, source := range list.config.Sources {
+		err := loadSource(loaded, source)
+		if err != nil {
+			return nil, fmt.Errorf("error loading blocklist %v: %w", source.Path, err)
+		}
+	}
+	return loaded, nil
+}
+
+func loadSource(loaded *rules, source Source) error {
+	file, err := os.Open(source.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		rule := fmt.Sprintf("%v:%v", source.Path, line)
+		switch source.Format {
+		case Hosts:
+			if comment := strings.Index(text, "#"); comment >= 0 {
+				text = text[:comment]
+			}
+			fields := strings.Fields(text)
+			if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+				fields = fields[1:]
+			}
+			for _, host := range fields {
+				loaded.hosts[normalizeHost(host)] = rule
+			}
+		case Prefixes:
+			loaded.prefixes[strings.ToLower(text)] = rule
+		case Patterns:
+			pattern, err := regexp.Compile(text)
+			if err != nil {
+				return fmt.Errorf("line %v: %w", line, err)
+			}
+			loaded.patterns[pattern] = rule
+		case HashPrefixes:
+			prefix, err := hex.DecodeString(text)
+			if err != nil || len(prefix) < 4 || len(prefix) > sha256.Size {
+				return fmt.Errorf("line %v: expected 4 to 32 hex encoded bytes", line)
+			}
+			loaded.hashPrefixes[string(prefix)] = rule
+			loaded.hashLengths[len(prefix)] = true
+		default:
+			return fmt.Errorf("unknown format %v", source.Format)
+		}
+	}
+	return scanner.Err()
+}
+
+// reloadInBackground starts checking the sources for changes once the reload
+// interval has passed since the last check, unless a check is still running.
+func (list *List) reloadInBackground() {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	if list.reloading || time.Since(list.lastCheck) < list.config.ReloadInterval {
+		return
+	}
+	list.lastCheck = time.Now()
+	list.reloading = true
+	go list.reloadIfChanged()
+}
+
+// reloadIfChanged reloads every source if any of them changed since the last
+// load. If they can't be loaded the previous rules are kept.
+func (list *List) reloadIfChanged() {
+	defer func() {
+		list.mutex.Lock()
+		list.reloading = false
+		list.mutex.Unlock()
+	}()
+	states, err := list.stat()
+	if err != nil {
+		logging.Default().Error("Could not check the blocklists for changes", "error", err)
+		return
+	}
+	changed := false
+	for i := range states {
+		changed = changed || states[i] != list.states[i]
+	}
+	if !changed {
+		return
+	}
+	rules, err := list.load()
+	if err != nil {
+		logging.Default().Error("Could not reload the blocklists, keeping the previous rules", "error", err)
+		return
+	}
+	list.rules.Store(rules)
+	list.states = states
+}
+
+// Match returns the file and line of a rule matching target, if any. Changed
+// sources are reloaded in the background, and used once loaded.
+func (list *List) Match(target string) (string, bool) {
+	list.reloadInBackground()
+	rules := list.rules.Load().(*rules)
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return "", false
+	}
+	host := normalizeHost(parsed.Hostname())
+	for _, suffix := range hostSuffixes(host) {
+		if rule, ok := rules.hosts[suffix]; ok {
+			return rule, true
+		}
+	}
+	lowered := strings.ToLower(target)
+	for prefix, rule := range rules.prefixes {
+		if strings.HasPrefix(lowered, prefix) {
+			return rule, true
+		}
+	}
+	for pattern, rule := range rules.patterns {
+		if pattern.MatchString(target) {
+			return rule, true
+		}
+	}
+	if len(rules.hashPrefixes) > 0 {
+		for _, expression := range expressions(host, parsed) {
+			hash := sha256.Sum256([]byte(expression))
+			for length := range rules.hashLengths {
+				if rule, ok := rules.hashPrefixes[string(hash[:length])]; ok {
+					return rule, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+func normalizeHost(host string) string {
+	return strings.Trim(strings.ToLower(host), ".")
+}
+
+// hostSuffixes returns host and each of its parent domains, except for the top
+// level domain. IPs are only returned as a whole.
+func hostSuffixes(host string) []string {
+	if net.ParseIP(host) != nil {
+		return []string{host}
+	}
+	components := strings.Split(host, ".")
+	suffixes := make([]string, 0, len(components))
+	for i := 0; i < len(components)-1 || i == 0; i++ {
+		suffixes = append(suffixes, strings.Join(components[i:], "."))
+	}
+	return suffixes
+}
+
+// expressions returns the host suffix and path prefix combinations that Safe
+// Browsing hashes for a URL. That is the exact host and up to four of its
+// parent domains, combined with the exact path with and without query and up
+// to four of its leading directories.
+func expressions(host string, parsed *url.URL) []string {
+	hosts := hostSuffixes(host)
+	if len(hosts) > 5 {
+		hosts = append(hosts[:1], hosts[len(hosts)-4:]...)
+	}
+	path := parsed.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	paths := make([]string, 0, 6)
+	if parsed.RawQuery != "" {
+		paths = append(paths, path+"?"+parsed.RawQuery)
+	}
+	paths = append(paths, path)
+	directories := strings.Split(path, "/")
+	for i := 1; i < len(directories) && i <= 4; i++ {
+		prefix := strings.Join(directories[:i], "/") + "/"
+		if prefix != path {
+			paths = append(paths, prefix)
+		}
+	}
+	combinations := make([]string, 0, len(hosts)*len(paths))
+	for _, host := range hosts {
+		for _, path := range paths {
+			combinations = append(combinations, host+path)
+		}
+	}
+	return combinations
+}
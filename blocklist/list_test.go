@@ -0,0 +1,126 @@
+package blocklist
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func hashPrefix(expression string) string {
+	hash := sha256.Sum256([]byte(expression))
+	return hex.EncodeToString(hash[:4])
+}
+
+// matchAfterReload matches target once the reload started by the first match,
+// if any, finished.
+func matchAfterReload(list *List, target string) bool {
+	list.Match(target)
+	for {
+		list.mutex.Lock()
+		reloading := list.reloading
+		list.mutex.Unlock()
+		if !reloading {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_, blocked := list.Match(target)
+	return blocked
+}
+
+func TestMatchesEveryFormat(t *testing.T) {
+	directory := t.TempDir()
+	sources := []Source{
+		{Hosts, filepath.Join(directory, "hosts")},
+		{Prefixes, filepath.Join(directory, "prefixes")},
+		{Patterns, filepath.Join(directory, "patterns")},
+		{HashPrefixes, filepath.Join(directory, "hashes")},
+	}
+	writeFile(t, sources[0].Path, "# comment\n0.0.0.0 malware.example.com\nphishing.example.org\n"+
+		"127.0.0.1 spam.example.com tracker.example.com # ads\nscam.example.com#comment\n")
+	writeFile(t, sources[1].Path, "https://example.net/downloads/\n")
+	writeFile(t, sources[2].Path, `^https?://[^/]*\.example\.io/login\.php`+"\n")
+	writeFile(t, sources[3].Path, hashPrefix("bad.example.dev/campaign/")+"\n")
+	list, err := NewList(&Config{Sources: sources})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	tests := []struct {
+		target  string
+		blocked bool
+	}{
+		{target: "https://malware.example.com/page", blocked: true},
+		{target: "https://cdn.malware.example.com", blocked: true},
+		{target: "https://example.com", blocked: false},
+		{target: "https://spam.example.com", blocked: true},
+		{target: "https://tracker.example.com", blocked: true},
+		{target: "https://ads", blocked: false},
+		{target: "https://scam.example.com", blocked: true},
+		{target: "https://127.0.0.1", blocked: false},
+		{target: "http://PHISHING.example.org.", blocked: true},
+		{target: "HTTPS://example.net/downloads/setup.exe", blocked: true},
+		{target: "https://example.net/docs", blocked: false},
+		{target: "https://bank.example.io/login.php?next=/", blocked: true},
+		{target: "https://bank.example.io/about", blocked: false},
+		{target: "https://www.bad.example.dev/campaign/2021/offer?id=1", blocked: true},
+		{target: "https://bad.example.dev/other", blocked: false},
+	}
+	for _, test := range tests {
+		_, blocked := list.Match(test.target)
+		if blocked != test.blocked {
+			t.Fatalf("expected blocked %v for %v but got %v", test.blocked, test.target, blocked)
+		}
+	}
+}
+
+func TestRejectsMalformedFiles(t *testing.T) {
+	directory := t.TempDir()
+	tests := []Source{
+		{Patterns, filepath.Join(directory, "patterns")},
+		{HashPrefixes, filepath.Join(directory, "hashes")},
+		{Hosts, filepath.Join(directory, "missing")},
+	}
+	writeFile(t, tests[0].Path, "(unclosed\n")
+	writeFile(t, tests[1].Path, "abc\n")
+	for _, source := range tests {
+		_, err := NewList(&Config{Sources: []Source{source}})
+		if err == nil {
+			t.Fatalf("accepted malformed blocklist %v", source.Path)
+		}
+	}
+}
+
+func TestReloadsChangedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	writeFile(t, path, "malware.example.com\n")
+	list, err := NewList(&Config{Sources: []Source{{Hosts, path}}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, blocked := list.Match("https://phishing.example.com"); blocked {
+		t.Fatalf("blocked a host not yet listed")
+	}
+	writeFile(t, path, "malware.example.com\nphishing.example.com\n")
+	err = os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !matchAfterReload(list, "https://phishing.example.com") {
+		t.Fatalf("did not reload the changed file")
+	}
+	os.Remove(path)
+	if !matchAfterReload(list, "https://phishing.example.com") {
+		t.Fatalf("dropped previous rules when the file disappeared")
+	}
+}
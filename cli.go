@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/carlos-marchal/shorty/entities"
+	"github.com/carlos-marchal/shorty/transfer"
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+	"gopkg.in/yaml.v2"
+)
+
+type command struct {
+	usage       string
+	description string
+	run         func(app *app, args []string) error
+	// offline commands run without opening the repository.
+	offline bool
+}
+
+// commands are run as the first argument of the program. Every command but
+// serve works directly on the repository, so they can be used to fix data
+// without a running server. They are set in init, as their flags refer back
+// to them for the usage line.
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"serve":   {"serve", "Start the HTTP server, the default when no command is given", serve, false},
+		"shorten": {"shorten [flags] <url>", "Shorten a URL", runShorten, false},
+		"resolve": {"resolve <id>", "Show the link with the given ID", runResolve, false},
+		"list":    {"list [flags]", "List the stored links, newest first", runList, false},
+		"delete":  {"delete <id>...", "Delete links whatever their owner", runDelete, false},
+		"import":  {"import [flags] [file]", "Import links from a file or standard input, keeping their IDs", runImport, false},
+		"export":  {"export [flags]", "Export links to standard output", runExport, false},
+		"gc":      {"gc", "Delete every expired link", runGC, false},
+		"verify":  {"verify", "Check every stored link against the current configuration", runVerify, false},
+		"config":  {"config print", "Print the effective configuration, with secrets redacted", runConfig, true},
+	}
+}
+
+func printUsage(w io.Writer, flags *flag.FlagSet) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Usage: shorty [settings] <command> [arguments]")
+	fmt.Fprintln(w, "\nCommands:")
+	table := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(table, "  %v\t%v\n", commands[name].usage, commands[name].description)
+	}
+	table.Flush()
+	fmt.Fprintln(w, "\nRun shorty <command> -h for the flags of a command.")
+	fmt.Fprintln(w, "\nSettings are read from a YAML file, the environment and these flags, each")
+	fmt.Fprintln(w, "overriding the previous one:")
+	flags.SetOutput(w)
+	flags.PrintDefaults()
+}
+
+// newFlags creates the flag set of a command, with its usage line.
+func newFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: shorty %v\n", commands[name].usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseArgs parses the flags of a command, checking that the number of
+// remaining arguments is between min and max. A negative max allows any.
+func parseArgs(flags *flag.FlagSet, args []string, min int, max int) error {
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < min || max >= 0 && flags.NArg() > max {
+		flags.Usage()
+		return fmt.Errorf("wrong number of arguments")
+	}
+	return nil
+}
+
+var conflictModes = map[string]shorturl.ConflictMode{
+	"skip":      shorturl.SkipConflicts,
+	"overwrite": shorturl.OverwriteConflicts,
+	"fail":      shorturl.FailOnConflict,
+}
+
+var listStatuses = map[string]shorturl.Status{
+	"all":     shorturl.AnyStatus,
+	"active":  shorturl.ActiveStatus,
+	"expired": shorturl.ExpiredStatus,
+}
+
+// filterFlags adds the flags of a listing filter to flags. The returned
+// function completes the filter once the flags are parsed.
+func filterFlags(flags *flag.FlagSet) func() (*shorturl.Filter, error) {
+	filter := new(shorturl.Filter)
+	statusName := flags.String("status", "all", "status of the links, all, active or expired")
+	flags.StringVar(&filter.Tag, "tag", "", "only links with this tag")
+	flags.StringVar(&filter.Creator, "creator", "", "only links by this creator")
+	flags.StringVar(&filter.Target, "target", "", "only links whose target contains this")
+	return func() (*shorturl.Filter, error) {
+		status, ok := listStatuses[*statusName]
+		if !ok {
+			return nil, fmt.Errorf("unknown status %v, must be all, active or expired", *statusName)
+		}
+		filter.Status = status
+		return filter, nil
+	}
+}
+
+func shortened(app *app, url *entities.ShortURL) string {
+	return fmt.Sprintf("%v/%v", app.config.server.Origin, url.ShortID)
+}
+
+func runShorten(app *app, args []string) error {
+	flags := newFlags("shorten")
+	options := &shorturl.ShortenOptions{Metadata: new(entities.Metadata)}
+	flags.StringVar(&options.Owner, "owner", "", "owner of the link")
+	flags.StringVar(&options.Metadata.Title, "title", "", "title of the link")
+	flags.StringVar(&options.Metadata.Description, "description", "", "description of the link")
+	flags.StringVar(&options.Metadata.Creator, "creator", "", "creator of the link")
+	tags := flags.String("tags", "", "comma separated tags of the link")
+	dedupe := flags.String("dedupe", "", "whether to reuse a link for the same target, always, never or owner")
+	redirect := flags.String("redirect", "", "redirect status code of the link, 301, 302, 307 or 308")
+	flags.BoolVar(&options.Interstitial, "interstitial", false, "show a warning before leaving for external targets")
+	err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	options.Metadata.Tags = splitList(*tags)
+	if *dedupe != "" {
+		mode, ok := dedupeModes[*dedupe]
+		if !ok {
+			return fmt.Errorf("unknown dedupe mode %v, must be always, never or owner", *dedupe)
+		}
+		options.Dedupe = mode
+	}
+	if *redirect != "" {
+		redirectType, ok := redirectTypes[*redirect]
+		if !ok {
+			return fmt.Errorf("unknown redirect type %v, must be 301, 302, 307 or 308", *redirect)
+		}
+		options.Redirect = redirectType
+	}
+	url, err := app.service.ShortenURL(context.Background(), flags.Arg(0), options)
+	if err != nil {
+		return err
+	}
+	fmt.Println(shortened(app, url))
+	return nil
+}
+
+func runResolve(app *app, args []string) error {
+	flags := newFlags("resolve")
+	err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	url, err := app.service.ResolveURL(context.Background(), flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, field := range [][2]string{
+		{"Target", url.Target},
+		{"Shortened", shortened(app, url)},
+		{"Created", url.Created.Format(time.RFC3339)},
+		{"Expires", url.Expires.Format(time.RFC3339)},
+		{"Owner", url.Owner},
+		{"Title", url.Title},
+		{"Description", url.Description},
+		{"Tags", strings.Join(url.Tags, ", ")},
+		{"Creator", url.Creator},
+	} {
+		if field[1] != "" {
+			fmt.Fprintf(table, "%v:\t%v\n", field[0], field[1])
+		}
+	}
+	return table.Flush()
+}
+
+func runList(app *app, args []string) error {
+	flags := newFlags("list")
+	filter := filterFlags(flags)
+	limit := flags.Int("limit", 0, "list at most this many links, 0 lists all")
+	err := parseArgs(flags, args, 0, 0)
+	if err != nil {
+		return err
+	}
+	parsed, err := filter()
+	if err != nil {
+		return err
+	}
+	urls, err := app.service.ExportURLs(context.Background(), parsed)
+	if err != nil {
+		return err
+	}
+	if *limit > 0 && len(urls) > *limit {
+		urls = urls[:*limit]
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tEXPIRES\tTARGET\tTAGS")
+	for _, url := range urls {
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\n", url.ShortID, url.Expires.Format(time.RFC3339), url.Target, strings.Join(url.Tags, ","))
+	}
+	return table.Flush()
+}
+
+func runDelete(app *app, args []string) error {
+	flags := newFlags("delete")
+	err := parseArgs(flags, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	for _, id := range flags.Args() {
+		err := app.service.RemoveURL(context.Background(), id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %v\n", id)
+	}
+	return nil
+}
+
+// runImport imports the links of a file, keeping their IDs. Rejected records
+// are listed without stopping the import.
+func runImport(app *app, args []string) error {
+	flags := newFlags("import")
+	formatName := flags.String("format", "json", "format of the file, json, csv or ndjson")
+	conflictsName := flags.String("conflicts", "skip", "what to do with links whose ID is taken, skip, overwrite or fail")
+	err := parseArgs(flags, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	format, ok := transfer.Formats[*formatName]
+	if !ok {
+		return fmt.Errorf("unknown format %v, must be json, csv or ndjson", *formatName)
+	}
+	conflicts, ok := conflictModes[*conflictsName]
+	if !ok {
+		return fmt.Errorf("unknown conflict mode %v, must be skip, overwrite or fail", *conflictsName)
+	}
+	input := os.Stdin
+	if name := flags.Arg(0); name != "" && name != "-" {
+		input, err = os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer input.Close()
+	}
+	records, err := transfer.Decode(input, format)
+	if err != nil {
+		return err
+	}
+	result, err := app.service.ImportURLs(context.Background(), records, conflicts)
+	if err != nil {
+		return err
+	}
+	for _, reject := range result.Rejected {
+		fmt.Fprintf(os.Stderr, "Rejected record %v (%v): %v\n", reject.Index+1, reject.ShortID, reject.Err)
+	}
+	fmt.Printf("Imported %v links, overwriting %v, skipped %v and rejected %v\n", result.Imported, result.Overwritten, result.Skipped, len(result.Rejected))
+	return nil
+}
+
+// runExport writes every link matching the given filters to standard output.
+func runExport(app *app, args []string) error {
+	flags := newFlags("export")
+	formatName := flags.String("format", "json", "format of the output, json, csv or ndjson")
+	filter := filterFlags(flags)
+	err := parseArgs(flags, args, 0, 0)
+	if err != nil {
+		return err
+	}
+	format, ok := transfer.Formats[*formatName]
+	if !ok {
+		return fmt.Errorf("unknown format %v, must be json, csv or ndjson", *formatName)
+	}
+	parsed, err := filter()
+	if err != nil {
+		return err
+	}
+	urls, err := app.service.ExportURLs(context.Background(), parsed)
+	if err != nil {
+		return err
+	}
+	return transfer.Encode(os.Stdout, urls, format)
+}
+
+func runGC(app *app, args []string) error {
+	flags := newFlags("gc")
+	err := parseArgs(flags, args, 0, 0)
+	if err != nil {
+		return err
+	}
+	deleted, err := app.service.DeleteExpiredURLs(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %v expired links\n", deleted)
+	return nil
+}
+
+// runVerify lists the problems of the stored links, and fails if there are
+// any so that it can be used in scripts.
+func runVerify(app *app, args []string) error {
+	flags := newFlags("verify")
+	err := parseArgs(flags, args, 0, 0)
+	if err != nil {
+		return err
+	}
+	problems, err := app.service.VerifyURLs(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Printf("%v: %v\n", problem.ShortID, problem.Err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %v problems", len(problems))
+	}
+	fmt.Println("No problems found")
+	return nil
+}
+
+// runConfig prints the configuration that the other commands would use, in
+// the format of the config file.
+func runConfig(app *app, args []string) error {
+	flags := newFlags("config")
+	err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if flags.Arg(0) != "print" {
+		flags.Usage()
+		return fmt.Errorf("unknown config command %v", flags.Arg(0))
+	}
+	printed, err := yaml.Marshal(app.config.printable())
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(printed)
+	return err
+}
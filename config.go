@@ -0,0 +1,426 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/carlos-marchal/shorty/blocklist"
+	"github.com/carlos-marchal/shorty/entities"
+	"github.com/carlos-marchal/shorty/git"
+	"github.com/carlos-marchal/shorty/http"
+	"github.com/carlos-marchal/shorty/logging"
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+	"gopkg.in/yaml.v2"
+)
+
+// setting is a configuration value. It is read from the config file under
+// its lowercase name, from the environment under its name, and from the flags
+// under its lowercase name with dashes, each overriding the previous one.
+type setting struct {
+	name     string
+	value    string
+	required bool
+	// secret settings are redacted when printing the configuration.
+	secret bool
+	usage  string
+}
+
+var settings = []*setting{
+	{name: "REPO_URL", required: true, usage: "ssh URL of the git repo used to store the data"},
+	{name: "REPO_PRIVATE_KEY", required: true, secret: true, usage: "PEM encoded private key with permission to push to the repo"},
+	{name: "URL_FILE_PATH", value: "urls.json", usage: "file where to store the URLs in the repo"},
+	{name: "COMMIT_NAME", value: "Shorty Bot", usage: "commit author name of the bot"},
+	{name: "COMMIT_EMAIL", value: "shorty.bot@carlos.marchal.page", usage: "commit author email of the bot"},
+	{name: "PORT", value: "8080", usage: "port on which to listen"},
+	{name: "ORIGIN", value: "http://localhost:8080", usage: "origin to use in responses"},
+	{name: "READY_SYNC_THRESHOLD", value: "5m", usage: "how recently the repo must have synced for /readyz to succeed"},
+	{name: "SHUTDOWN_TIMEOUT", value: "30s", usage: "how long to wait for requests in progress when stopping"},
+	{name: "READ_TIMEOUT", value: "10s", usage: "how long GET requests may wait for the repo, 0 for no limit"},
+	{name: "WRITE_TIMEOUT", value: "30s", usage: "how long other requests may wait for the repo, 0 for no limit"},
+	{name: "FETCH_TIMEOUT", value: "5s", usage: "how long a fetch may take before the last known state is served instead"},
+	{name: "LOG_LEVEL", value: "info", usage: "least severe log level written, debug, info, warn or error"},
+	{name: "OFFLINE_WRITES", value: "reject", usage: "whether to reject or queue writes while the repo is down"},
+	{name: "API_KEYS", secret: true, usage: "comma separated owner:key pairs accepted as API keys"},
+	{name: "API_KEYS_FILE_PATH", usage: "file in the repo listing further API keys"},
+	{name: "ALLOWED_DOMAINS", usage: "comma separated domains that are the only ones allowed as targets"},
+	{name: "DENIED_DOMAINS", usage: "comma separated domains that are never allowed as targets"},
+	{name: "BLOCKLISTS", usage: "comma separated format:path malware and phishing blocklists"},
+	{name: "BLOCKLIST_RELOAD_INTERVAL", value: "1m", usage: "how often to check the blocklist files for changes"},
+	{name: "SORT_QUERY_PARAMS", value: "false", usage: "ignore the order of query parameters when reusing links"},
+	{name: "STRIP_TRACKING_PARAMS", value: "false", usage: "ignore utm_* and click ID parameters when reusing links"},
+	{name: "DEDUPE", value: "always", usage: "whether to reuse links always, never or only for the same owner"},
+	{name: "DEFAULT_REDIRECT", value: "307", usage: "redirect status code of links that don't choose one"},
+	{name: "INTERNAL_DOMAINS", usage: "comma separated domains that skip the interstitial warning"},
+	{name: "ADMIN_OWNERS", usage: "comma separated owners of the keys that may import and export"},
+	{name: "BOOKMARKLET", value: "false", usage: "whether GET /shorten?url=&api_key= shortens links, for bookmarklets"},
+	{name: "REDIRECT_RATE_LIMIT", value: "600", usage: "redirects allowed per minute and client IP"},
+	{name: "SHORTEN_IP_RATE_LIMIT", value: "10", usage: "shortens allowed per minute and client IP"},
+	{name: "SHORTEN_KEY_RATE_LIMIT", value: "60", usage: "shortens allowed per minute and API key"},
+	{name: "WRITE_RATE_LIMIT", value: "60", usage: "commits to the repo allowed per minute, for all clients at once"},
+	{name: "TRUST_FORWARDED_FOR", value: "false", usage: "identify clients by the address their proxy appends to x-forwarded-for"},
+}
+
+func (setting *setting) key() string {
+	return strings.ToLower(setting.name)
+}
+
+func (setting *setting) flag() string {
+	return strings.ReplaceAll(setting.key(), "_", "-")
+}
+
+// config is the parsed configuration. The parts that need the repository,
+// such as the blocklist and the key stores, are completed by app.open and
+// serve.
+type config struct {
+	// values are the effective settings by name, before parsing.
+	values     map[string]string
+	repository git.Config
+	service    shorturl.Config
+	policy     shorturl.TargetPolicy
+	blocklist  blocklist.Config
+	server     http.Config
+	apiKeys    http.StaticKeys
+	// shutdownTimeout bounds how long the server waits for the requests in
+	// progress when stopping.
+	shutdownTimeout time.Duration
+	logLevel        logging.Level
+}
+
+// configErrors lists every problem found in the configuration, so that they
+// can be fixed at once.
+type configErrors []string
+
+func (problems configErrors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(problems, "\n  ")
+}
+
+var offlineWritePolicies = map[string]git.WritePolicy{
+	"reject": git.RejectWrites,
+	"queue":  git.QueueWrites,
+}
+
+var dedupeModes = map[string]shorturl.DedupeMode{
+	"always": shorturl.AlwaysReuse,
+	"never":  shorturl.NeverReuse,
+	"owner":  shorturl.ReuseOwn,
+}
+
+var redirectTypes = map[string]entities.RedirectType{
+	"301": entities.MovedPermanently,
+	"302": entities.Found,
+	"307": entities.TemporaryRedirect,
+	"308": entities.PermanentRedirect,
+}
+
+var blocklistFormats = map[string]blocklist.Format{
+	"hosts":         blocklist.Hosts,
+	"prefixes":      blocklist.Prefixes,
+	"patterns":      blocklist.Patterns,
+	"hash_prefixes": blocklist.HashPrefixes,
+}
+
+// configFlags are the flags given before the command, one per setting plus
+// the config file.
+func configFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("shorty", flag.ContinueOnError)
+	flags.String("config", "", "YAML file to read the settings from, or CONFIG_FILE")
+	for _, setting := range settings {
+		usage := fmt.Sprintf("%v, or %v", setting.usage, setting.name)
+		if setting.value != "" {
+			usage += fmt.Sprintf(" (default %v)", setting.value)
+		}
+		flags.String(setting.flag(), "", usage)
+	}
+	return flags
+}
+
+// loadConfig reads the settings from the config file, the environment and
+// the parsed flags, in that order of precedence, and validates them all.
+func loadConfig(flags *flag.FlagSet, getenv func(string) string) (*config, error) {
+	values := make(map[string]string)
+	for _, setting := range settings {
+		values[setting.name] = setting.value
+	}
+	problems := make(configErrors, 0)
+	path := getenv("CONFIG_FILE")
+	if flagged := flags.Lookup("config").Value.String(); flagged != "" {
+		path = flagged
+	}
+	if path != "" {
+		problems = append(problems, readConfigFile(path, values)...)
+	}
+	for _, setting := range settings {
+		if value := getenv(setting.name); value != "" {
+			values[setting.name] = value
+		}
+	}
+	for _, setting := range settings {
+		if flagged := flags.Lookup(setting.flag()).Value.String(); flagged != "" {
+			values[setting.name] = flagged
+		}
+	}
+	config, invalid := parseConfig(values)
+	problems = append(problems, invalid...)
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return config, nil
+}
+
+// readConfigFile sets the values found in a YAML or TOML file, told apart by
+// the extension. Lists are joined with commas, as they are written in the
+// environment. Files named as any other format are rejected instead of
+// misread.
+func readConfigFile(path string, values map[string]string) configErrors {
+	extension := strings.ToLower(filepath.Ext(path))
+	switch extension {
+	case ".yaml", ".yml", ".toml", "":
+	default:
+		return configErrors{fmt.Sprintf("config file %v must be YAML or TOML, with a .yaml, .yml or .toml extension, not %v", path, extension)}
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return configErrors{fmt.Sprintf("can't read config file: %v", err)}
+	}
+	file := make(map[string]interface{})
+	if extension == ".toml" {
+		file, err = parseTOML(content)
+	} else {
+		err = yaml.Unmarshal(content, &file)
+	}
+	if err != nil {
+		return configErrors{fmt.Sprintf("can't parse config file %v: %v", path, err)}
+	}
+	known := make(map[string]*setting)
+	for _, setting := range settings {
+		known[setting.key()] = setting
+	}
+	problems := make(configErrors, 0)
+	for key, value := range file {
+		setting, ok := known[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown setting %v in config file", key))
+			continue
+		}
+		switch value := value.(type) {
+		case nil:
+			values[setting.name] = ""
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			values[setting.name] = strings.Join(items, ",")
+		case map[interface{}]interface{}:
+			problems = append(problems, fmt.Sprintf("%v in config file must be a value or a list", key))
+		default:
+			values[setting.name] = fmt.Sprint(value)
+		}
+	}
+	return problems
+}
+
+// parseConfig validates the effective settings, and returns every problem
+// found instead of stopping at the first one.
+func parseConfig(values map[string]string) (*config, configErrors) {
+	problems := make(configErrors, 0)
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	for _, setting := range settings {
+		if setting.required && values[setting.name] == "" {
+			fail("%v is required", setting.name)
+		}
+	}
+	boolean := func(name string) bool {
+		value, err := strconv.ParseBool(values[name])
+		if err != nil {
+			fail("%v must be true or false, got %q", name, values[name])
+		}
+		return value
+	}
+	rateLimit := func(name string) http.RateLimit {
+		limit, err := parseRateLimit(values[name])
+		if err != nil {
+			fail("%v: %v", name, err)
+		}
+		return limit
+	}
+
+	config := &config{values: values}
+	offlineWrites, ok := offlineWritePolicies[values["OFFLINE_WRITES"]]
+	if !ok {
+		fail("OFFLINE_WRITES must be reject or queue, got %q", values["OFFLINE_WRITES"])
+	}
+	config.repository = git.Config{
+		RepoURL:       values["REPO_URL"],
+		PrivateKey:    values["REPO_PRIVATE_KEY"],
+		URLFilePath:   values["URL_FILE_PATH"],
+		CommitName:    values["COMMIT_NAME"],
+		CommitEmail:   values["COMMIT_EMAIL"],
+		OfflineWrites: offlineWrites,
+		KeysFilePath:  values["API_KEYS_FILE_PATH"],
+	}
+
+	config.policy = shorturl.TargetPolicy{
+		Allow:  splitList(values["ALLOWED_DOMAINS"]),
+		Deny:   splitList(values["DENIED_DOMAINS"]),
+		Origin: values["ORIGIN"],
+	}
+	sources, err := parseBlocklists(values["BLOCKLISTS"])
+	if err != nil {
+		fail("BLOCKLISTS: %v", err)
+	}
+	reloadInterval, err := time.ParseDuration(values["BLOCKLIST_RELOAD_INTERVAL"])
+	if err != nil || reloadInterval <= 0 {
+		fail("BLOCKLIST_RELOAD_INTERVAL must be a positive duration such as 1m, got %q", values["BLOCKLIST_RELOAD_INTERVAL"])
+	}
+	config.blocklist = blocklist.Config{Sources: sources, ReloadInterval: reloadInterval}
+	dedupe, ok := dedupeModes[values["DEDUPE"]]
+	if !ok {
+		fail("DEDUPE must be always, never or owner, got %q", values["DEDUPE"])
+	}
+	config.service = shorturl.Config{
+		Policy: &config.policy,
+		Canonical: entities.CanonicalOptions{
+			SortQuery:     boolean("SORT_QUERY_PARAMS"),
+			StripTracking: boolean("STRIP_TRACKING_PARAMS"),
+		},
+		Dedupe: dedupe,
+	}
+
+	port, err := strconv.ParseUint(values["PORT"], 10, 16)
+	if err != nil {
+		fail("PORT must be a port number, got %q", values["PORT"])
+	}
+	if values["API_KEYS"] != "" {
+		config.apiKeys, err = parseAPIKeys(values["API_KEYS"])
+		if err != nil {
+			fail("API_KEYS: %v", err)
+		}
+	}
+	defaultRedirect, ok := redirectTypes[values["DEFAULT_REDIRECT"]]
+	if !ok {
+		fail("DEFAULT_REDIRECT must be 301, 302, 307 or 308, got %q", values["DEFAULT_REDIRECT"])
+	}
+	config.server = http.Config{
+		Port:   uint(port),
+		Origin: values["ORIGIN"],
+		RateLimits: http.RateLimits{
+			RedirectsPerIP:    rateLimit("REDIRECT_RATE_LIMIT"),
+			ShortensPerIP:     rateLimit("SHORTEN_IP_RATE_LIMIT"),
+			ShortensPerKey:    rateLimit("SHORTEN_KEY_RATE_LIMIT"),
+			Writes:            rateLimit("WRITE_RATE_LIMIT"),
+			TrustForwardedFor: boolean("TRUST_FORWARDED_FOR"),
+		},
+		DefaultRedirect: defaultRedirect,
+		InternalDomains: splitList(values["INTERNAL_DOMAINS"]),
+		Bookmarklet:     boolean("BOOKMARKLET"),
+		AdminOwners:     splitList(values["ADMIN_OWNERS"]),
+		Version:         version,
+	}
+	if config.server.Bookmarklet && values["API_KEYS"] == "" && values["API_KEYS_FILE_PATH"] == "" {
+		fail("BOOKMARKLET needs API keys, set API_KEYS or API_KEYS_FILE_PATH")
+	}
+	config.server.ReadyWithin, err = time.ParseDuration(values["READY_SYNC_THRESHOLD"])
+	if err != nil || config.server.ReadyWithin <= 0 {
+		fail("READY_SYNC_THRESHOLD must be a positive duration such as 5m, got %q", values["READY_SYNC_THRESHOLD"])
+	}
+	config.shutdownTimeout, err = time.ParseDuration(values["SHUTDOWN_TIMEOUT"])
+	if err != nil || config.shutdownTimeout <= 0 {
+		fail("SHUTDOWN_TIMEOUT must be a positive duration such as 30s, got %q", values["SHUTDOWN_TIMEOUT"])
+	}
+	config.repository.FetchTimeout, err = time.ParseDuration(values["FETCH_TIMEOUT"])
+	if err != nil || config.repository.FetchTimeout <= 0 {
+		fail("FETCH_TIMEOUT must be a positive duration such as 5s, got %q", values["FETCH_TIMEOUT"])
+	}
+	config.server.ReadTimeout, err = time.ParseDuration(values["READ_TIMEOUT"])
+	if err != nil || config.server.ReadTimeout < 0 {
+		fail("READ_TIMEOUT must be a duration such as 10s, or 0 for no limit, got %q", values["READ_TIMEOUT"])
+	}
+	config.server.WriteTimeout, err = time.ParseDuration(values["WRITE_TIMEOUT"])
+	if err != nil || config.server.WriteTimeout < 0 {
+		fail("WRITE_TIMEOUT must be a duration such as 30s, or 0 for no limit, got %q", values["WRITE_TIMEOUT"])
+	}
+	config.logLevel, err = logging.ParseLevel(values["LOG_LEVEL"])
+	if err != nil {
+		fail("LOG_LEVEL must be debug, info, warn or error, got %q", values["LOG_LEVEL"])
+	}
+	return config, problems
+}
+
+// printable returns the effective settings as they would be written in a
+// config file, with the secret ones redacted.
+func (config *config) printable() yaml.MapSlice {
+	printed := make(yaml.MapSlice, 0, len(settings))
+	for _, setting := range settings {
+		value := config.values[setting.name]
+		if setting.secret && value != "" {
+			value = "REDACTED"
+		}
+		printed = append(printed, yaml.MapItem{Key: setting.key(), Value: value})
+	}
+	return printed
+}
+
+// parseAPIKeys reads a comma separated list of owner:key pairs.
+func parseAPIKeys(value string) (http.StaticKeys, error) {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("expected owner:key but got %q", pair)
+		}
+		keys[parts[0]] = parts[1]
+	}
+	return http.NewStaticKeys(keys), nil
+}
+
+// parseBlocklists reads a comma separated list of format:path pairs.
+func parseBlocklists(value string) ([]blocklist.Source, error) {
+	sources := make([]blocklist.Source, 0)
+	for _, pair := range splitList(value) {
+		parts := strings.SplitN(pair, ":", 2)
+		format, ok := blocklistFormats[parts[0]]
+		if len(parts) != 2 || !ok || parts[1] == "" {
+			return nil, fmt.Errorf("expected format:path with format hosts, prefixes, patterns or hash_prefixes but got %q", pair)
+		}
+		sources = append(sources, blocklist.Source{Format: format, Path: parts[1]})
+	}
+	return sources, nil
+}
+
+// parseRateLimit reads a limit given as requests per minute, optionally
+// followed by a slash and the burst size. The burst defaults to the per minute
+// rate.
+func parseRateLimit(value string) (http.RateLimit, error) {
+	parts := strings.SplitN(value, "/", 2)
+	perMinute, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return http.RateLimit{}, fmt.Errorf("expected requests per minute but got %q", value)
+	}
+	burst := perMinute
+	if len(parts) == 2 {
+		burst, err = strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return http.RateLimit{}, fmt.Errorf("expected burst size but got %q", value)
+		}
+	}
+	return http.RateLimit{PerMinute: float64(perMinute), Burst: int(burst)}, nil
+}
+
+// splitList reads a comma separated list, which may be empty.
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
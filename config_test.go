@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shorty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	content := "repo_url: ssh://file\nrepo_private_key: key\nport: 9000\norigin: https://file\nallowed_domains: [a.com, b.com]\n"
+	err = ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"CONFIG_FILE": path, "PORT": "9100", "ORIGIN": "https://env"}
+	flags := configFlags()
+	err = flags.Parse([]string{"-port", "9200", "serve"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(flags, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if config.repository.RepoURL != "ssh://file" || config.server.Origin != "https://env" || config.server.Port != 9200 {
+		t.Fatalf("expected flags over env over file, got %+v", config.values)
+	}
+	if domains := config.policy.Allow; len(domains) != 2 || domains[1] != "b.com" {
+		t.Fatalf("expected list from file, got %v", domains)
+	}
+	if config.repository.URLFilePath != "urls.json" {
+		t.Fatalf("expected default file path, got %v", config.repository.URLFilePath)
+	}
+}
+
+func TestReadsTOMLLikeYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shorty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"config.yaml": "repo_url: ssh://file\nrepo_private_key: |\n  line one\n  line two\nport: 9000\n" +
+			"allowed_domains: [a.com, \"*.b.com\"]\nbookmarklet: true\nwrite_rate_limit: 1.5\n",
+		"config.toml": "# The same settings\nrepo_url = \"ssh://file\"\nrepo_private_key = \"\"\"\nline one\nline two\n\"\"\"\n" +
+			"port = 9000\nallowed_domains = [\n  \"a.com\",\n  '*.b.com', # trailing comma\n]\nbookmarklet = true\nwrite_rate_limit = 1.5\n",
+	}
+	read := make(map[string]map[string]string)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err = ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read[name] = make(map[string]string)
+		problems := readConfigFile(path, read[name])
+		if len(problems) > 0 {
+			t.Fatalf("unexpected problems reading %v: %v", name, problems)
+		}
+	}
+	if !reflect.DeepEqual(read["config.yaml"], read["config.toml"]) {
+		t.Fatalf("expected the same settings from both files, got %v and %v", read["config.yaml"], read["config.toml"])
+	}
+	if read["config.toml"]["ALLOWED_DOMAINS"] != "a.com,*.b.com" || read["config.toml"]["REPO_PRIVATE_KEY"] != "line one\nline two\n" {
+		t.Fatalf("unexpected settings %v", read["config.toml"])
+	}
+}
+
+func TestRejectsConfigFilesInOtherFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shorty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(`{"port": 9000}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := readConfigFile(path, make(map[string]string))
+	if len(problems) != 1 || !strings.Contains(problems[0], "must be YAML or TOML") {
+		t.Fatalf("expected the JSON file to be rejected, got %v", problems)
+	}
+}
+
+func TestReportsEveryConfigProblem(t *testing.T) {
+	env := map[string]string{"REPO_PRIVATE_KEY": "key", "PORT": "port", "DEDUPE": "sometimes", "WRITE_RATE_LIMIT": "fast"}
+	flags := configFlags()
+	err := flags.Parse([]string{"-bookmarklet", "maybe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadConfig(flags, func(name string) string { return env[name] })
+	problems, ok := err.(configErrors)
+	if !ok {
+		t.Fatalf("expected config errors, got %v", err)
+	}
+	if len(problems) != 5 {
+		t.Fatalf("expected 5 problems, got %v", problems)
+	}
+}
+
+func TestRequiresKeysForBookmarklet(t *testing.T) {
+	env := map[string]string{"REPO_URL": "ssh://repo", "REPO_PRIVATE_KEY": "private", "BOOKMARKLET": "true"}
+	_, err := loadConfig(configFlags(), func(name string) string { return env[name] })
+	problems, ok := err.(configErrors)
+	if !ok || len(problems) != 1 || !strings.Contains(problems[0], "BOOKMARKLET needs API keys") {
+		t.Fatalf("expected the bookmarklet without keys to be rejected, got %v", err)
+	}
+	env["API_KEYS"] = "team:key"
+	_, err = loadConfig(configFlags(), func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestRedactsSecrets(t *testing.T) {
+	env := map[string]string{"REPO_URL": "ssh://repo", "REPO_PRIVATE_KEY": "private", "API_KEYS": "team:key"}
+	config, err := loadConfig(configFlags(), func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, item := range config.printable() {
+		switch item.Key {
+		case "repo_private_key", "api_keys":
+			if item.Value != "REDACTED" {
+				t.Fatalf("expected %v to be redacted, got %v", item.Key, item.Value)
+			}
+		case "repo_url":
+			if item.Value != "ssh://repo" {
+				t.Fatalf("expected repo URL to be printed, got %v", item.Value)
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package entities
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// CanonicalOptions enable the normalizations that may change which page a URL
+// points to, for sites that give meaning to parameter order or names.
+type CanonicalOptions struct {
+	SortQuery     bool
+	StripTracking bool
+}
+
+// trackingParams are query parameters added by analytics and ad platforms,
+// on top of any starting with utm_.
+var trackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"dclid":   true,
+	"msclkid": true,
+	"yclid":   true,
+	"igshid":  true,
+	"mc_cid":  true,
+	"mc_eid":  true,
+	"_ga":     true,
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// CanonicalURL normalizes target so that URLs pointing to the same page compare
+// equal. The scheme and host are lowercased, default ports are dropped, an
+// empty path becomes / and an empty query is removed. Percent encoded
+// unreserved characters are decoded and other escapes uppercased. A nil
+// options applies none of the optional normalizations.
+func CanonicalURL(target string, options *CanonicalOptions) (string, error) {
+	if options == nil {
+		options = new(CanonicalOptions)
+	}
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return "", &ErrInvalidURL{target}
+	}
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", &ErrInvalidURL{target}
+	}
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port := parsed.Port(); port != "" && port != defaultPorts[parsed.Scheme] {
+		host += ":" + port
+	}
+	parsed.Host = host
+	path := normalizeEscapes(parsed.EscapedPath())
+	if path == "" {
+		path = "/"
+	}
+	query := normalizeQuery(normalizeEscapes(parsed.RawQuery), options)
+	canonical := parsed.Scheme + "://"
+	if parsed.User != nil {
+		canonical += parsed.User.String() + "@"
+	}
+	canonical += parsed.Host + path
+	if query != "" {
+		canonical += "?" + query
+	}
+	if parsed.Fragment != "" {
+		canonical += "#" + parsed.EscapedFragment()
+	}
+	return canonical, nil
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// normalizeEscapes decodes escaped unreserved characters and uppercases the
+// hex digits of the remaining escapes, as described in RFC 3986 section 6.2.2.
+func normalizeEscapes(escaped string) string {
+	var normalized strings.Builder
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] == '%' && i+2 < len(escaped) {
+			high, highOK := unhex(escaped[i+1])
+			low, lowOK := unhex(escaped[i+2])
+			if highOK && lowOK {
+				if c := high<<4 | low; isUnreserved(c) {
+					normalized.WriteByte(c)
+				} else {
+					normalized.WriteString(strings.ToUpper(escaped[i : i+3]))
+				}
+				i += 2
+				continue
+			}
+		}
+		normalized.WriteByte(escaped[i])
+	}
+	return normalized.String()
+}
+
+// normalizeQuery applies the optional query normalizations. It works on the
+// raw query so that the encoding of the parameters is kept as is.
+func normalizeQuery(query string, options *CanonicalOptions) string {
+	if query == "" || !options.SortQuery && !options.StripTracking {
+		return query
+	}
+	params := make([]string, 0)
+	for _, param := range strings.Split(query, "&") {
+		if param == "" {
+			continue
+		}
+		if options.StripTracking {
+			name, err := url.QueryUnescape(strings.SplitN(param, "=", 2)[0])
+			if err == nil && (trackingParams[strings.ToLower(name)] || strings.HasPrefix(strings.ToLower(name), "utm_")) {
+				continue
+			}
+		}
+		params = append(params, param)
+	}
+	if options.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool {
+			return strings.SplitN(params[i], "=", 2)[0] < strings.SplitN(params[j], "=", 2)[0]
+		})
+	}
+	return strings.Join(params, "&")
+}
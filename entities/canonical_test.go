@@ -0,0 +1,44 @@
+package entities
+
+import "testing"
+
+func TestCanonicalizesURLs(t *testing.T) {
+	tests := []struct {
+		target    string
+		options   *CanonicalOptions
+		canonical string
+	}{
+		{target: "HTTPS://Example.COM", canonical: "https://example.com/"},
+		{target: "https://example.com./", canonical: "https://example.com/"},
+		{target: "http://example.com:80/page", canonical: "http://example.com/page"},
+		{target: "https://example.com:443/?", canonical: "https://example.com/"},
+		{target: "https://example.com:8443/", canonical: "https://example.com:8443/"},
+		{target: "http://[2001:DB8::1]:80/", canonical: "http://[2001:db8::1]/"},
+		{target: "https://example.com/%7euser/%2f%3F", canonical: "https://example.com/~user/%2F%3F"},
+		{target: "https://example.com/Path?b=2&a=1#Top", canonical: "https://example.com/Path?b=2&a=1#Top"},
+		{target: "https://example.com/?b=2&a=1&a=0", options: &CanonicalOptions{SortQuery: true},
+			canonical: "https://example.com/?a=1&a=0&b=2"},
+		{target: "https://example.com/?id=1&utm_source=mail&fbclid=x&UTM_Medium=y", options: &CanonicalOptions{StripTracking: true},
+			canonical: "https://example.com/?id=1"},
+		{target: "https://example.com/?utm_source=mail", options: &CanonicalOptions{StripTracking: true},
+			canonical: "https://example.com/"},
+	}
+	for _, test := range tests {
+		canonical, err := CanonicalURL(test.target, test.options)
+		if err != nil {
+			t.Fatalf("unexpected error %v for %v", err, test.target)
+		}
+		if canonical != test.canonical {
+			t.Fatalf("expected %v to become %v, got %v", test.target, test.canonical, canonical)
+		}
+	}
+}
+
+func TestCanonicalRejectsNonHTTPURLs(t *testing.T) {
+	for _, target := range []string{"ftp://example.com", "example.com", "https://exa mple.com/%zz"} {
+		_, err := CanonicalURL(target, nil)
+		if _, ok := err.(*ErrInvalidURL); !ok {
+			t.Fatalf("expected invalid URL error for %v, got %v", target, err)
+		}
+	}
+}
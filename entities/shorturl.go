@@ -4,17 +4,65 @@ import (
 	"fmt"
 	"net/url"
 	"regexp"
+	"strings"
 	"time"
 )
 
 type ShortURL struct {
-	Target  string
-	ShortID string
-	Expires time.Time
+	Target string
+	// Canonical is the normalized form of Target, used to find other URLs
+	// pointing to the same page. Target is still the one redirected to.
+	Canonical string
+	ShortID   string
+	Expires   time.Time
+	Created   time.Time
+	// Owner identifies who may modify or delete the URL. URLs created without
+	// authentication have no owner.
+	Owner string
+	// Quarantined is the reason the URL stopped redirecting after its target
+	// was found to be malicious. It is empty for URLs in good standing.
+	Quarantined string
+	Redirect    RedirectType
+	// Interstitial sends visitors through a warning page before redirecting
+	// them to a domain outside of the organization.
+	Interstitial bool
+	Metadata
+}
+
+// RedirectType is the HTTP status code used to redirect to the target.
+type RedirectType int
+
+const (
+	// DefaultRedirect leaves the choice to the server configuration.
+	DefaultRedirect   RedirectType = 0
+	MovedPermanently  RedirectType = 301
+	Found             RedirectType = 302
+	TemporaryRedirect RedirectType = 307
+	PermanentRedirect RedirectType = 308
+)
+
+// Permanent reports whether clients may remember the redirect.
+func (redirect RedirectType) Permanent() bool {
+	return redirect == MovedPermanently || redirect == PermanentRedirect
+}
+
+// Metadata holds optional information used to describe and organize links.
+type Metadata struct {
+	Title       string
+	Description string
+	Tags        []string
+	Creator     string
 }
 
 var idRegexp = regexp.MustCompile(`^[[:alnum:]]+$`)
 
+var tagRegexp = regexp.MustCompile(`^[[:alnum:]][[:alnum:]_-]*$`)
+
+const (
+	maxTags      = 16
+	maxTagLength = 32
+)
+
 type ErrInvalidURL struct {
 	url string
 }
@@ -31,6 +79,30 @@ func (err *ErrInvalidID) Error() string {
 	return fmt.Sprintf("id %v is not alphanumeric", err.id)
 }
 
+type ErrInvalidTag struct {
+	tag string
+}
+
+func (err *ErrInvalidTag) Error() string {
+	return fmt.Sprintf("tag %q must be at most %v alphanumeric, dash or underscore characters", err.tag, maxTagLength)
+}
+
+type ErrInvalidRedirect struct {
+	redirect RedirectType
+}
+
+func (err *ErrInvalidRedirect) Error() string {
+	return fmt.Sprintf("redirect type %v must be one of 301, 302, 307 or 308", int(err.redirect))
+}
+
+type ErrTooManyTags struct {
+	count int
+}
+
+func (err *ErrTooManyTags) Error() string {
+	return fmt.Sprintf("got %v tags but a URL can have at most %v", err.count, maxTags)
+}
+
 func NewShortURL(target string, shortID string) (*ShortURL, error) {
 	parsedTarget, err := url.Parse(target)
 	if err != nil {
@@ -42,9 +114,50 @@ func NewShortURL(target string, shortID string) (*ShortURL, error) {
 	if !idRegexp.MatchString(shortID) {
 		return nil, &ErrInvalidID{shortID}
 	}
+	canonical, err := CanonicalURL(target, nil)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
 	return &ShortURL{
-		Target:  target,
-		ShortID: shortID,
-		Expires: time.Now().Add(time.Hour * 24 * 7),
+		Target:    target,
+		Canonical: canonical,
+		ShortID:   shortID,
+		Expires:   now.Add(time.Hour * 24 * 7),
+		Created:   now,
 	}, nil
 }
+
+// SetMetadata validates and assigns the given metadata. Tags are stored
+// lowercased and without duplicates.
+func (url *ShortURL) SetMetadata(metadata *Metadata) error {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range metadata.Tags {
+		if len(tag) > maxTagLength || !tagRegexp.MatchString(tag) {
+			return &ErrInvalidTag{tag}
+		}
+		tag = strings.ToLower(tag)
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxTags {
+		return &ErrTooManyTags{len(tags)}
+	}
+	url.Metadata = *metadata
+	url.Tags = tags
+	return nil
+}
+
+// SetRedirect validates and assigns the redirect type.
+func (url *ShortURL) SetRedirect(redirect RedirectType) error {
+	switch redirect {
+	case DefaultRedirect, MovedPermanently, Found, TemporaryRedirect, PermanentRedirect:
+		url.Redirect = redirect
+		return nil
+	default:
+		return &ErrInvalidRedirect{redirect}
+	}
+}
@@ -86,3 +86,81 @@ func TestShortenedURLLastsOneWeek(t *testing.T) {
 		t.Fatalf("incorrect expiration date set at %v", url.Expires)
 	}
 }
+
+func TestRecordsCreationTime(t *testing.T) {
+	url, err := NewShortURL("https://example.com", "abc")
+	if err != nil {
+		t.Fatalf("encountered error %v", err)
+	}
+	diff := time.Since(url.Created)
+	if diff < 0 || diff > time.Second {
+		t.Fatalf("incorrect creation date set at %v", url.Created)
+	}
+}
+
+func TestValidatesTags(t *testing.T) {
+	tests := []struct {
+		tags  []string
+		valid bool
+	}{
+		{tags: nil, valid: true},
+		{tags: []string{"docs"}, valid: true},
+		{tags: []string{"team-a", "q3_2021", "Docs"}, valid: true},
+		{tags: []string{""}, valid: false},
+		{tags: []string{"-leading"}, valid: false},
+		{tags: []string{"with space"}, valid: false},
+		{tags: []string{"🌵"}, valid: false},
+		{tags: []string{"abcdefghijklmnopqrstuvwxyz0123456789"}, valid: false},
+		{tags: []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m", "n", "o", "p", "q"}, valid: false},
+	}
+	for _, test := range tests {
+		url, err := NewShortURL("https://example.com", "abc")
+		if err != nil {
+			t.Fatalf("encountered error %v", err)
+		}
+		err = url.SetMetadata(&Metadata{Tags: test.tags})
+		if err == nil && !test.valid {
+			t.Fatalf("accepted tags %v when supposed to error", test.tags)
+		} else if err != nil && test.valid {
+			t.Fatalf("threw error %v for tags %v when supposed to accept", err, test.tags)
+		}
+	}
+}
+
+func TestNormalizesTags(t *testing.T) {
+	url, err := NewShortURL("https://example.com", "abc")
+	if err != nil {
+		t.Fatalf("encountered error %v", err)
+	}
+	err = url.SetMetadata(&Metadata{Title: "Example", Tags: []string{"Docs", "docs", "team"}})
+	if err != nil {
+		t.Fatalf("encountered error %v", err)
+	}
+	if url.Title != "Example" || len(url.Tags) != 2 || url.Tags[0] != "docs" || url.Tags[1] != "team" {
+		t.Fatalf("metadata not assigned correctly: %+v", url)
+	}
+}
+
+func TestValidatesRedirect(t *testing.T) {
+	tests := []struct {
+		redirect RedirectType
+		valid    bool
+	}{
+		{redirect: DefaultRedirect, valid: true},
+		{redirect: MovedPermanently, valid: true},
+		{redirect: Found, valid: true},
+		{redirect: TemporaryRedirect, valid: true},
+		{redirect: PermanentRedirect, valid: true},
+		{redirect: 200, valid: false},
+		{redirect: 303, valid: false},
+	}
+	for _, test := range tests {
+		url := new(ShortURL)
+		err := url.SetRedirect(test.redirect)
+		if err == nil && !test.valid {
+			t.Fatalf("accepted redirect %v", test.redirect)
+		} else if err != nil && test.valid {
+			t.Fatalf("rejected redirect %v with %v", test.redirect, err)
+		}
+	}
+}
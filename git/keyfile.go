@@ -0,0 +1,38 @@
+package git
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// keyFileType is the format of the API key file kept in the repository. Only
+// the hashes of the keys are stored, so that the file can be committed without
+// leaking them.
+type keyFileType struct {
+	Keys []*keyRecord `json:"keys"`
+}
+
+type keyRecord struct {
+	Owner  string `json:"owner"`
+	SHA256 string `json:"sha256"`
+}
+
+var sha256Regexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// parseKeyFile returns the owner of each key in the file, indexed by hash.
+func parseKeyFile(content []byte) (map[string]string, error) {
+	keyFile := new(keyFileType)
+	err := json.Unmarshal(content, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string]string)
+	for _, key := range keyFile.Keys {
+		if key.Owner == "" || !sha256Regexp.MatchString(key.SHA256) {
+			return nil, fmt.Errorf("key %+v must have an owner and a lowercase hex encoded sha256 hash", key)
+		}
+		owners[key.SHA256] = key.Owner
+	}
+	return owners, nil
+}
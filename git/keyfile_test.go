@@ -0,0 +1,29 @@
+package git
+
+import "testing"
+
+func TestParsesKeyFile(t *testing.T) {
+	hash := "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"
+	owners, err := parseKeyFile([]byte(`{"keys": [{"owner": "newsletter", "sha256": "` + hash + `"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owners[hash] != "newsletter" {
+		t.Fatalf("expected key to belong to newsletter, got %v", owners)
+	}
+}
+
+func TestRejectsMalformedKeys(t *testing.T) {
+	invalidFiles := []string{
+		`{"keys": [{"owner": "", "sha256": "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"}]}`,
+		`{"keys": [{"owner": "newsletter", "sha256": "secret"}]}`,
+		`{"keys": [{"owner": "newsletter", "sha256": "2BB80D537B1DA3E38BD30361AA855686BDE0EACD7162FEF6A25FE97BF527A25B"}]}`,
+		`not json`,
+	}
+	for _, content := range invalidFiles {
+		_, err := parseKeyFile([]byte(content))
+		if err == nil {
+			t.Fatalf("expected error for %v", content)
+		}
+	}
+}
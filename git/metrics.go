@@ -0,0 +1,53 @@
+package git
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Metrics records the git operations of a repository.
+type Metrics interface {
+	// ObserveOperation records a fetch, pull, commit or push.
+	ObserveOperation(operation string, duration time.Duration, failed bool)
+	// CountPushConflict counts a push rejected because the remote changed.
+	CountPushConflict()
+	SetActiveLinks(count int)
+}
+
+// noMetrics is used when the configuration sets no metrics.
+type noMetrics struct{}
+
+func (noMetrics) ObserveOperation(operation string, duration time.Duration, failed bool) {}
+func (noMetrics) CountPushConflict()                                                     {}
+func (noMetrics) SetActiveLinks(count int)                                               {}
+
+// timed runs a git operation and records its duration. Errors that only
+// mean there was nothing to do are not counted as failures.
+func (repository *Repository) timed(operation string, run func() error) error {
+	start := time.Now()
+	err := run()
+	failed := err != nil && err != git.NoErrAlreadyUpToDate && err != transport.ErrEmptyRemoteRepository
+	repository.metrics.ObserveOperation(operation, time.Since(start), failed)
+	return err
+}
+
+// isPushConflict tells whether a push was rejected because the remote branch
+// moved. go-git only reports it in the error message.
+func isPushConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "non-fast-forward")
+}
+
+// reportLinks updates the number of links that haven't expired.
+func (repository *Repository) reportLinks() {
+	now := time.Now()
+	active := 0
+	for _, url := range repository.urls {
+		if url.Expires.After(now) {
+			active++
+		}
+	}
+	repository.metrics.SetActiveLinks(active)
+}
@@ -1,187 +1,633 @@
 package git
 
 import (
+	"context"
 	"encoding/base32"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/carlos-marchal/shorty/entities"
+	"github.com/carlos-marchal/shorty/logging"
 	"github.com/carlos-marchal/shorty/usecases/shorturl"
 	gossh "golang.org/x/crypto/ssh"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-billy/v5/memfs"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/go-git/go-git/v5/storage/memory"
 )
 
+// defaultFetchTimeout is used when the configuration sets no fetch timeout.
+const defaultFetchTimeout = 5 * time.Second
+
+// WritePolicy decides what happens to writes while the remote is unreachable.
+type WritePolicy int
+
+const (
+	// RejectWrites fails every write until the remote is reachable again.
+	RejectWrites WritePolicy = iota
+	// QueueWrites applies writes in memory and pushes them once the remote is
+	// reachable again.
+	QueueWrites
+)
+
 type Config struct {
-	RepoURL     string
-	PrivateKey  string
-	URLFilePath string
-	CommitName  string
-	CommitEmail string
+	RepoURL       string
+	PrivateKey    string
+	URLFilePath   string
+	CommitName    string
+	CommitEmail   string
+	OfflineWrites WritePolicy
+	// KeysFilePath is the file in the repo listing the accepted API keys. It
+	// is optional.
+	KeysFilePath string
+	// FetchTimeout bounds each fetch, after which the remote is considered
+	// unreachable. It defaults to five seconds.
+	FetchTimeout time.Duration
+	// Metrics records the git operations. It is optional.
+	Metrics Metrics
 }
 
 type Repository struct {
-	config      *Config
-	repository  *git.Repository
-	worktree    *git.Worktree
-	fs          billy.Filesystem
-	urls        []*entities.ShortURL
-	urlByID     map[string]*entities.ShortURL
-	urlByTarget map[string]*entities.ShortURL
-	serial      uint
-	keys        *ssh.PublicKeys
-}
-
-type urlFileType struct {
-	URLs   []*entities.ShortURL
-	Serial uint
-}
-
-func (repository *Repository) readRemote() error {
-	err := repository.repository.Fetch(&git.FetchOptions{
-		Auth:       repository.keys,
-		RemoteName: "origin",
-		Depth:      1,
-	})
+	config     *Config
+	repository *git.Repository
+	worktree   *git.Worktree
+	fs         billy.Filesystem
+	urls       []*entities.ShortURL
+	urlByID    map[string]*entities.ShortURL
+	// urlByTarget indexes the URLs by their canonical target. Several URLs
+	// may share one, depending on the dedupe mode they were created with.
+	urlByTarget  map[string][]*entities.ShortURL
+	serial       uint
+	keys         *ssh.PublicKeys
+	fetchTimeout time.Duration
+	// fetching is closed once a fetch given up on finishes. It is nil if
+	// there is none.
+	fetching chan struct{}
+	// head is the hash of the last commit read or written, kept apart so
+	// that it can be reported while a fetch uses the storage.
+	head string
+	// busy is held by whoever is using the repository. It is a channel so
+	// that requests can stop waiting for it once their context is done.
+	busy      chan struct{}
+	online    bool
+	lastFetch time.Time
+	lastPush  time.Time
+	pending   []*pendingWrite
+	loadErr   error
+	keyOwners map[string]string
+	metrics   Metrics
+	// closed rejects every write, so that none is accepted after the
+	// pending ones were flushed on exit.
+	closed bool
+	// snapshot is what Health and KeyOwner report. It is taken whenever the
+	// repository is unlocked, so that they never wait behind a push.
+	snapshot     snapshot
+	snapshotLock sync.RWMutex
+}
+
+// snapshot is the state of the repository as of the last operation.
+type snapshot struct {
+	health    shorturl.Health
+	keyOwners map[string]string
+}
+
+// ErrUnflushedWrites means that writes queued while offline could not be
+// pushed when closing the repository, and are lost.
+type ErrUnflushedWrites struct {
+	Count int
+}
+
+func (err *ErrUnflushedWrites) Error() string {
+	return fmt.Sprintf("%v writes could not be pushed to the remote", err.Count)
+}
+
+// pendingWrite is a change accepted while offline. It holds either a stored
+// URL, a deleted URL or the serial number reached after generating an ID.
+type pendingWrite struct {
+	url     *entities.ShortURL
+	deleted *entities.ShortURL
+	serial  uint
+}
+
+// lockContext waits for the repository to be free, unless ctx is done first.
+func (repository *Repository) lockContext(ctx context.Context) error {
+	select {
+	case repository.busy <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return &shorturl.ErrRepoTimeout{Err: fmt.Errorf("waiting for the repository: %w", ctx.Err())}
+	}
+}
+
+func (repository *Repository) lock() {
+	repository.busy <- struct{}{}
+}
+
+func (repository *Repository) unlock() {
+	repository.takeSnapshot()
+	<-repository.busy
+}
+
+// takeSnapshot copies the state reported by Health and KeyOwner. The key owners
+// are shared, as the key file replaces them instead of changing them.
+func (repository *Repository) takeSnapshot() {
+	repository.snapshotLock.Lock()
+	defer repository.snapshotLock.Unlock()
+	repository.snapshot = snapshot{
+		health: shorturl.Health{
+			Backend:       "git",
+			Online:        repository.online,
+			LastFetch:     repository.lastFetch,
+			LastPush:      repository.lastPush,
+			PendingWrites: len(repository.pending),
+			Head:          repository.head,
+			Links:         len(repository.urls),
+			Serial:        repository.serial,
+		},
+		keyOwners: repository.keyOwners,
+	}
+}
+
+// errFetchInProgress means that a fetch given up on earlier is still running.
+var errFetchInProgress = errors.New("an earlier fetch is still running")
+
+// fetch fetches the remote, waiting at most for the fetch timeout. go-git only
+// honors the context once connected, so a fetch given up on may keep running
+// in the background. Until it finishes the storage is left to it, and every
+// later fetch fails right away.
+func (repository *Repository) fetch(ctx context.Context) error {
+	if repository.fetching != nil {
+		select {
+		case <-repository.fetching:
+			repository.fetching = nil
+		default:
+			return errFetchInProgress
+		}
+	}
+	fetchCtx, cancel := context.WithTimeout(ctx, repository.fetchTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		done <- repository.timed("fetch", func() error {
+			return repository.repository.FetchContext(fetchCtx, &git.FetchOptions{
+				Auth:       repository.keys,
+				RemoteName: "origin",
+				Depth:      1,
+			})
+		})
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-fetchCtx.Done():
+		repository.fetching = finished
+		return fmt.Errorf("fetching from remote: %w", fetchCtx.Err())
+	}
+}
+
+// readRemote brings the in memory state up to date with the remote. If the
+// remote can't be reached the last known state is kept and served instead.
+// The fetch has a deadline of its own, shorter than those of requests, so that
+// a remote that hangs is treated as unreachable while there's still time to
+// answer.
+func (repository *Repository) readRemote(ctx context.Context) error {
+	err := repository.fetch(ctx)
+	if err != nil && ctx.Err() != nil {
+		return &shorturl.ErrRepoTimeout{Err: fmt.Errorf("fetching from remote: %w", ctx.Err())}
+	}
 	switch err {
-	case nil:
-		err = repository.worktree.Pull(&git.PullOptions{
+	case nil, git.NoErrAlreadyUpToDate, transport.ErrEmptyRemoteRepository:
+		repository.online = true
+		repository.lastFetch = time.Now()
+	default:
+		if repository.online {
+			logging.FromContext(ctx).Warn("Serving the last known state, the remote is unreachable", "error", err)
+		}
+		repository.online = false
+		return nil
+	}
+	if len(repository.pending) > 0 {
+		return repository.reconcile(ctx)
+	}
+	// A fetch given up on may have brought new commits when it finished, in
+	// which case there is nothing left to fetch but they still have to be
+	// pulled.
+	if err == transport.ErrEmptyRemoteRepository || err == git.NoErrAlreadyUpToDate && repository.atRemote() {
+		if repository.loadErr != nil {
+			return &shorturl.ErrRepoInternal{Err: repository.loadErr}
+		}
+		return nil
+	}
+	err = repository.timed("pull", func() error {
+		return repository.worktree.PullContext(ctx, &git.PullOptions{
 			Auth:       repository.keys,
 			RemoteName: "origin",
 			Depth:      1,
 		})
-		if err != nil {
-			return &shorturl.ErrRepoInternal{}
+	})
+	if err != nil && ctx.Err() != nil {
+		return &shorturl.ErrRepoTimeout{Err: fmt.Errorf("pulling from remote: %w", ctx.Err())}
+	}
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return &shorturl.ErrRepoInternal{Err: fmt.Errorf("pulling from remote: %w", err)}
+	}
+	return repository.readRemoteNoFetch(ctx)
+}
+
+// reconcile replays the writes queued while offline on top of the current
+// remote state and pushes the result. Writes to URLs whose ID was taken in the
+// meantime by somebody else are dropped.
+func (repository *Repository) reconcile(ctx context.Context) error {
+	err := repository.resetToRemoteState(ctx)
+	if err != nil {
+		return err
+	}
+	err = repository.writeRemote(ctx, fmt.Sprintf("Syncing %v changes made while offline", len(repository.pending)))
+	if err != nil {
+		logging.FromContext(ctx).Warn("Could not push the writes queued while offline", "pending", len(repository.pending), "error", err)
+		// Running out of time says nothing about the remote, which is only
+		// considered offline when the push itself failed.
+		_, timedOut := err.(*shorturl.ErrRepoTimeout)
+		if !timedOut {
+			repository.online = false
+		}
+		resetErr := repository.resetToRemote()
+		if resetErr != nil || !timedOut {
+			return resetErr
+		}
+		return err
+	}
+	logging.FromContext(ctx).Info("Pushed the writes queued while offline", "pending", len(repository.pending))
+	repository.pending = nil
+	return nil
+}
+
+// resetToRemoteState brings the in memory state back to that of the remote as
+// last fetched, dropping the writes in progress along with any commit of them,
+// and replays the writes queued while offline on top. A fetch given up on may
+// have moved the remote since it was last read, so the URL file is read again.
+func (repository *Repository) resetToRemoteState(ctx context.Context) error {
+	err := repository.resetToRemote()
+	if err != nil {
+		return err
+	}
+	err = repository.readRemoteNoFetch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, write := range repository.pending {
+		if write.serial > repository.serial {
+			repository.serial = write.serial
+		}
+		if write.url != nil {
+			existing := repository.urlByID[write.url.ShortID]
+			if existing == nil || sameURL(existing, write.url) {
+				repository.storeURL(write.url)
+			}
 		}
-		return repository.readRemoteNoFetch()
-	case git.NoErrAlreadyUpToDate:
+		if write.deleted != nil {
+			existing := repository.urlByID[write.deleted.ShortID]
+			if existing != nil && sameURL(existing, write.deleted) {
+				repository.removeURL(existing.ShortID)
+			}
+		}
+	}
+	return nil
+}
+
+// atRemote reports whether HEAD is at the commit of the remote branch as last
+// fetched, or there's none to compare.
+func (repository *Repository) atRemote() bool {
+	head, err := repository.repository.Head()
+	if err != nil {
+		return true
+	}
+	remoteName := plumbing.NewRemoteReferenceName("origin", head.Name().Short())
+	remote, err := repository.repository.Reference(remoteName, true)
+	if err != nil {
+		return true
+	}
+	return head.Hash() == remote.Hash()
+}
+
+// resetToRemote drops any local commit that didn't make it to the remote.
+func (repository *Repository) resetToRemote() error {
+	head, err := repository.repository.Head()
+	if err == plumbing.ErrReferenceNotFound {
 		return nil
-	case transport.ErrEmptyRemoteRepository:
+	} else if err != nil {
+		return &shorturl.ErrRepoInternal{Err: fmt.Errorf("reading head: %w", err)}
+	}
+	remoteName := plumbing.NewRemoteReferenceName("origin", head.Name().Short())
+	remote, err := repository.repository.Reference(remoteName, true)
+	if err == plumbing.ErrReferenceNotFound {
 		return nil
-	default:
-		return &shorturl.ErrRepoInternal{}
+	} else if err != nil {
+		return &shorturl.ErrRepoInternal{Err: fmt.Errorf("reading remote branch: %w", err)}
+	}
+	err = repository.worktree.Reset(&git.ResetOptions{Commit: remote.Hash(), Mode: git.HardReset})
+	if err != nil {
+		return &shorturl.ErrRepoInternal{Err: fmt.Errorf("resetting to remote: %w", err)}
+	}
+	repository.readHead()
+	return nil
+}
+
+// sameURL reports whether both values are versions of the same URL, as opposed
+// to different URLs that were given the same ID.
+func sameURL(a *entities.ShortURL, b *entities.ShortURL) bool {
+	return a.ShortID == b.ShortID && a.Created.Equal(b.Created)
+}
+
+// storeURL adds url to the in memory state, replacing the URL with the same ID
+// if there is one. It returns the replaced URL, if any.
+func (repository *Repository) storeURL(url *entities.ShortURL) *entities.ShortURL {
+	previous := repository.urlByID[url.ShortID]
+	if previous == nil {
+		repository.urls = append([]*entities.ShortURL{url}, repository.urls...)
+	} else {
+		for i, stored := range repository.urls {
+			if stored == previous {
+				repository.urls[i] = url
+			}
+		}
+		repository.unindexTarget(previous)
+	}
+	repository.urlByID[url.ShortID] = url
+	repository.indexTarget(url)
+	return previous
+}
+
+func (repository *Repository) indexTarget(url *entities.ShortURL) {
+	repository.urlByTarget[url.Canonical] = append(repository.urlByTarget[url.Canonical], url)
+}
+
+func (repository *Repository) unindexTarget(url *entities.ShortURL) {
+	indexed := repository.urlByTarget[url.Canonical]
+	for i, stored := range indexed {
+		if stored == url {
+			indexed = append(indexed[:i:i], indexed[i+1:]...)
+			break
+		}
+	}
+	if len(indexed) == 0 {
+		delete(repository.urlByTarget, url.Canonical)
+	} else {
+		repository.urlByTarget[url.Canonical] = indexed
+	}
+}
+
+// removeURL removes the URL with the given ID from the in memory state, and
+// returns it.
+func (repository *Repository) removeURL(shortID string) *entities.ShortURL {
+	removed := repository.urlByID[shortID]
+	if removed == nil {
+		return nil
+	}
+	for i, stored := range repository.urls {
+		if stored == removed {
+			repository.urls = append(repository.urls[:i:i], repository.urls[i+1:]...)
+			break
+		}
+	}
+	delete(repository.urlByID, shortID)
+	repository.unindexTarget(removed)
+	return removed
+}
+
+// persist stores the current in memory state in the remote. When the remote is
+// unreachable the write is either queued or rejected, depending on the
+// configured policy. Either way the in memory state goes back to that of the
+// remote, with the queued writes on top, so rejected writes are undone.
+func (repository *Repository) persist(ctx context.Context, commitMessage string, writes ...*pendingWrite) error {
+	if repository.closed {
+		return &shorturl.ErrRepoInternal{Err: errors.New("repository is closed")}
+	}
+	var rejected error = &shorturl.ErrRepoInternal{Err: errors.New("remote is unreachable")}
+	if repository.online {
+		err := repository.writeRemote(ctx, commitMessage)
+		if err == nil {
+			repository.reportLinks()
+			return nil
+		}
+		// Running out of time says nothing about the remote, so the write is
+		// rejected without considering it offline.
+		if _, timedOut := err.(*shorturl.ErrRepoTimeout); !timedOut {
+			repository.online = false
+		}
+		rejected = err
+	}
+	queued := !repository.online && repository.config.OfflineWrites == QueueWrites
+	if queued {
+		repository.pending = append(repository.pending, writes...)
+	}
+	err := repository.resetToRemoteState(ctx)
+	if err != nil {
+		if queued {
+			repository.pending = repository.pending[:len(repository.pending)-len(writes)]
+		}
+		return err
+	}
+	if !queued {
+		return rejected
 	}
+	logging.FromContext(ctx).Warn("Queued write while the remote is unreachable", "commit", commitMessage, "pending", len(repository.pending), "error", rejected)
+	return nil
 }
 
-func (repository *Repository) readRemoteNoFetch() error {
+// readRemoteNoFetch loads the URL file from the worktree. If the file can't be
+// loaded the in memory state is left untouched and loadErr is set, so that the
+// file is never overwritten with the older state.
+func (repository *Repository) readRemoteNoFetch(ctx context.Context) error {
+	repository.loadErr = nil
 	urlFileContent, err := repository.fs.Open(repository.config.URLFilePath)
 	if err != nil {
 		if err.Error() == "file does not exist" {
 			repository.urls = []*entities.ShortURL{}
 			repository.serial = 0
 		} else {
-			return &shorturl.ErrRepoInternal{}
+			return &shorturl.ErrRepoInternal{Err: fmt.Errorf("opening URL file: %w", err)}
 		}
 	} else {
 		rawContent, err := io.ReadAll(urlFileContent)
 		if err != nil {
-			return &shorturl.ErrRepoInternal{}
+			return &shorturl.ErrRepoInternal{Err: fmt.Errorf("reading URL file: %w", err)}
 		}
 		err = urlFileContent.Close()
 		if err != nil {
-			return &shorturl.ErrRepoInternal{}
+			return &shorturl.ErrRepoInternal{Err: fmt.Errorf("closing URL file: %w", err)}
 		}
-		urlFile := new(urlFileType)
-		err = json.Unmarshal(rawContent, urlFile)
+		urlFile, err := parseURLFile(rawContent)
+		repository.loadErr = err
 		if err != nil {
-			return &shorturl.ErrRepoInternal{}
+			return &shorturl.ErrRepoInternal{Err: fmt.Errorf("parsing URL file: %w", err)}
 		}
-		repository.urls = urlFile.URLs
+		repository.urls = urlFile.entities()
 		repository.serial = urlFile.Serial
 	}
 	repository.urlByID = make(map[string]*entities.ShortURL)
-	repository.urlByTarget = make(map[string]*entities.ShortURL)
+	repository.urlByTarget = make(map[string][]*entities.ShortURL)
 	for _, url := range repository.urls {
 		repository.urlByID[url.ShortID] = url
-		repository.urlByTarget[url.Target] = url
+		repository.indexTarget(url)
 	}
+	repository.readKeyFile(ctx)
+	repository.reportLinks()
+	repository.readHead()
 	return nil
 }
 
-func (repository *Repository) writeRemote(commitMessage string) error {
-	file, err := repository.fs.OpenFile(repository.config.URLFilePath, os.O_RDWR, 666)
+// readHead remembers the hash of the current commit, if there is one.
+func (repository *Repository) readHead() {
+	head, err := repository.repository.Head()
+	if err == nil {
+		repository.head = head.Hash().String()
+	}
+}
+
+// readKeyFile loads the API key file from the worktree. If the file is missing
+// or broken no key from it is accepted.
+func (repository *Repository) readKeyFile(ctx context.Context) {
+	repository.keyOwners = make(map[string]string)
+	if repository.config.KeysFilePath == "" {
+		return
+	}
+	file, err := repository.fs.Open(repository.config.KeysFilePath)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		logging.FromContext(ctx).Error("Could not open the key file", "error", err)
+		return
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
 	if err != nil {
-		if err.Error() == "file does not exist" {
-			file, err = repository.fs.Create(repository.config.URLFilePath)
-			if err != nil {
-				return &shorturl.ErrRepoInternal{}
-			}
-		} else {
-			return &shorturl.ErrRepoInternal{}
-		}
+		logging.FromContext(ctx).Error("Could not read the key file", "error", err)
+		return
 	}
-	for i := 0; i < len(repository.urls); i++ {
-		url := repository.urls[i]
-		if url.Expires.Before(time.Now()) {
-			repository.urls = append(repository.urls[:i], repository.urls[i+1:]...)
-			delete(repository.urlByID, url.ShortID)
-			delete(repository.urlByTarget, url.Target)
+	owners, err := parseKeyFile(content)
+	if err != nil {
+		logging.FromContext(ctx).Error("Could not parse the key file", "error", err)
+		return
+	}
+	repository.keyOwners = owners
+}
+
+func (repository *Repository) writeRemote(ctx context.Context, commitMessage string) error {
+	if repository.loadErr != nil {
+		return &shorturl.ErrRepoInternal{Err: fmt.Errorf("URL file could not be loaded: %w", repository.loadErr)}
+	}
+	// Expired URLs are left out of the file, but only dropped from memory once
+	// the push succeeds, as the state is read back from the remote if it
+	// fails.
+	now := time.Now()
+	live := make([]*entities.ShortURL, 0, len(repository.urls))
+	for _, url := range repository.urls {
+		if !url.Expires.Before(now) {
+			live = append(live, url)
 		}
 	}
-	urlFile := &urlFileType{repository.urls, repository.serial}
-	fileContents, err := json.MarshalIndent(urlFile, "", "  ")
+	fileContents, err := formatURLFile(live, repository.serial)
+	if err != nil {
+		return &shorturl.ErrRepoInternal{Err: fmt.Errorf("formatting URL file: %w", err)}
+	}
+	file, err := repository.fs.Create(repository.config.URLFilePath)
 	if err != nil {
-		return &shorturl.ErrRepoInternal{}
+		return &shorturl.ErrRepoInternal{Err: fmt.Errorf("creating URL file: %w", err)}
 	}
 	_, err = file.Write(fileContents)
 	if err != nil {
-		return &shorturl.ErrRepoInternal{}
+		return &shorturl.ErrRepoInternal{Err: fmt.Errorf("writing URL file: %w", err)}
 	}
 	err = file.Close()
 	if err != nil {
-		return &shorturl.ErrRepoInternal{}
+		return &shorturl.ErrRepoInternal{Err: fmt.Errorf("closing URL file: %w", err)}
 	}
 	_, err = repository.worktree.Add(repository.config.URLFilePath)
 	if err != nil {
-		return &shorturl.ErrRepoInternal{}
+		return &shorturl.ErrRepoInternal{Err: fmt.Errorf("staging URL file: %w", err)}
 	}
-	_, err = repository.worktree.Commit(
-		fmt.Sprintf("BOT: %v", commitMessage),
-		&git.CommitOptions{
-			Author: &object.Signature{
-				Name:  repository.config.CommitName,
-				Email: repository.config.CommitEmail,
-				When:  time.Now(),
-			},
-		})
+	err = repository.timed("commit", func() error {
+		_, err := repository.worktree.Commit(
+			fmt.Sprintf("BOT: %v", commitMessage),
+			&git.CommitOptions{
+				Author: &object.Signature{
+					Name:  repository.config.CommitName,
+					Email: repository.config.CommitEmail,
+					When:  time.Now(),
+				},
+			})
+		return err
+	})
 	if err != nil {
-		return &shorturl.ErrRepoInternal{}
+		return &shorturl.ErrRepoInternal{Err: fmt.Errorf("committing: %w", err)}
+	}
+	err = repository.timed("push", func() error {
+		return repository.repository.PushContext(ctx, &git.PushOptions{Auth: repository.keys, RemoteName: "origin"})
+	})
+	if isPushConflict(err) {
+		repository.metrics.CountPushConflict()
+	}
+	if err != nil && ctx.Err() != nil {
+		return &shorturl.ErrRepoTimeout{Err: fmt.Errorf("pushing to remote: %w", ctx.Err())}
 	}
-	err = repository.repository.Push(&git.PushOptions{Auth: repository.keys, RemoteName: "origin"})
 	if err != nil {
-		return &shorturl.ErrRepoInternal{}
+		return &shorturl.ErrRepoInternal{Err: fmt.Errorf("pushing to remote: %w", err)}
 	}
+	repository.lastPush = time.Now()
+	repository.readHead()
+	repository.dropExpired(now)
 	return nil
 }
 
-func NewRepository(config *Config) (*Repository, error) {
+// dropExpired forgets the URLs that expired before now.
+func (repository *Repository) dropExpired(now time.Time) {
+	live := make([]*entities.ShortURL, 0, len(repository.urls))
+	for _, url := range repository.urls {
+		if url.Expires.Before(now) {
+			delete(repository.urlByID, url.ShortID)
+			repository.unindexTarget(url)
+		} else {
+			live = append(live, url)
+		}
+	}
+	repository.urls = live
+}
+
+// NewRepository clones the remote and loads its URLs. ctx bounds the clone.
+func NewRepository(ctx context.Context, config *Config) (*Repository, error) {
 	keys, err := ssh.NewPublicKeys("git", []byte(config.PrivateKey), "")
 	keys.HostKeyCallback = gossh.InsecureIgnoreHostKey()
 	if err != nil {
-		return nil, &shorturl.ErrRepoInternal{}
+		return nil, &shorturl.ErrRepoInternal{Err: fmt.Errorf("parsing private key: %w", err)}
 	}
 	fs := memfs.New()
 	storer := memory.NewStorage()
-	gitRepo, err := git.Clone(storer, fs, &git.CloneOptions{
+	gitRepo, err := git.CloneContext(ctx, storer, fs, &git.CloneOptions{
 		URL:   config.RepoURL,
 		Auth:  keys,
 		Depth: 1,
 	})
+	if err != nil && ctx.Err() != nil {
+		return nil, &shorturl.ErrRepoTimeout{Err: fmt.Errorf("cloning remote: %w", ctx.Err())}
+	}
 	if err != nil && err != transport.ErrEmptyRemoteRepository {
-		return nil, &shorturl.ErrRepoInternal{}
+		return nil, &shorturl.ErrRepoInternal{Err: fmt.Errorf("cloning remote: %w", err)}
 	}
 	worktree, err := gitRepo.Worktree()
 	if err != nil {
-		return nil, &shorturl.ErrRepoInternal{}
+		return nil, &shorturl.ErrRepoInternal{Err: fmt.Errorf("opening worktree: %w", err)}
 	}
 	repository := &Repository{
 		config:      config,
@@ -190,70 +636,258 @@ func NewRepository(config *Config) (*Repository, error) {
 		fs:          fs,
 		urls:        make([]*entities.ShortURL, 0),
 		urlByID:     make(map[string]*entities.ShortURL),
-		urlByTarget: make(map[string]*entities.ShortURL),
+		urlByTarget: make(map[string][]*entities.ShortURL),
 		serial:      0,
 		keys:        keys,
+		busy:        make(chan struct{}, 1),
+		online:      true,
+		lastFetch:   time.Now(),
+		metrics:     config.Metrics,
+	}
+	if repository.metrics == nil {
+		repository.metrics = noMetrics{}
 	}
-	err = repository.readRemoteNoFetch()
+	repository.fetchTimeout = config.FetchTimeout
+	if repository.fetchTimeout <= 0 {
+		repository.fetchTimeout = defaultFetchTimeout
+	}
+	err = repository.readRemoteNoFetch(ctx)
 	if err != nil {
 		return nil, err
 	}
+	repository.takeSnapshot()
 	return repository, nil
 }
 
-func (repository *Repository) GetByURL(target string) (*entities.ShortURL, error) {
-	err := repository.readRemote()
+// Close pushes the writes queued while offline and rejects any later write.
+// It waits for the write in progress, if any, so that nothing is left between
+// commit and push, but gives up once ctx is done.
+func (repository *Repository) Close(ctx context.Context) error {
+	err := repository.lockContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer repository.unlock()
+	repository.closed = true
+	if len(repository.pending) == 0 {
+		return nil
+	}
+	err = repository.readRemote(ctx)
+	if err != nil {
+		return err
+	}
+	if len(repository.pending) > 0 {
+		return &ErrUnflushedWrites{len(repository.pending)}
+	}
+	return nil
+}
+
+// Health reports whether the remote was reachable on the last attempt, when it
+// was last fetched from and pushed to, and what is stored locally. It describes
+// the repository as of the last finished operation, without waiting for the
+// one in progress.
+func (repository *Repository) Health() *shorturl.Health {
+	repository.snapshotLock.RLock()
+	defer repository.snapshotLock.RUnlock()
+	health := repository.snapshot.health
+	return &health
+}
+
+// Sync fetches the remote, pushing the writes queued while offline if it is
+// reachable again.
+func (repository *Repository) Sync(ctx context.Context) error {
+	err := repository.lockContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer repository.unlock()
+	return repository.readRemote(ctx)
+}
+
+// KeyOwner returns the owner of the API key with the given hex encoded SHA-256
+// hash, according to the key file as of the last sync.
+func (repository *Repository) KeyOwner(keyHash string) (string, bool) {
+	repository.snapshotLock.RLock()
+	defer repository.snapshotLock.RUnlock()
+	owner, ok := repository.snapshot.keyOwners[keyHash]
+	return owner, ok
+}
+
+func (repository *Repository) GetByURL(ctx context.Context, canonical string) ([]*entities.ShortURL, error) {
+	err := repository.lockContext(ctx)
 	if err != nil {
 		return nil, err
 	}
-	url := repository.urlByTarget[target]
-	if url == nil {
-		return nil, &shorturl.ErrRepoNotFound{target}
+	defer repository.unlock()
+	err = repository.readRemote(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return url, nil
+	urls := make([]*entities.ShortURL, len(repository.urlByTarget[canonical]))
+	copy(urls, repository.urlByTarget[canonical])
+	return urls, nil
 }
 
-func (repository *Repository) GetByID(shortID string) (*entities.ShortURL, error) {
-	err := repository.readRemote()
+func (repository *Repository) GetByID(ctx context.Context, shortID string) (*entities.ShortURL, error) {
+	err := repository.lockContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer repository.unlock()
+	err = repository.readRemote(ctx)
 	if err != nil {
 		return nil, err
 	}
 	url := repository.urlByID[shortID]
 	if url == nil {
-		return nil, &shorturl.ErrRepoNotFound{shortID}
+		return nil, &shorturl.ErrRepoNotFound{ID: shortID}
 	}
 	return url, nil
 }
 
-func (repository *Repository) GenerateShortID() (string, error) {
-	err := repository.readRemote()
+// nextID returns the ID for the current serial number and increases it. IDs
+// taken by imported URLs are skipped.
+func (repository *Repository) nextID() string {
+	for {
+		id := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(fmt.Sprint(repository.serial)))
+		repository.serial++
+		if repository.urlByID[id] == nil {
+			return id
+		}
+	}
+}
+
+func (repository *Repository) GenerateShortID(ctx context.Context) (string, error) {
+	err := repository.lockContext(ctx)
 	if err != nil {
 		return "", err
 	}
-	id := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(fmt.Sprint(repository.serial)))
-	repository.serial++
-	err = repository.writeRemote(fmt.Sprintf("Increasing serial number to %v", repository.serial))
+	defer repository.unlock()
+	err = repository.readRemote(ctx)
+	if err != nil {
+		return "", err
+	}
+	id := repository.nextID()
+	err = repository.persist(
+		ctx,
+		fmt.Sprintf("Increasing serial number to %v", repository.serial),
+		&pendingWrite{serial: repository.serial},
+	)
 	if err != nil {
-		repository.serial--
 		return "", err
 	}
 	return id, nil
 }
 
-func (repository *Repository) SaveURL(url *entities.ShortURL) error {
-	err := repository.readRemote()
+func (repository *Repository) SaveURL(ctx context.Context, url *entities.ShortURL) error {
+	err := repository.lockContext(ctx)
 	if err != nil {
 		return err
 	}
-	repository.urls = append([]*entities.ShortURL{url}, repository.urls...)
-	repository.urlByID[url.ShortID] = url
-	repository.urlByTarget[url.Target] = url
-	err = repository.writeRemote(fmt.Sprintf("Adding URL %v to list", url.Target))
+	defer repository.unlock()
+	err = repository.readRemote(ctx)
 	if err != nil {
-		repository.urls = repository.urls[1:]
-		delete(repository.urlByID, url.ShortID)
-		delete(repository.urlByTarget, url.Target)
 		return err
 	}
-	return nil
+	previous := repository.storeURL(url)
+	commitMessage := fmt.Sprintf("Adding URL %v to list", url.Target)
+	if previous != nil {
+		commitMessage = fmt.Sprintf("Updating URL %v", url.ShortID)
+	}
+	return repository.persist(ctx, commitMessage, &pendingWrite{url: url})
+}
+
+// SaveNewURLs generates the IDs of all urls and stores them in one commit,
+// along with the resulting serial number.
+func (repository *Repository) SaveNewURLs(ctx context.Context, urls []*entities.ShortURL) error {
+	err := repository.lockContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer repository.unlock()
+	err = repository.readRemote(ctx)
+	if err != nil {
+		return err
+	}
+	writes := make([]*pendingWrite, 0, len(urls)+1)
+	for _, url := range urls {
+		url.ShortID = repository.nextID()
+		repository.storeURL(url)
+		writes = append(writes, &pendingWrite{url: url})
+	}
+	writes = append(writes, &pendingWrite{serial: repository.serial})
+	return repository.persist(ctx, fmt.Sprintf("Adding %v URLs to list", len(urls)), writes...)
+}
+
+// SaveURLs stores urls in one commit, keeping their IDs.
+func (repository *Repository) SaveURLs(ctx context.Context, urls []*entities.ShortURL) error {
+	err := repository.lockContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer repository.unlock()
+	err = repository.readRemote(ctx)
+	if err != nil {
+		return err
+	}
+	writes := make([]*pendingWrite, len(urls))
+	for i, url := range urls {
+		repository.storeURL(url)
+		writes[i] = &pendingWrite{url: url}
+	}
+	return repository.persist(ctx, fmt.Sprintf("Importing %v URLs", len(urls)), writes...)
+}
+
+func (repository *Repository) DeleteURL(ctx context.Context, shortID string) error {
+	err := repository.lockContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer repository.unlock()
+	err = repository.readRemote(ctx)
+	if err != nil {
+		return err
+	}
+	removed := repository.removeURL(shortID)
+	if removed == nil {
+		return &shorturl.ErrRepoNotFound{ID: shortID}
+	}
+	return repository.persist(ctx, fmt.Sprintf("Removing URL %v", shortID), &pendingWrite{deleted: removed})
+}
+
+// DeleteURLs removes the URLs with the given IDs in one commit.
+func (repository *Repository) DeleteURLs(ctx context.Context, shortIDs []string) error {
+	err := repository.lockContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer repository.unlock()
+	err = repository.readRemote(ctx)
+	if err != nil {
+		return err
+	}
+	writes := make([]*pendingWrite, 0, len(shortIDs))
+	for _, shortID := range shortIDs {
+		url := repository.removeURL(shortID)
+		if url != nil {
+			writes = append(writes, &pendingWrite{deleted: url})
+		}
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	return repository.persist(ctx, fmt.Sprintf("Removing %v URLs", len(writes)), writes...)
+}
+
+func (repository *Repository) ListURLs(ctx context.Context, filter *shorturl.Filter, page *shorturl.Page) (*shorturl.URLPage, error) {
+	err := repository.lockContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer repository.unlock()
+	err = repository.readRemote(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return shorturl.Paginate(repository.urls, filter, page, time.Now()), nil
 }
@@ -3,11 +3,21 @@
 package git
 
 import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/carlos-marchal/shorty/entities"
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
 )
 
 var emptyRepoConfig *Config
@@ -31,23 +41,34 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+func setRemoteURL(t *testing.T, repo *Repository, url string) {
+	err := repo.repository.DeleteRemote("origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.repository.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{url}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestGetsFromRepoWithNoURLFile(t *testing.T) {
-	_, err := NewRepository(emptyRepoConfig)
+	_, err := NewRepository(context.Background(), emptyRepoConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestAssignsDistinctIDs(t *testing.T) {
-	repo, err := NewRepository(emptyRepoConfig)
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
-	id1, err := repo.GenerateShortID()
+	id1, err := repo.GenerateShortID(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
-	id2, err := repo.GenerateShortID()
+	id2, err := repo.GenerateShortID(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -57,7 +78,7 @@ func TestAssignsDistinctIDs(t *testing.T) {
 }
 
 func TestStoresAndRetreivesCorrectly(t *testing.T) {
-	repo, err := NewRepository(emptyRepoConfig)
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -66,32 +87,32 @@ func TestStoresAndRetreivesCorrectly(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = repo.SaveURL(url)
+	err = repo.SaveURL(context.Background(), url)
 	if err != nil {
 		t.Fatal(err)
 	}
-	byID, err := repo.GetByID(id)
+	byID, err := repo.GetByID(context.Background(), id)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if *url != *byID {
+	if !reflect.DeepEqual(url, byID) {
 		t.Fatalf("expected: %+v, got: %+v", url, byID)
 	}
-	byURL, err := repo.GetByURL(target)
+	byURL, err := repo.GetByURL(context.Background(), url.Canonical)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if *url != *byURL {
+	if !reflect.DeepEqual([]*entities.ShortURL{url}, byURL) {
 		t.Fatalf("expected: %+v, got: %+v", url, byURL)
 	}
 }
 
 func TestReadsExistentRepoCorrectly(t *testing.T) {
-	repo, err := NewRepository(exampleRepoConfig)
+	repo, err := NewRepository(context.Background(), exampleRepoConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
-	url, err := repo.GetByID("googleid")
+	url, err := repo.GetByID(context.Background(), "googleid")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -101,7 +122,19 @@ func TestReadsExistentRepoCorrectly(t *testing.T) {
 }
 
 func TestPreservesURLsWhenAddingToNonEmptyRepo(t *testing.T) {
-	repo, err := NewRepository(exampleRepoConfig)
+	repo, err := NewRepository(context.Background(), exampleRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, err := entities.NewShortURL("https://go.dev", "goid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SaveURL(context.Background(), existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRepository(context.Background(), exampleRepoConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -109,19 +142,822 @@ func TestPreservesURLsWhenAddingToNonEmptyRepo(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = repo.SaveURL(newURL)
-	url, err := repo.GetByID("googleid")
+	err = other.SaveURL(context.Background(), newURL)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if url == nil {
-		t.Fatal("got nil url from existing repo")
+	for _, id := range []string{"goid", "wikiid"} {
+		url, err := other.GetByID(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if url == nil {
+			t.Fatal("got nil url from existing repo")
+		}
+	}
+	// The example URLs expired long ago, and are dropped on the first write.
+	_, err = other.GetByID(context.Background(), "googleid")
+	if _, ok := err.(*shorturl.ErrRepoNotFound); !ok {
+		t.Fatalf("expected expired URL to be dropped, got %v", err)
+	}
+}
+
+func TestServesLastKnownStateWhileOffline(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := entities.NewShortURL("https://online.example.com", "onlineid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SaveURL(context.Background(), saved)
+	if err != nil {
+		t.Fatal(err)
 	}
-	url, err = repo.GetByID("wikiid")
+	setRemoteURL(t, repo, "ssh://git@unreachable.invalid/home/git/empty.git")
+	url, err := repo.GetByID(context.Background(), "onlineid")
 	if err != nil {
 		t.Fatal(err)
 	}
 	if url == nil {
-		t.Fatal("got nil url from existing repo")
+		t.Fatal("got nil url while offline")
+	}
+	if repo.Health().Online {
+		t.Fatal("expected repository to report being offline")
+	}
+}
+
+func TestServesLastKnownStateWhileRemoteHangs(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		// Connections are accepted and never answered.
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	config := new(Config)
+	*config = *emptyRepoConfig
+	config.FetchTimeout = 100 * time.Millisecond
+	repo, err := NewRepository(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := entities.NewShortURL("https://hanging.example.com", "hangingid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SaveURL(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRemoteURL(t, repo, fmt.Sprintf("ssh://git@%v/home/git/empty.git", listener.Addr()))
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = repo.GetByID(ctx, "hangingid")
+		cancel()
+		if err != nil {
+			t.Fatalf("expected the last known state to be served, got %v", err)
+		}
+	}
+	if repo.Health().Online {
+		t.Fatal("expected a remote that hangs to be considered offline")
+	}
+}
+
+func TestRejectsWritesWhileOfflineByDefault(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRemoteURL(t, repo, "ssh://git@unreachable.invalid/home/git/empty.git")
+	_, err = repo.GenerateShortID(context.Background())
+	if err == nil {
+		t.Fatal("expected error generating ID while offline")
+	}
+	url, err := entities.NewShortURL("https://offline.example.com", "rejectedid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SaveURL(context.Background(), url)
+	if err == nil {
+		t.Fatal("expected error saving URL while offline")
+	}
+	_, err = repo.GetByID(context.Background(), "rejectedid")
+	if err == nil {
+		t.Fatal("rejected URL should not be retrievable")
+	}
+}
+
+func TestUndoesDeleteWhenPushFails(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := make([]*entities.ShortURL, 3)
+	for i := range urls {
+		urls[i], err = entities.NewShortURL(fmt.Sprintf("https://undo%v.example.com", i), fmt.Sprintf("undo%v", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first one expires before the delete, while still in memory.
+	urls[0].Expires = time.Now().Add(100 * time.Millisecond)
+	err = repo.SaveURLs(context.Background(), urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	stored := len(repo.urls)
+	setRemoteURL(t, repo, "ssh://git@unreachable.invalid/home/git/empty.git")
+	// The push has to fail after a successful fetch, so the delete is done
+	// the way DeleteURL does it, without fetching.
+	removed := repo.removeURL("undo2")
+	err = repo.persist(context.Background(), "Removing URL", &pendingWrite{deleted: removed})
+	if err == nil {
+		t.Fatal("expected the push to fail")
+	}
+	for _, url := range urls {
+		if repo.urlByID[url.ShortID] == nil {
+			t.Fatalf("expected %v to be restored", url.ShortID)
+		}
+	}
+	if len(repo.urls) != stored {
+		t.Fatalf("expected %v URLs after undoing the delete, got %v", stored, len(repo.urls))
+	}
+}
+
+// fetchInBackground fetches the remote without pulling, as a fetch that was
+// given up on does once it finishes.
+func fetchInBackground(t *testing.T, repository *Repository) {
+	err := repository.repository.Fetch(&git.FetchOptions{
+		Auth:       repository.keys,
+		RemoteName: "origin",
+		Depth:      1,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		t.Fatal(err)
+	}
+}
+
+func TestPullsCommitsFetchedInBackground(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := entities.NewShortURL("https://background.example.com", "backgroundid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.SaveURL(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchInBackground(t, repo)
+	_, err = repo.GetByID(context.Background(), "backgroundid")
+	if err != nil {
+		t.Fatalf("expected the commits fetched in the background to be pulled, got %v", err)
+	}
+}
+
+func TestReadsRemoteStateAfterRejectedPush(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := entities.NewShortURL("https://theirs.example.com", "theirsid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.SaveURL(context.Background(), theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := other.serial
+	fetchInBackground(t, repo)
+	// The push is rejected, as the remote moved on, so the write is done the
+	// way SaveURL does it, without pulling first.
+	ours, err := entities.NewShortURL("https://ours.example.com", "oursid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.storeURL(ours)
+	err = repo.persist(context.Background(), "Adding URL", &pendingWrite{url: ours})
+	if err == nil {
+		t.Fatal("expected the push to be rejected")
+	}
+	if repo.urlByID["theirsid"] == nil || repo.urlByID["oursid"] != nil || repo.serial != serial {
+		t.Fatalf("expected the state of the remote after the rejected push, got %v with serial %v", repo.urls, repo.serial)
+	}
+}
+
+func TestQueuesWritesWhileOfflineAndReconciles(t *testing.T) {
+	config := new(Config)
+	*config = *emptyRepoConfig
+	config.OfflineWrites = QueueWrites
+	repo, err := NewRepository(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRemoteURL(t, repo, "ssh://git@unreachable.invalid/home/git/empty.git")
+	id, err := repo.GenerateShortID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := entities.NewShortURL("https://offline.example.com", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SaveURL(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending := repo.Health().PendingWrites; pending != 2 {
+		t.Fatalf("expected 2 pending writes, got %v", pending)
+	}
+	setRemoteURL(t, repo, config.RepoURL)
+	_, err = repo.GetByID(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health := repo.Health(); !health.Online || health.PendingWrites != 0 {
+		t.Fatalf("expected repository to be synced, got %+v", health)
+	}
+	other, err := NewRepository(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.GetByID(context.Background(), id)
+	if err != nil {
+		t.Fatalf("queued URL was not pushed: %v", err)
+	}
+}
+
+func TestCloseFlushesQueuedWrites(t *testing.T) {
+	config := new(Config)
+	*config = *emptyRepoConfig
+	config.OfflineWrites = QueueWrites
+	repo, err := NewRepository(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRemoteURL(t, repo, "ssh://git@unreachable.invalid/home/git/empty.git")
+	url, err := entities.NewShortURL("https://closing.example.com", "closingid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SaveURL(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Close(context.Background())
+	if _, ok := err.(*ErrUnflushedWrites); !ok {
+		t.Fatalf("expected unflushed writes while offline, got %v", err)
+	}
+	setRemoteURL(t, repo, config.RepoURL)
+	err = repo.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRepository(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.GetByID(context.Background(), "closingid")
+	if err != nil {
+		t.Fatalf("queued URL was not pushed on close: %v", err)
+	}
+	err = repo.SaveURL(context.Background(), url)
+	if err == nil {
+		t.Fatal("expected writes to be rejected after closing")
+	}
+}
+
+func TestCloseGivesUpWhenContextIsDone(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = repo.Close(ctx)
+	repo.unlock()
+	if _, ok := err.(*shorturl.ErrRepoTimeout); !ok {
+		t.Fatalf("expected closing to time out while the repository is busy, got %v", err)
+	}
+}
+
+func TestStopsWaitingWhenContextIsDone(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = repo.GetByID(ctx, "anything")
+	repo.unlock()
+	if _, ok := err.(*shorturl.ErrRepoTimeout); !ok {
+		t.Fatalf("expected a timeout while the repository is busy, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the timeout to wrap the deadline, got %v", err)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = repo.GetByID(cancelled, "anything")
+	if _, ok := err.(*shorturl.ErrRepoTimeout); !ok {
+		t.Fatalf("expected a cancelled context to stop the fetch, got %v", err)
+	}
+	if !repo.Health().Online {
+		t.Fatalf("expected the remote to stay online after a cancelled request")
+	}
+}
+
+func TestReportsHealth(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := entities.NewShortURL("https://health.example.com", "healthid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SaveURL(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	health := repo.Health()
+	if health.Backend != "git" || !health.Online || health.LastPush.IsZero() || health.Links == 0 {
+		t.Fatalf("unexpected health %+v", health)
+	}
+	head, err := repo.repository.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Head != head.Hash().String() {
+		t.Fatalf("expected head %v, got %v", head.Hash(), health.Head)
+	}
+	err = repo.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synced := repo.Health(); !synced.LastFetch.After(health.LastFetch) {
+		t.Fatalf("expected sync to fetch the remote")
+	}
+}
+
+func TestReportsHealthWhileBusy(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.lock()
+	defer repo.unlock()
+	done := make(chan *shorturl.Health)
+	go func() {
+		repo.KeyOwner("unknown")
+		done <- repo.Health()
+	}()
+	select {
+	case health := <-done:
+		if !health.Online {
+			t.Fatalf("expected the last known health, got %+v", health)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected health and key owners to be reported while the repository is busy")
+	}
+}
+
+type fakeMetrics struct {
+	operations  map[string]int
+	failures    map[string]int
+	conflicts   int
+	activeLinks int
+}
+
+func (metrics *fakeMetrics) ObserveOperation(operation string, duration time.Duration, failed bool) {
+	metrics.operations[operation]++
+	if failed {
+		metrics.failures[operation]++
+	}
+}
+
+func (metrics *fakeMetrics) CountPushConflict() {
+	metrics.conflicts++
+}
+
+func (metrics *fakeMetrics) SetActiveLinks(count int) {
+	metrics.activeLinks = count
+}
+
+func TestRecordsOperationMetrics(t *testing.T) {
+	metrics := &fakeMetrics{operations: make(map[string]int), failures: make(map[string]int)}
+	config := new(Config)
+	*config = *emptyRepoConfig
+	config.Metrics = metrics
+	repo, err := NewRepository(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := entities.NewShortURL("https://metrics.example.com", "metricsid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SaveURL(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, operation := range []string{"fetch", "commit", "push"} {
+		if metrics.operations[operation] == 0 {
+			t.Fatalf("expected %v to be recorded, got %v", operation, metrics.operations)
+		}
+	}
+	if len(metrics.failures) != 0 {
+		t.Fatalf("expected no failures, got %v", metrics.failures)
+	}
+	if metrics.activeLinks == 0 {
+		t.Fatalf("expected active links to be reported")
+	}
+	setRemoteURL(t, repo, "ssh://git@unreachable.invalid/home/git/empty.git")
+	repo.Sync(context.Background())
+	if metrics.failures["fetch"] != 1 {
+		t.Fatalf("expected a failed fetch, got %v", metrics.failures)
+	}
+}
+
+func TestShrinkingURLFileLeavesNoTrailingData(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := entities.NewShortURL("https://soon.expired.example.com/with/a/rather/long/path", "shortlived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url.Expires = time.Now().Add(time.Second)
+	err = repo.SaveURL(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	_, err = repo.GenerateShortID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatalf("could not load URL file after it shrank: %v", err)
+	}
+}
+
+func TestPersistsMetadata(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := entities.NewShortURL("https://metadata.example.com", "metadataid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := &entities.Metadata{Title: "Title", Description: "Description", Tags: []string{"a", "b"}, Creator: "me"}
+	err = url.SetMetadata(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SaveURL(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := other.GetByID(context.Background(), "metadataid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored.Metadata, *metadata) || !stored.Created.Equal(url.Created) {
+		t.Fatalf("expected: %+v, got: %+v", url, stored)
+	}
+}
+
+func TestListsStoredURLs(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := entities.NewShortURL("https://listed.example.com", "listedid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = url.SetMetadata(&entities.Metadata{Tags: []string{"listed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SaveURL(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := repo.ListURLs(context.Background(), &shorturl.Filter{Tag: "listed"}, &shorturl.Page{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.URLs) != 1 || page.URLs[0].ShortID != "listedid" {
+		t.Fatalf("expected only the listed URL, got %+v", page.URLs)
+	}
+}
+
+func TestUpdatesAndDeletesURLs(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := entities.NewShortURL("https://updated.example.com", "updatedid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SaveURL(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := *url
+	updated.Title = "Updated"
+	err = repo.SaveURL(context.Background(), &updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := other.GetByID(context.Background(), "updatedid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Title != "Updated" {
+		t.Fatalf("expected updated title, got %+v", stored)
+	}
+	page, err := other.ListURLs(context.Background(), &shorturl.Filter{Target: "updated.example.com"}, &shorturl.Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.URLs) != 1 {
+		t.Fatalf("expected update to replace the URL, got %v copies", len(page.URLs))
+	}
+	err = repo.DeleteURL(context.Background(), "updatedid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.GetByID(context.Background(), "updatedid")
+	if _, ok := err.(*shorturl.ErrRepoNotFound); !ok {
+		t.Fatalf("expected deleted URL to be gone, got %v", err)
+	}
+	other, err = NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.GetByID(context.Background(), "updatedid")
+	if _, ok := err.(*shorturl.ErrRepoNotFound); !ok {
+		t.Fatalf("expected deleted URL to be gone from remote, got %v", err)
+	}
+}
+
+func TestIndexesSeveralURLsPerTarget(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := entities.NewShortURL("https://shared.example.com", "sharedfirst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := entities.NewShortURL("https://shared.example.com", "sharedsecond")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []*entities.ShortURL{first, second} {
+		err = repo.SaveURL(context.Background(), url)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	urls, err := repo.GetByURL(context.Background(), first.Canonical)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 2 {
+		t.Fatalf("expected both URLs for the target, got %v", len(urls))
+	}
+	err = repo.DeleteURL(context.Background(), "sharedfirst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls, err = repo.GetByURL(context.Background(), first.Canonical)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 1 || urls[0].ShortID != "sharedsecond" {
+		t.Fatalf("expected only the remaining URL, got %+v", urls)
+	}
+}
+
+func TestSavesBatchInOneCommit(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := repo.repository.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := make([]*entities.ShortURL, 0)
+	for _, target := range []string{"https://batch.example.com/a", "https://batch.example.com/b", "https://batch.example.com/c"} {
+		url, err := entities.NewShortURL(target, "pending")
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, url)
+	}
+	err = repo.SaveNewURLs(context.Background(), urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := repo.repository.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.repository.CommitObject(after.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commit.ParentHashes) != 1 || commit.ParentHashes[0] != before.Hash() {
+		t.Fatalf("expected a single commit for the batch")
+	}
+	reloaded, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, url := range urls {
+		if seen[url.ShortID] {
+			t.Fatalf("generated ID %v twice", url.ShortID)
+		}
+		seen[url.ShortID] = true
+		stored, err := reloaded.GetByID(context.Background(), url.ShortID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Target != url.Target {
+			t.Fatalf("expected %v for ID %v, got %v", url.Target, url.ShortID, stored.Target)
+		}
+	}
+	id, err := reloaded.GenerateShortID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen[id] {
+		t.Fatalf("generated ID %v again after the batch", id)
+	}
+}
+
+func TestImportedIDsAreNotGeneratedAgain(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(fmt.Sprint(repo.serial)))
+	following := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(fmt.Sprint(repo.serial + 1)))
+	imported, err := entities.NewShortURL("https://imported.example.com", next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SaveURLs(context.Background(), []*entities.ShortURL{imported})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := repo.GenerateShortID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != following {
+		t.Fatalf("expected imported ID %v to be skipped and get %v, got %v", next, following, id)
+	}
+	reloaded, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := reloaded.GetByID(context.Background(), next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Target != imported.Target {
+		t.Fatalf("expected imported URL to be stored, got %+v", stored)
+	}
+}
+
+func TestDeletesSeveralURLsInOneCommit(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := make([]*entities.ShortURL, 0)
+	for _, id := range []string{"deleteda", "deletedb", "deletekept"} {
+		url, err := entities.NewShortURL("https://deleted.example.com/"+id, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, url)
+	}
+	err = repo.SaveURLs(context.Background(), urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := repo.repository.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.DeleteURLs(context.Background(), []string{"deleteda", "deletedb", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := repo.repository.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.repository.CommitObject(after.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commit.ParentHashes) != 1 || commit.ParentHashes[0] != before.Hash() {
+		t.Fatalf("expected a single commit for the deletions")
+	}
+	other, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"deleteda", "deletedb"} {
+		_, err = other.GetByID(context.Background(), id)
+		if _, ok := err.(*shorturl.ErrRepoNotFound); !ok {
+			t.Fatalf("expected %v to be gone from remote, got %v", id, err)
+		}
+	}
+	if _, err := other.GetByID(context.Background(), "deletekept"); err != nil {
+		t.Fatalf("expected kept URL to remain, got %v", err)
+	}
+}
+
+func TestReadsKeyFileFromRepo(t *testing.T) {
+	repo, err := NewRepository(context.Background(), emptyRepoConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"
+	file, err := repo.fs.Create("keys.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte(`{"keys": [{"owner": "newsletter", "sha256": "` + hash + `"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	_, err = repo.worktree.Add("keys.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.writeRemote(context.Background(), "Adding key file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := new(Config)
+	*config = *emptyRepoConfig
+	config.KeysFilePath = "keys.json"
+	other, err := NewRepository(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner, ok := other.KeyOwner(hash); !ok || owner != "newsletter" {
+		t.Fatalf("expected key to belong to newsletter, got %q", owner)
+	}
+	if _, ok := other.KeyOwner("unknown"); ok {
+		t.Fatal("accepted unknown key")
 	}
 }
@@ -0,0 +1,223 @@
+package git
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/carlos-marchal/shorty/entities"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// urlFileVersion is the version of the URL file format written by this code.
+// Files without a version field predate versioning and are treated as version
+// 0. It only changes when older code would misread newer files, as when fields
+// are renamed or reshaped. New optional fields keep the version, since the
+// schema lets older code load files that have them.
+const urlFileVersion = 2
+
+// urlFileSchemaSource is the published JSON Schema of the current URL file
+// version. Every file is validated against it after being migrated.
+//
+//go:embed urlfile.schema.json
+var urlFileSchemaSource string
+
+var urlFileSchema = jsonschema.MustCompileString("urlfile.schema.json", urlFileSchemaSource)
+
+// urlFileType and urlRecord are the on disk representation of the stored URLs.
+// They are kept apart from the entities so that renaming a Go field never
+// changes the file format.
+type urlFileType struct {
+	Version uint         `json:"version"`
+	URLs    []*urlRecord `json:"urls"`
+	Serial  uint         `json:"serial"`
+}
+
+type urlRecord struct {
+	Target       string     `json:"target"`
+	Canonical    string     `json:"canonical,omitempty"`
+	ShortID      string     `json:"short_id"`
+	Expires      time.Time  `json:"expires"`
+	Created      *time.Time `json:"created,omitempty"`
+	Owner        string     `json:"owner,omitempty"`
+	Quarantined  string     `json:"quarantined,omitempty"`
+	Redirect     int        `json:"redirect,omitempty"`
+	Interstitial bool       `json:"interstitial,omitempty"`
+	Title        string     `json:"title,omitempty"`
+	Description  string     `json:"description,omitempty"`
+	Tags         []string   `json:"tags,omitempty"`
+	Creator      string     `json:"creator,omitempty"`
+}
+
+func newURLRecord(url *entities.ShortURL) *urlRecord {
+	record := &urlRecord{
+		Target:       url.Target,
+		Canonical:    url.Canonical,
+		ShortID:      url.ShortID,
+		Expires:      url.Expires,
+		Owner:        url.Owner,
+		Quarantined:  url.Quarantined,
+		Redirect:     int(url.Redirect),
+		Interstitial: url.Interstitial,
+		Title:        url.Title,
+		Description:  url.Description,
+		Tags:         url.Tags,
+		Creator:      url.Creator,
+	}
+	if !url.Created.IsZero() {
+		created := url.Created
+		record.Created = &created
+	}
+	return record
+}
+
+func (record *urlRecord) toEntity() *entities.ShortURL {
+	url := &entities.ShortURL{
+		Target:       record.Target,
+		Canonical:    record.Canonical,
+		ShortID:      record.ShortID,
+		Expires:      record.Expires,
+		Owner:        record.Owner,
+		Quarantined:  record.Quarantined,
+		Redirect:     entities.RedirectType(record.Redirect),
+		Interstitial: record.Interstitial,
+		Metadata: entities.Metadata{
+			Title:       record.Title,
+			Description: record.Description,
+			Tags:        record.Tags,
+			Creator:     record.Creator,
+		},
+	}
+	if record.Created != nil {
+		url.Created = *record.Created
+	}
+	if url.Canonical == "" {
+		url.Canonical, _ = entities.CanonicalURL(url.Target, nil)
+	}
+	return url
+}
+
+type errUnsupportedVersion struct {
+	version uint
+}
+
+func (err *errUnsupportedVersion) Error() string {
+	return fmt.Sprintf("url file version %v is newer than supported version %v", err.version, urlFileVersion)
+}
+
+// migrations[n] upgrades the raw contents of a version n file to version n+1.
+// They work on the raw JSON object so that fields can be renamed or reshaped
+// before decoding into the current urlFileType.
+var migrations = []func(raw map[string]json.RawMessage) error{
+	// Version 1 only adds the version field itself.
+	func(raw map[string]json.RawMessage) error { return nil },
+	// Version 2 replaces the Go field names with explicit lowercase ones.
+	func(raw map[string]json.RawMessage) error {
+		renameKeys(raw, map[string]string{"Version": "version", "URLs": "urls", "Serial": "serial"})
+		urls := make([]map[string]json.RawMessage, 0)
+		if rawURLs, ok := raw["urls"]; ok {
+			err := json.Unmarshal(rawURLs, &urls)
+			if err != nil {
+				return err
+			}
+		}
+		if urls == nil {
+			urls = make([]map[string]json.RawMessage, 0)
+		}
+		for _, url := range urls {
+			renameKeys(url, map[string]string{"Target": "target", "ShortID": "short_id", "Expires": "expires"})
+		}
+		rawURLs, err := json.Marshal(urls)
+		if err != nil {
+			return err
+		}
+		raw["urls"] = rawURLs
+		return nil
+	},
+}
+
+// renameKeys renames the keys of a JSON object. Keys are matched ignoring case,
+// same as encoding/json did when decoding legacy files.
+func renameKeys(raw map[string]json.RawMessage, names map[string]string) {
+	for key, value := range raw {
+		for oldName, newName := range names {
+			if strings.EqualFold(key, oldName) {
+				delete(raw, key)
+				raw[newName] = value
+			}
+		}
+	}
+}
+
+func fileVersion(raw map[string]json.RawMessage) (uint, error) {
+	var version uint
+	for _, key := range []string{"version", "Version"} {
+		if rawVersion, ok := raw[key]; ok {
+			err := json.Unmarshal(rawVersion, &version)
+			return version, err
+		}
+	}
+	return 0, nil
+}
+
+// parseURLFile decodes a URL file of any known version, upgrading it to the
+// current one. Files from a newer version are refused, since writing them back
+// could silently drop data this version doesn't know about.
+func parseURLFile(content []byte) (*urlFileType, error) {
+	raw := make(map[string]json.RawMessage)
+	err := json.Unmarshal(content, &raw)
+	if err != nil {
+		return nil, err
+	}
+	version, err := fileVersion(raw)
+	if err != nil {
+		return nil, err
+	}
+	if version > urlFileVersion {
+		return nil, &errUnsupportedVersion{version}
+	}
+	for ; version < urlFileVersion; version++ {
+		err = migrations[version](raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	raw["version"] = json.RawMessage(fmt.Sprint(urlFileVersion))
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var document interface{}
+	err = json.Unmarshal(migrated, &document)
+	if err != nil {
+		return nil, err
+	}
+	err = urlFileSchema.Validate(document)
+	if err != nil {
+		return nil, err
+	}
+	urlFile := new(urlFileType)
+	err = json.Unmarshal(migrated, urlFile)
+	if err != nil {
+		return nil, err
+	}
+	return urlFile, nil
+}
+
+func (urlFile *urlFileType) entities() []*entities.ShortURL {
+	urls := make([]*entities.ShortURL, len(urlFile.URLs))
+	for i, record := range urlFile.URLs {
+		urls[i] = record.toEntity()
+	}
+	return urls
+}
+
+func formatURLFile(urls []*entities.ShortURL, serial uint) ([]byte, error) {
+	records := make([]*urlRecord, len(urls))
+	for i, url := range urls {
+		records[i] = newURLRecord(url)
+	}
+	return json.MarshalIndent(&urlFileType{urlFileVersion, records, serial}, "", "  ")
+}
@@ -0,0 +1,129 @@
+package git
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/carlos-marchal/shorty/entities"
+)
+
+func TestParsesUnversionedURLFile(t *testing.T) {
+	urlFile, err := parseURLFile([]byte(`{
+		"URLs": [{"Target": "https://example.com", "ShortID": "GA", "Expires": "2021-03-19T17:06:35Z"}],
+		"Serial": 1
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urlFile.Version != urlFileVersion {
+		t.Fatalf("expected file to be migrated to version %v, got %v", urlFileVersion, urlFile.Version)
+	}
+	if len(urlFile.URLs) != 1 || urlFile.URLs[0].ShortID != "GA" || urlFile.Serial != 1 {
+		t.Fatalf("unexpected contents after migration: %+v", urlFile)
+	}
+}
+
+func TestParsesLegacyURLFileInRepo(t *testing.T) {
+	content, err := ioutil.ReadFile("../urls.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseURLFile(content)
+	if err != nil {
+		t.Fatalf("could not parse legacy file: %v", err)
+	}
+}
+
+func TestMigratesVersionOneFieldNames(t *testing.T) {
+	urlFile, err := parseURLFile([]byte(`{
+		"Version": 1,
+		"URLs": [{"Target": "https://example.com", "ShortID": "GA", "Expires": "2021-03-19T17:06:35Z"}],
+		"Serial": 4
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urlFile.URLs) != 1 || urlFile.URLs[0].Target != "https://example.com" || urlFile.Serial != 4 {
+		t.Fatalf("unexpected contents after migration: %+v", urlFile)
+	}
+}
+
+func TestRejectsURLFilesNotMatchingSchema(t *testing.T) {
+	invalidFiles := []string{
+		`{"version": 2, "serial": 0}`,
+		`{"version": 2, "urls": [], "serial": -1}`,
+		`{"version": 2, "urls": [{"target": "https://example.com", "short_id": "not-alnum", "expires": "2021-03-19T17:06:35Z"}], "serial": 0}`,
+		`{"version": 2, "urls": [{"target": "ftp://example.com", "short_id": "GA", "expires": "2021-03-19T17:06:35Z"}], "serial": 0}`,
+		`{"version": 2, "urls": [{"target": "https://example.com", "short_id": "GA"}], "serial": 0}`,
+		`{"version": 2, "urls": [{"target": "https://example.com", "short_id": "GA", "expires": "2021-03-19T17:06:35Z", "tags": ["Not Valid"]}], "serial": 0}`,
+	}
+	for _, content := range invalidFiles {
+		_, err := parseURLFile([]byte(content))
+		if err == nil {
+			t.Fatalf("expected schema error for %v", content)
+		}
+	}
+}
+
+func TestLoadsFilesWithNewerOptionalFields(t *testing.T) {
+	urlFile, err := parseURLFile([]byte(`{
+		"version": 2,
+		"urls": [{"target": "https://example.com", "short_id": "GA", "expires": "2021-03-19T17:06:35Z", "unknown": true}],
+		"serial": 1,
+		"unknown": true
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urlFile.URLs) != 1 || urlFile.URLs[0].ShortID != "GA" || urlFile.Serial != 1 {
+		t.Fatalf("unexpected contents: %+v", urlFile)
+	}
+}
+
+func TestRefusesNewerURLFileVersions(t *testing.T) {
+	_, err := parseURLFile([]byte(`{"version": 999, "urls": [], "serial": 0}`))
+	if _, ok := err.(*errUnsupportedVersion); !ok {
+		t.Fatalf("expected unsupported version error, got %v", err)
+	}
+}
+
+func TestFormattedURLFileParsesBack(t *testing.T) {
+	now := time.Now().UTC().Round(0)
+	url := &entities.ShortURL{
+		Target:    "https://example.com",
+		Canonical: "https://example.com/",
+		ShortID:   "GA",
+		Expires:   now,
+		Created:   now,
+		Owner:     "newsletter",
+		Metadata: entities.Metadata{
+			Title:       "Example",
+			Description: "An example link",
+			Tags:        []string{"docs", "team-a"},
+			Creator:     "someone",
+		},
+	}
+	content, err := formatURLFile([]*entities.ShortURL{url}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urlFile, err := parseURLFile(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urlFile.Serial != 3 || len(urlFile.entities()) != 1 || !reflect.DeepEqual(urlFile.entities()[0], url) {
+		t.Fatalf("expected %+v to round trip, got %+v", url, urlFile)
+	}
+}
+
+func TestFillsMissingCanonicalTargets(t *testing.T) {
+	urlFile, err := parseURLFile([]byte(`{"version": 2, "urls": [{"target": "HTTPS://Example.com:443", "short_id": "GA", "expires": "2021-03-19T17:06:35Z"}], "serial": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canonical := urlFile.entities()[0].Canonical; canonical != "https://example.com/" {
+		t.Fatalf("expected default canonical target, got %q", canonical)
+	}
+}
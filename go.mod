@@ -3,7 +3,9 @@ module github.com/carlos-marchal/shorty
 go 1.16
 
 require (
-	github.com/go-git/go-billy/v5 v5.0.0 // indirect
-	github.com/go-git/go-git/v5 v5.2.0 // indirect
-	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83 // indirect
+	github.com/go-git/go-billy/v5 v5.0.0
+	github.com/go-git/go-git/v5 v5.2.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.0.0
+	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
+	gopkg.in/yaml.v2 v2.2.4
 )
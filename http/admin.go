@@ -0,0 +1,148 @@
+package http
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/carlos-marchal/shorty/logging"
+	"github.com/carlos-marchal/shorty/transfer"
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+const csvType = "text/csv"
+
+// maxImportBody limits how much of an import file is read.
+const maxImportBody = 32 << 20
+
+// transferTypes maps the media types of import and export files to their
+// formats.
+var transferTypes = map[string]transfer.Format{
+	jsonType:   transfer.JSON,
+	csvType:    transfer.CSV,
+	ndjsonType: transfer.NDJSON,
+}
+
+var conflictModes = map[string]shorturl.ConflictMode{
+	"":          shorturl.SkipConflicts,
+	"skip":      shorturl.SkipConflicts,
+	"overwrite": shorturl.OverwriteConflicts,
+	"fail":      shorturl.FailOnConflict,
+}
+
+type importRejectBody struct {
+	Index int        `json:"index"`
+	ID    string     `json:"id,omitempty"`
+	Error *errorBody `json:"error"`
+}
+
+type importResponseBody struct {
+	Imported    int                 `json:"imported"`
+	Overwritten int                 `json:"overwritten"`
+	Skipped     int                 `json:"skipped"`
+	Rejected    []*importRejectBody `json:"rejected"`
+}
+
+// requireAdmin only lets through the owners of the keys listed as admins.
+// Unlike authenticate, it lets nobody through when no keys are configured.
+func requireAdmin(config *Config, handler http.HandlerFunc) http.HandlerFunc {
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if len(config.Keys) == 0 {
+			sendErrorJSON(w, codeForbidden, "Administration requires an API key, and the server accepts none.", http.StatusForbidden)
+			return
+		}
+		owner := ownerOf(r)
+		for _, admin := range config.AdminOwners {
+			if owner == admin {
+				handler(w, r)
+				return
+			}
+		}
+		sendErrorJSON(w, codeForbidden, "Only administrators can do this.", http.StatusForbidden)
+	})
+}
+
+// importHandler stores the links of an import file keeping their IDs. The
+// format is chosen by the content type, and the conflicts query parameter
+// decides what happens to links whose ID is taken.
+func importHandler(urls shorturl.UseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			sendErrorJSON(w, codeMethodNotAllowed, fmt.Sprintf("Method %v not supported.", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("content-type"))
+		format, ok := transferTypes[mediaType]
+		if err != nil || !ok {
+			sendErrorJSON(w, codeBadRequest, "The content type must be application/json, text/csv or application/x-ndjson.", http.StatusBadRequest)
+			return
+		}
+		conflicts, ok := conflictModes[r.URL.Query().Get("conflicts")]
+		if !ok {
+			sendErrorJSON(w, codeBadRequest, "The conflicts parameter must be skip, overwrite or fail.", http.StatusBadRequest)
+			return
+		}
+		records, err := transfer.Decode(http.MaxBytesReader(w, r.Body, maxImportBody), format)
+		if err != nil {
+			sendErrorJSON(w, codeBadRequest, fmt.Sprintf("The file can't be read: %v.", err), http.StatusBadRequest)
+			return
+		}
+		result, err := urls.ImportURLs(r.Context(), records, conflicts)
+		if err != nil {
+			sendUseCaseError(w, r, err, "")
+			return
+		}
+		response := &importResponseBody{
+			Imported:    result.Imported,
+			Overwritten: result.Overwritten,
+			Skipped:     result.Skipped,
+			Rejected:    make([]*importRejectBody, len(result.Rejected)),
+		}
+		for i, reject := range result.Rejected {
+			body, _ := useCaseError(reject.Err, reject.ShortID)
+			response.Rejected[i] = &importRejectBody{reject.Index, reject.ShortID, body}
+		}
+		sendJSON(w, response)
+	}
+}
+
+// exportHandler sends every link matching the same filters as the listing,
+// in the format given by the format query parameter.
+func exportHandler(urls shorturl.UseCase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			sendErrorJSON(w, codeMethodNotAllowed, fmt.Sprintf("Method %v not supported.", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		name := query.Get("format")
+		if name == "" {
+			name = "json"
+		}
+		format, ok := transfer.Formats[name]
+		if !ok {
+			sendErrorJSON(w, codeBadRequest, "The format must be json, csv or ndjson.", http.StatusBadRequest)
+			return
+		}
+		filter, ok := parseFilter(query)
+		if !ok {
+			sendErrorJSON(w, codeBadRequest, "The status must be one of all, active or expired.", http.StatusBadRequest)
+			return
+		}
+		exported, err := urls.ExportURLs(r.Context(), filter)
+		if err != nil {
+			sendUseCaseError(w, r, err, "")
+			return
+		}
+		for mediaType, candidate := range transferTypes {
+			if candidate == format {
+				w.Header().Set("content-type", mediaType)
+			}
+		}
+		w.Header().Set("content-disposition", fmt.Sprintf(`attachment; filename="links.%v"`, name))
+		err = transfer.Encode(w, exported, format)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Could not export links", "error", err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+// newAdminRequest returns a request made with the key of adminConfig.
+func newAdminRequest(method string, target string, body string) *http.Request {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	request.Header.Set("x-api-key", "admin-key")
+	return request
+}
+
+var adminConfig = &Config{
+	Origin:      "https://test",
+	Keys:        []KeyStore{NewStaticKeys(map[string]string{"admin": "admin-key"})},
+	AdminOwners: []string{"admin"},
+}
+
+func TestAdminEndpointsRequireAdminKey(t *testing.T) {
+	config := &Config{
+		Origin:      "https://test",
+		Keys:        []KeyStore{NewStaticKeys(map[string]string{"admin": "admin-key", "team": "team-key"})},
+		AdminOwners: []string{"admin"},
+	}
+	tests := []struct {
+		key      string
+		expected int
+	}{
+		{key: "", expected: http.StatusUnauthorized},
+		{key: "team-key", expected: http.StatusForbidden},
+		{key: "admin-key", expected: http.StatusOK},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/api/admin/export", nil)
+		if test.key != "" {
+			request.Header.Set("authorization", "Bearer "+test.key)
+		}
+		w := httptest.NewRecorder()
+		buildHandler(&fakeUserService{}, config).ServeHTTP(w, request)
+		if status := w.Result().StatusCode; status != test.expected {
+			t.Fatalf("Expected status %v but got %v for %+v", test.expected, status, test)
+		}
+	}
+}
+
+func TestAdminEndpointsAreClosedWithoutKeys(t *testing.T) {
+	service := &fakeUserService{}
+	request := httptest.NewRequest("POST", "/api/admin/import?conflicts=overwrite", strings.NewReader(`[{"id": "GA", "target": "https://evil.example.com", "owner": "admin"}]`))
+	request.Header.Set("content-type", "application/json")
+	w := httptest.NewRecorder()
+	buildHandler(service, &Config{Origin: "https://test"}).ServeHTTP(w, request)
+	if status := w.Result().StatusCode; status != http.StatusForbidden {
+		t.Fatalf("Expected an anonymous import to be forbidden, got %v", status)
+	}
+	if service.imported != nil {
+		t.Fatalf("Expected the import not to reach the service")
+	}
+	for _, path := range []string{"/api/admin/export", "/status"} {
+		w := httptest.NewRecorder()
+		buildHandler(service, &Config{Origin: "https://test"}).ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if status := w.Result().StatusCode; status != http.StatusForbidden {
+			t.Fatalf("Expected %v to be forbidden without keys, got %v", path, status)
+		}
+	}
+}
+
+func TestImportReportsRejects(t *testing.T) {
+	tests := []struct {
+		contentType string
+		query       string
+		content     string
+		status      int
+		conflicts   shorturl.ConflictMode
+	}{
+		{contentType: "text/csv", query: "", content: "id,target\nGA,https://example.com\n", status: http.StatusOK, conflicts: shorturl.SkipConflicts},
+		{contentType: "application/json", query: "?conflicts=overwrite", content: `[{"id": "GA", "target": "https://example.com"}]`, status: http.StatusOK, conflicts: shorturl.OverwriteConflicts},
+		{contentType: "application/x-ndjson", query: "?conflicts=fail", content: `{"id": "GA", "target": "https://example.com"}`, status: http.StatusOK, conflicts: shorturl.FailOnConflict},
+		{contentType: "text/plain", query: "", content: "GA https://example.com", status: http.StatusBadRequest},
+		{contentType: "text/csv", query: "?conflicts=sometimes", content: "id,target\n", status: http.StatusBadRequest},
+		{contentType: "text/csv", query: "", content: "id,url\n", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		request := newAdminRequest("POST", "/api/admin/import"+test.query, test.content)
+		request.Header.Set("content-type", test.contentType)
+		w := httptest.NewRecorder()
+		service := &fakeUserService{}
+		buildHandler(service, adminConfig).ServeHTTP(w, request)
+		if status := w.Result().StatusCode; status != test.status {
+			t.Fatalf("Expected status %v but got %v for %+v", test.status, status, test)
+		}
+		if test.status == http.StatusOK && (len(service.imported) != 1 || service.conflicts != test.conflicts) {
+			t.Fatalf("Expected one record with conflicts %v, got %v with %v", test.conflicts, len(service.imported), service.conflicts)
+		}
+	}
+
+	request := newAdminRequest("POST", "/api/admin/import", "id,target,expires\nGA,https://example.com,\nGE,https://example.com,soon\n")
+	request.Header.Set("content-type", "text/csv")
+	w := httptest.NewRecorder()
+	buildHandler(&fakeUserService{}, adminConfig).ServeHTTP(w, request)
+	response := new(importResponseBody)
+	err := json.NewDecoder(w.Body).Decode(response)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if response.Imported != 1 || len(response.Rejected) != 1 {
+		t.Fatalf("Expected one imported and one rejected record, got %+v", response)
+	}
+	if reject := response.Rejected[0]; reject.Index != 1 || reject.ID != "GE" || reject.Error.Code != codeInvalidRecord {
+		t.Fatalf("Expected the second record to be rejected as invalid, got %+v", reject)
+	}
+}
+
+func TestImportConflictIsReported(t *testing.T) {
+	request := newAdminRequest("POST", "/api/admin/import?conflicts=fail", `[{"id": "GA", "target": "https://example.com"}]`)
+	request.Header.Set("content-type", "application/json")
+	w := httptest.NewRecorder()
+	service := &fakeUserService{custom: true, resultError: &shorturl.ErrImportConflict{ID: "GA"}}
+	buildHandler(service, adminConfig).ServeHTTP(w, request)
+	if status := w.Result().StatusCode; status != http.StatusConflict {
+		t.Fatalf("Expected conflict status but got %v", status)
+	}
+}
+
+func TestExportsInRequestedFormat(t *testing.T) {
+	tests := []struct {
+		query       string
+		status      int
+		contentType string
+		contains    string
+	}{
+		{query: "", status: http.StatusOK, contentType: "application/json", contains: `"id": "1"`},
+		{query: "?format=csv", status: http.StatusOK, contentType: "text/csv", contains: "id,target,"},
+		{query: "?format=ndjson&tag=docs", status: http.StatusOK, contentType: "application/x-ndjson", contains: `{"id":"1"`},
+		{query: "?format=xml", status: http.StatusBadRequest},
+		{query: "?status=sometimes", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		request := newAdminRequest("GET", "/api/admin/export"+test.query, "")
+		w := httptest.NewRecorder()
+		buildHandler(&fakeUserService{}, adminConfig).ServeHTTP(w, request)
+		if status := w.Result().StatusCode; status != test.status {
+			t.Fatalf("Expected status %v but got %v for %v", test.status, status, test.query)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if contentType := w.Header().Get("content-type"); contentType != test.contentType {
+			t.Fatalf("Expected %v but got %v", test.contentType, contentType)
+		}
+		if !strings.Contains(w.Body.String(), test.contains) {
+			t.Fatalf("Expected %q in export, got %v", test.contains, w.Body.String())
+		}
+	}
+}
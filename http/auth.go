@@ -0,0 +1,97 @@
+package http
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// KeyStore looks up the owner of an API key by its hex encoded SHA-256 hash.
+type KeyStore interface {
+	KeyOwner(keyHash string) (string, bool)
+}
+
+// StaticKeys is a KeyStore holding a fixed set of keys, indexed by hash.
+type StaticKeys map[string]string
+
+// NewStaticKeys builds a StaticKeys from a map of owner names to plain keys.
+func NewStaticKeys(keys map[string]string) StaticKeys {
+	static := make(StaticKeys)
+	for owner, key := range keys {
+		static[hashKey(key)] = owner
+	}
+	return static
+}
+
+func (keys StaticKeys) KeyOwner(keyHash string) (string, bool) {
+	owner, ok := keys[keyHash]
+	return owner, ok
+}
+
+func hashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+type contextKey int
+
+const ownerContextKey contextKey = iota
+
+// requestKey extracts the API key from either a bearer authorization header,
+// an x-api-key header or, for forms of the web UI and the bookmarklet, an
+// api_key field or query parameter.
+func requestKey(r *http.Request) string {
+	if authorization := r.Header.Get("authorization"); strings.HasPrefix(strings.ToLower(authorization), "bearer ") {
+		return strings.TrimSpace(authorization[len("bearer "):])
+	}
+	if key := r.Header.Get("x-api-key"); key != "" {
+		return key
+	}
+	if r.Method == "GET" && r.URL.Path == "/shorten" {
+		return r.URL.Query().Get("api_key")
+	}
+	if r.Method != "POST" {
+		return ""
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("content-type")); err == nil && mediaType == formType {
+		return r.PostFormValue("api_key")
+	}
+	return ""
+}
+
+// authenticate only lets through requests with a valid API key, and makes the
+// owner of the key available to the handler through ownerOf. When no key
+// stores are configured authentication is disabled and requests are anonymous.
+func authenticate(config *Config, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(config.Keys) == 0 {
+			handler(w, r)
+			return
+		}
+		key := requestKey(r)
+		if key == "" {
+			w.Header().Set("www-authenticate", "Bearer")
+			sendErrorJSON(w, codeUnauthorized, "An API key is required.", http.StatusUnauthorized)
+			return
+		}
+		keyHash := hashKey(key)
+		for _, keys := range config.Keys {
+			if owner, ok := keys.KeyOwner(keyHash); ok {
+				handler(w, r.WithContext(context.WithValue(r.Context(), ownerContextKey, owner)))
+				return
+			}
+		}
+		w.Header().Set("www-authenticate", `Bearer error="invalid_token"`)
+		sendErrorJSON(w, codeUnauthorized, "The API key is not valid.", http.StatusUnauthorized)
+	}
+}
+
+// ownerOf returns the owner of the API key used in the request, or an empty
+// string for anonymous requests.
+func ownerOf(r *http.Request) string {
+	owner, _ := r.Context().Value(ownerContextKey).(string)
+	return owner
+}
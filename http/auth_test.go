@@ -0,0 +1,89 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testKeys = NewStaticKeys(map[string]string{"newsletter": "secret-key"})
+
+func TestAPIRequiresValidKeyWhenConfigured(t *testing.T) {
+	tests := []struct {
+		header   string
+		value    string
+		expected int
+	}{
+		{expected: http.StatusUnauthorized},
+		{header: "authorization", value: "Bearer wrong-key", expected: http.StatusUnauthorized},
+		{header: "x-api-key", value: "wrong-key", expected: http.StatusUnauthorized},
+		{header: "authorization", value: "Bearer secret-key", expected: http.StatusOK},
+		{header: "x-api-key", value: "secret-key", expected: http.StatusOK},
+	}
+	for _, test := range tests {
+		for _, path := range []string{"/shorten", "/api/links"} {
+			method := "GET"
+			if path == "/shorten" {
+				method = "POST"
+			}
+			request := httptest.NewRequest(method, path, strings.NewReader(`{"url": "https://example.com"}`))
+			request.Header.Set("content-type", "application/json")
+			if test.header != "" {
+				request.Header.Set(test.header, test.value)
+			}
+			w := httptest.NewRecorder()
+			testHandler := buildHandler(&fakeUserService{}, &Config{Origin: "https://test", Keys: []KeyStore{testKeys}})
+			testHandler.ServeHTTP(w, request)
+			if status := w.Result().StatusCode; status != test.expected {
+				t.Fatalf("Expected status %v but got %v for %v with %v: %v", test.expected, status, path, test.header, test.value)
+			}
+		}
+	}
+}
+
+func TestAttributesLinksToKeyOwner(t *testing.T) {
+	request := httptest.NewRequest("POST", "/shorten", strings.NewReader(`{"url": "https://example.com"}`))
+	request.Header.Set("content-type", "application/json")
+	request.Header.Set("authorization", "Bearer secret-key")
+	w := httptest.NewRecorder()
+	service := &fakeUserService{}
+	testHandler := buildHandler(service, &Config{Origin: "https://test", Keys: []KeyStore{testKeys}})
+	testHandler.ServeHTTP(w, request)
+	if service.owner != "newsletter" {
+		t.Fatalf("Expected link to be owned by newsletter, got %q", service.owner)
+	}
+}
+
+func TestReadsKeyFromForms(t *testing.T) {
+	for _, contentType := range []string{formType, formType + "; charset=utf-8", "application/X-WWW-Form-Urlencoded"} {
+		request := httptest.NewRequest("POST", "/shorten", strings.NewReader("url=https://example.com&api_key=secret-key"))
+		request.Header.Set("content-type", contentType)
+		if key := requestKey(request); key != "secret-key" {
+			t.Fatalf("Expected the key of the form sent as %v, got %q", contentType, key)
+		}
+	}
+}
+
+func TestChecksEveryKeyStore(t *testing.T) {
+	other := NewStaticKeys(map[string]string{"other": "other-key"})
+	request := httptest.NewRequest("DELETE", "/api/links/id", nil)
+	request.Header.Set("x-api-key", "other-key")
+	w := httptest.NewRecorder()
+	service := &fakeUserService{}
+	testHandler := buildHandler(service, &Config{Origin: "https://test", Keys: []KeyStore{testKeys, other}})
+	testHandler.ServeHTTP(w, request)
+	if status := w.Result().StatusCode; status != http.StatusNoContent || service.owner != "other" {
+		t.Fatalf("Expected delete as other, got status %v and owner %q", status, service.owner)
+	}
+}
+
+func TestRedirectsArePublic(t *testing.T) {
+	request := httptest.NewRequest("GET", "/id", nil)
+	w := httptest.NewRecorder()
+	testHandler := buildHandler(&fakeUserService{}, &Config{Origin: "https://test", Keys: []KeyStore{testKeys}})
+	testHandler.ServeHTTP(w, request)
+	if status := w.Result().StatusCode; status != http.StatusTemporaryRedirect {
+		t.Fatalf("Expected redirect without key, got %v", status)
+	}
+}
@@ -0,0 +1,141 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+const ndjsonType = "application/x-ndjson"
+
+const (
+	// maxBatchItems is the most links a single batch may shorten.
+	maxBatchItems = 1000
+	// maxBatchBody limits how much of a batch request body is read.
+	maxBatchBody = 4 << 20
+)
+
+const badBatchBody = "The body must be a json array, or newline delimited json, of objects with the same fields as the body of /shorten."
+
+// batchItemBody is the result of shortening one of the items of a batch, at
+// the given position in the request.
+type batchItemBody struct {
+	Index int           `json:"index"`
+	Link  *responseBody `json:"link,omitempty"`
+	Error *errorBody    `json:"error,omitempty"`
+}
+
+type batchResponseBody struct {
+	Results []*batchItemBody `json:"results"`
+}
+
+// readBatch splits a batch body into the raw JSON of each of its items. JSON
+// bodies must hold a single array, while NDJSON bodies hold one item per line.
+func readBatch(body io.Reader, ndjson bool) ([]json.RawMessage, bool) {
+	items := make([]json.RawMessage, 0)
+	decoder := json.NewDecoder(body)
+	if !ndjson {
+		token, err := decoder.Token()
+		if delim, ok := token.(json.Delim); err != nil || !ok || delim != '[' {
+			return nil, false
+		}
+	}
+	for decoder.More() {
+		var item json.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			return nil, false
+		}
+		items = append(items, item)
+	}
+	if !ndjson {
+		token, err := decoder.Token()
+		if delim, ok := token.(json.Delim); err != nil || !ok || delim != ']' || decoder.More() {
+			return nil, false
+		}
+	}
+	_, err := decoder.Token()
+	return items, err == io.EOF
+}
+
+// parseBatchItem reads an item of a batch like the body of /shorten.
+func parseBatchItem(item json.RawMessage, r *http.Request) (*shorturl.ShortenRequest, *errorBody) {
+	parsed := new(requestBody)
+	decoder := json.NewDecoder(bytes.NewReader(item))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(parsed)
+	if err != nil || parsed.URL == nil {
+		return nil, &errorBody{Error: badShortenBody, Code: codeBadRequest}
+	}
+	options, body := shortenOptions(parsed, r)
+	if body != nil {
+		return nil, body
+	}
+	return &shorturl.ShortenRequest{Target: *parsed.URL, Options: options}, nil
+}
+
+// batchHandler shortens many links at once, storing them in a single write.
+// Each item gets its own result or error, and failing items don't affect the
+// rest. NDJSON requests get NDJSON responses, with one result per line.
+func batchHandler(urls shorturl.UseCase, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			sendErrorJSON(w, codeMethodNotAllowed, fmt.Sprintf("Method %v not supported.", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("content-type"))
+		if err != nil || mediaType != jsonType && mediaType != ndjsonType {
+			sendErrorJSON(w, codeBadRequest, badBatchBody, http.StatusBadRequest)
+			return
+		}
+		ndjson := mediaType == ndjsonType
+		items, ok := readBatch(http.MaxBytesReader(w, r.Body, maxBatchBody), ndjson)
+		if !ok {
+			sendErrorJSON(w, codeBadRequest, badBatchBody, http.StatusBadRequest)
+			return
+		}
+		if len(items) > maxBatchItems {
+			sendErrorJSON(w, codeBadRequest, fmt.Sprintf("A batch can have at most %v links.", maxBatchItems), http.StatusBadRequest)
+			return
+		}
+		response := &batchResponseBody{Results: make([]*batchItemBody, len(items))}
+		requests := make([]*shorturl.ShortenRequest, 0, len(items))
+		indexes := make([]int, 0, len(items))
+		for i, item := range items {
+			request, body := parseBatchItem(item, r)
+			response.Results[i] = &batchItemBody{Index: i, Error: body}
+			if body == nil {
+				requests = append(requests, request)
+				indexes = append(indexes, i)
+			}
+		}
+		if len(requests) > 0 {
+			results, err := urls.ShortenURLs(r.Context(), requests)
+			if err != nil {
+				sendUseCaseError(w, r, err, "")
+				return
+			}
+			for i, result := range results {
+				item := response.Results[indexes[i]]
+				if result.Err != nil {
+					item.Error, _ = useCaseError(result.Err, "")
+				} else {
+					item.Link = newResponseBody(result.URL, config)
+				}
+			}
+		}
+		if !ndjson {
+			sendJSON(w, response)
+			return
+		}
+		w.Header().Set("content-type", ndjsonType)
+		encoder := json.NewEncoder(w)
+		for _, item := range response.Results {
+			encoder.Encode(item)
+		}
+	}
+}
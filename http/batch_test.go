@@ -0,0 +1,92 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+func TestBatchReportsEachItem(t *testing.T) {
+	tests := []struct {
+		contentType string
+		content     string
+	}{
+		{contentType: jsonType, content: `[{"url": "https://example.com"}, {"title": "no url"}, {"url": "https://example.com", "dedupe": "sometimes"}]`},
+		{contentType: ndjsonType, content: "{\"url\": \"https://example.com\"}\n{\"title\": \"no url\"}\n{\"url\": \"https://example.com\", \"dedupe\": \"sometimes\"}\n"},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/api/links:batch", strings.NewReader(test.content))
+		request.Header.Set("content-type", test.contentType)
+		w := httptest.NewRecorder()
+		buildHandler(&fakeUserService{}, &Config{Origin: "https://test"}).ServeHTTP(w, request)
+		response := w.Result()
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("Expected ok but got %v for %v", response.StatusCode, test.contentType)
+		}
+		results := make([]*batchItemBody, 0)
+		if test.contentType == ndjsonType {
+			scanner := bufio.NewScanner(response.Body)
+			for scanner.Scan() {
+				item := new(batchItemBody)
+				if err := json.Unmarshal(scanner.Bytes(), item); err != nil {
+					t.Fatalf("Unexpected error %v", err)
+				}
+				results = append(results, item)
+			}
+		} else {
+			parsed := new(batchResponseBody)
+			if err := json.NewDecoder(response.Body).Decode(parsed); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			results = parsed.Results
+		}
+		if len(results) != 3 {
+			t.Fatalf("Expected 3 results but got %v", len(results))
+		}
+		if results[0].Link == nil || results[0].Link.Shortened != "https://test/"+defaultTestResponse.ShortID {
+			t.Fatalf("Expected a link for the first item, got %+v", results[0])
+		}
+		for _, result := range results[1:] {
+			if result.Link != nil || result.Error == nil || result.Error.Code != codeBadRequest {
+				t.Fatalf("Expected a bad request error, got %+v", result)
+			}
+		}
+		for i, result := range results {
+			if result.Index != i {
+				t.Fatalf("Expected index %v but got %v", i, result.Index)
+			}
+		}
+	}
+}
+
+func TestBatchRejectsMalformedBodies(t *testing.T) {
+	tests := []struct {
+		contentType string
+		content     string
+		service     fakeUserService
+		status      int
+	}{
+		{contentType: "text/plain", content: `[]`, status: http.StatusBadRequest},
+		{contentType: jsonType, content: `{"url": "https://example.com"}`, status: http.StatusBadRequest},
+		{contentType: jsonType, content: `[{"url": "https://example.com"}`, status: http.StatusBadRequest},
+		{contentType: jsonType, content: `[] []`, status: http.StatusBadRequest},
+		{contentType: ndjsonType, content: "{\"url\": \"https://example.com\"}\n{ bad json ]", status: http.StatusBadRequest},
+		{contentType: jsonType, content: `[]`, status: http.StatusOK},
+		{contentType: jsonType, content: `[{"url": "https://example.com"}]`, service: fakeUserService{batchError: &shorturl.ErrRepoInternal{}}, status: http.StatusServiceUnavailable},
+		{contentType: jsonType, content: "[" + strings.Repeat(`{"url": "https://example.com"},`, maxBatchItems) + `{"url": "https://example.com"}]`, status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/api/links:batch", strings.NewReader(test.content))
+		request.Header.Set("content-type", test.contentType)
+		w := httptest.NewRecorder()
+		buildHandler(&test.service, &Config{Origin: "https://test"}).ServeHTTP(w, request)
+		if status := w.Result().StatusCode; status != test.status {
+			t.Fatalf("Expected status %v but got %v for %v %.40v", test.status, status, test.contentType, test.content)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/carlos-marchal/shorty/entities"
+	"github.com/carlos-marchal/shorty/logging"
+	"github.com/carlos-marchal/shorty/transfer"
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+// Error codes identify the kind of error in a response body. Unlike the
+// messages, they are stable and meant to be checked by clients.
+const (
+	codeBadRequest       = "bad_request"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeCSRF             = "csrf_failed"
+	codeRateLimited      = "rate_limited"
+	codeNotFound         = "not_found"
+	codeExpired          = "expired"
+	codeQuarantined      = "quarantined"
+	codeNotOwner         = "not_owner"
+	codeInvalidURL       = "invalid_url"
+	codeInvalidID        = "invalid_id"
+	codeInvalidRecord    = "invalid_record"
+	codeConflict         = "conflict"
+	codeInvalidTags      = "invalid_tags"
+	codeInvalidRedirect  = "invalid_redirect"
+	codeTargetNotAllowed = "target_not_allowed"
+	codeUnavailable      = "repository_unavailable"
+	codeTimeout          = "repository_timeout"
+	codeInternal         = "internal_error"
+)
+
+type errorBody struct {
+	Error   string     `json:"error"`
+	Code    string     `json:"code"`
+	Expired *time.Time `json:"expired,omitempty"`
+}
+
+func sendErrorBody(w http.ResponseWriter, body *errorBody, status int) {
+	content, _ := json.MarshalIndent(body, "", "  ")
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, string(content))
+}
+
+func sendErrorJSON(w http.ResponseWriter, code string, error string, status int) {
+	sendErrorBody(w, &errorBody{Error: error, Code: code}, status)
+}
+
+// useCaseError returns the body and status matching an error returned by the
+// use cases for the link with the given ID.
+func useCaseError(err error, id string) (*errorBody, int) {
+	switch err := err.(type) {
+	case *shorturl.ErrRepoNotFound:
+		return &errorBody{Error: fmt.Sprintf("URL for ID %v not found.", id), Code: codeNotFound}, http.StatusNotFound
+	case *shorturl.ErrURLExpired:
+		expired := err.Time
+		return &errorBody{
+			Error:   fmt.Sprintf("URL for ID %v expired on %v.", id, expired.Format(time.RFC3339)),
+			Code:    codeExpired,
+			Expired: &expired,
+		}, http.StatusGone
+	case *shorturl.ErrURLQuarantined:
+		return &errorBody{Error: fmt.Sprintf("URL for ID %v was disabled because its target is listed as malware or phishing.", id), Code: codeQuarantined}, http.StatusForbidden
+	case *shorturl.ErrNotOwner:
+		return &errorBody{Error: "Only the owner of a link can change it.", Code: codeNotOwner}, http.StatusForbidden
+	case *entities.ErrInvalidURL:
+		return &errorBody{Error: "URL must be a valid HTTP or HTTPS URL.", Code: codeInvalidURL}, http.StatusBadRequest
+	case *entities.ErrInvalidID:
+		return &errorBody{Error: "IDs may only contain letters and digits.", Code: codeInvalidID}, http.StatusBadRequest
+	case *transfer.ErrInvalidRecord:
+		return &errorBody{Error: fmt.Sprintf("The record can't be read: %v.", err.Reason), Code: codeInvalidRecord}, http.StatusBadRequest
+	case *shorturl.ErrImportConflict:
+		return &errorBody{Error: fmt.Sprintf("ID %v is already taken.", err.ID), Code: codeConflict}, http.StatusConflict
+	case *entities.ErrInvalidTag, *entities.ErrTooManyTags:
+		return &errorBody{Error: fmt.Sprintf("Invalid tags: %v.", err), Code: codeInvalidTags}, http.StatusBadRequest
+	case *entities.ErrInvalidRedirect:
+		return &errorBody{Error: "The redirect must be one of 301, 302, 307 or 308.", Code: codeInvalidRedirect}, http.StatusBadRequest
+	case *shorturl.ErrTargetNotAllowed:
+		return &errorBody{Error: fmt.Sprintf("URL can't be shortened because %v.", err.Reason), Code: codeTargetNotAllowed}, http.StatusUnprocessableEntity
+	case *shorturl.ErrWriteLimited:
+		return &errorBody{Error: fmt.Sprintf("Too many requests, try again in %v seconds.", retrySeconds(err.Wait)), Code: codeRateLimited}, http.StatusTooManyRequests
+	case *shorturl.ErrRepoInternal:
+		return &errorBody{Error: "The link storage is unavailable, try again later.", Code: codeUnavailable}, http.StatusServiceUnavailable
+	case *shorturl.ErrRepoTimeout:
+		return &errorBody{Error: "The link storage took too long to answer, try again later.", Code: codeTimeout}, http.StatusGatewayTimeout
+	default:
+		return &errorBody{Error: "Internal server error.", Code: codeInternal}, http.StatusInternalServerError
+	}
+}
+
+func sendUseCaseError(w http.ResponseWriter, r *http.Request, err error, id string) {
+	body, status := useCaseError(err, id)
+	logServerError(r, err, status)
+	sendErrorBody(w, body, status)
+}
+
+// logServerError logs the errors that are the fault of the server, along with
+// their cause, which clients never see.
+func logServerError(r *http.Request, err error, status int) {
+	if status >= http.StatusInternalServerError {
+		logging.FromContext(r.Context()).Error("Request failed", "status", status, "error", err)
+	}
+}
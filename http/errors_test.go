@@ -0,0 +1,58 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+func TestMapsResolveErrors(t *testing.T) {
+	expiry := time.Date(2021, 3, 19, 17, 6, 35, 0, time.UTC)
+	tests := []struct {
+		path    string
+		err     error
+		status  int
+		code    string
+		expired bool
+	}{
+		{path: "/id", err: &shorturl.ErrRepoNotFound{ID: "id"}, status: http.StatusNotFound, code: codeNotFound},
+		{path: "/id", err: &shorturl.ErrURLExpired{URL: "https://example.com", Time: expiry}, status: http.StatusGone, code: codeExpired, expired: true},
+		{path: "/id", err: &shorturl.ErrURLQuarantined{URL: "https://example.com", Reason: "listed"}, status: http.StatusForbidden, code: codeQuarantined},
+		{path: "/id", err: &shorturl.ErrRepoInternal{}, status: http.StatusServiceUnavailable, code: codeUnavailable},
+		{path: "/id", err: &shorturl.ErrRepoTimeout{Err: context.DeadlineExceeded}, status: http.StatusGatewayTimeout, code: codeTimeout},
+		{path: "/id", err: errors.New("unexpected"), status: http.StatusInternalServerError, code: codeInternal},
+		{path: "/id/info", err: &shorturl.ErrURLExpired{URL: "https://example.com", Time: expiry}, status: http.StatusGone, code: codeExpired, expired: true},
+		{path: "/id/info", err: &shorturl.ErrRepoInternal{}, status: http.StatusServiceUnavailable, code: codeUnavailable},
+		{path: "/api/links/id", err: &shorturl.ErrRepoNotFound{ID: "id"}, status: http.StatusNotFound, code: codeNotFound},
+		{path: "/api/links/id", err: &shorturl.ErrURLExpired{URL: "https://example.com", Time: expiry}, status: http.StatusGone, code: codeExpired, expired: true},
+		{path: "/api/links/id", err: &shorturl.ErrRepoInternal{}, status: http.StatusServiceUnavailable, code: codeUnavailable},
+		{path: "/api/links/id", err: &shorturl.ErrRepoTimeout{Err: context.Canceled}, status: http.StatusGatewayTimeout, code: codeTimeout},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", test.path, nil)
+		w := httptest.NewRecorder()
+		testHandler := buildHandler(&fakeUserService{custom: true, resultError: test.err}, &Config{Origin: "https://test"})
+		testHandler.ServeHTTP(w, request)
+		response := w.Result()
+		if response.StatusCode != test.status {
+			t.Fatalf("expected status %v for %v on %v, got %v", test.status, test.err, test.path, response.StatusCode)
+		}
+		parsed := new(errorBody)
+		err := json.NewDecoder(response.Body).Decode(parsed)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if parsed.Code != test.code {
+			t.Fatalf("expected code %v for %v on %v, got %v", test.code, test.err, test.path, parsed.Code)
+		}
+		if test.expired && (parsed.Expired == nil || !parsed.Expired.Equal(expiry)) {
+			t.Fatalf("expected expiry %v in body, got %v", expiry, parsed.Expired)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// defaultReadyWithin is used when the configuration sets no sync threshold.
+const defaultReadyWithin = 5 * time.Minute
+
+type healthBody struct {
+	Status   string     `json:"status"`
+	LastSync *time.Time `json:"last_sync,omitempty"`
+}
+
+type buildBody struct {
+	Version   string `json:"version"`
+	Module    string `json:"module,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+type statusBody struct {
+	Backend       string     `json:"backend,omitempty"`
+	Online        bool       `json:"online"`
+	LastFetch     *time.Time `json:"last_fetch,omitempty"`
+	LastPush      *time.Time `json:"last_push,omitempty"`
+	PendingWrites int        `json:"pending_writes"`
+	Head          string     `json:"head,omitempty"`
+	Links         int        `json:"links"`
+	Serial        uint       `json:"serial"`
+	Build         *buildBody `json:"build"`
+}
+
+// optionalTime leaves zero times out of responses.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// healthzHandler tells that the process is up and serving requests, without
+// checking the repository.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, &healthBody{Status: "ok"})
+}
+
+// readyzHandler tells whether the repository synced with its backend within
+// the configured threshold. A stale repository is synced first, so that an
+// idle server isn't reported as unready.
+func readyzHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.Health == nil {
+			sendJSON(w, &healthBody{Status: "ready"})
+			return
+		}
+		readyWithin := config.ReadyWithin
+		if readyWithin == 0 {
+			readyWithin = defaultReadyWithin
+		}
+		lastSync := config.Health.Health().LastSync()
+		if time.Since(lastSync) > readyWithin {
+			config.Health.Sync(r.Context())
+			lastSync = config.Health.Health().LastSync()
+		}
+		if time.Since(lastSync) > readyWithin {
+			sendErrorJSON(w, codeUnavailable, fmt.Sprintf("The repository has not synced since %v.", lastSync.Format(time.RFC3339)), http.StatusServiceUnavailable)
+			return
+		}
+		sendJSON(w, &healthBody{Status: "ready", LastSync: &lastSync})
+	}
+}
+
+// buildInfo describes the running binary. The version comes from the
+// configuration, or from the module when built with go install.
+func buildInfo(config *Config) *buildBody {
+	build := &buildBody{Version: config.Version, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		build.Module = info.Main.Path
+		if build.Version == "" {
+			build.Version = info.Main.Version
+		}
+	}
+	return build
+}
+
+// statusHandler describes the state of the repository and the build, for
+// administrators.
+func statusHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := &statusBody{Build: buildInfo(config)}
+		if config.Health != nil {
+			health := config.Health.Health()
+			status.Backend = health.Backend
+			status.Online = health.Online
+			status.LastFetch = optionalTime(health.LastFetch)
+			status.LastPush = optionalTime(health.LastPush)
+			status.PendingWrites = health.PendingWrites
+			status.Head = health.Head
+			status.Links = health.Links
+			status.Serial = health.Serial
+		}
+		sendJSON(w, status)
+	}
+}
@@ -0,0 +1,94 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+type fakeHealth struct {
+	health   shorturl.Health
+	syncs    int
+	syncedAt time.Time
+}
+
+func (reporter *fakeHealth) Health() *shorturl.Health {
+	health := reporter.health
+	return &health
+}
+
+func (reporter *fakeHealth) Sync(ctx context.Context) error {
+	reporter.syncs++
+	if !reporter.syncedAt.IsZero() {
+		reporter.health.LastFetch = reporter.syncedAt
+	}
+	return nil
+}
+
+func TestReportsReadiness(t *testing.T) {
+	tests := []struct {
+		lastFetch time.Time
+		syncedAt  time.Time
+		status    int
+		syncs     int
+	}{
+		{lastFetch: time.Now(), status: http.StatusOK},
+		{lastFetch: time.Now().Add(-time.Hour), syncedAt: time.Now(), status: http.StatusOK, syncs: 1},
+		{lastFetch: time.Now().Add(-time.Hour), status: http.StatusServiceUnavailable, syncs: 1},
+	}
+	for _, test := range tests {
+		reporter := &fakeHealth{health: shorturl.Health{LastFetch: test.lastFetch}, syncedAt: test.syncedAt}
+		config := &Config{Origin: "https://test", Health: reporter, ReadyWithin: time.Minute}
+		w := httptest.NewRecorder()
+		buildHandler(&fakeUserService{}, config).ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		if status := w.Result().StatusCode; status != test.status {
+			t.Fatalf("Expected status %v but got %v for %+v", test.status, status, test)
+		}
+		if reporter.syncs != test.syncs {
+			t.Fatalf("Expected %v syncs but got %v", test.syncs, reporter.syncs)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	buildHandler(&fakeUserService{}, &Config{Origin: "https://test"}).ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if status := w.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("Expected healthz to succeed, got %v", status)
+	}
+}
+
+func TestReportsStatus(t *testing.T) {
+	fetched := time.Now().Add(-time.Minute).Round(time.Second)
+	reporter := &fakeHealth{health: shorturl.Health{Backend: "git", Online: true, LastFetch: fetched, Head: "abc", Links: 3, Serial: 7}}
+	config := &Config{
+		Origin:      "https://test",
+		Keys:        []KeyStore{NewStaticKeys(map[string]string{"admin": "admin-key"})},
+		AdminOwners: []string{"admin"},
+		Health:      reporter,
+		Version:     "1.2.3",
+	}
+	w := httptest.NewRecorder()
+	buildHandler(&fakeUserService{}, config).ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if status := w.Result().StatusCode; status != http.StatusUnauthorized {
+		t.Fatalf("Expected status to require a key, got %v", status)
+	}
+	request := httptest.NewRequest("GET", "/status", nil)
+	request.Header.Set("x-api-key", "admin-key")
+	w = httptest.NewRecorder()
+	buildHandler(&fakeUserService{}, config).ServeHTTP(w, request)
+	body := new(statusBody)
+	err := json.NewDecoder(w.Body).Decode(body)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if body.Backend != "git" || body.Head != "abc" || body.Links != 3 || body.Serial != 7 || !body.LastFetch.Equal(fetched) || body.LastPush != nil {
+		t.Fatalf("Unexpected status %+v", body)
+	}
+	if body.Build.Version != "1.2.3" || body.Build.GoVersion == "" {
+		t.Fatalf("Unexpected build info %+v", body.Build)
+	}
+}
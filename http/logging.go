@@ -0,0 +1,51 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/carlos-marchal/shorty/logging"
+)
+
+const requestIDHeader = "x-request-id"
+
+// validRequestID limits the IDs taken from clients, so that they can't inject
+// anything into the logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// logRequests gives every request an ID, taken from the x-request-id header
+// if the client or a proxy sent a valid one, and sends it back in the same
+// header. The logger of the request context carries the ID, so that every
+// line logged on behalf of the request can be told apart. Once handled, the
+// request itself is logged.
+func logRequests(logger *logging.Logger, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		requestLogger := logger.With("request_id", id)
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r.WithContext(logging.NewContext(r.Context(), requestLogger)))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		requestLogger.Info("Handled request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
@@ -0,0 +1,78 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/carlos-marchal/shorty/logging"
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+func TestAssignsRequestIDs(t *testing.T) {
+	tests := []struct {
+		header    string
+		preserved bool
+	}{
+		{header: "", preserved: false},
+		{header: "trace-1", preserved: true},
+		{header: "not valid\"", preserved: false},
+		{header: strings.Repeat("a", 129), preserved: false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/healthz", nil)
+		if test.header != "" {
+			request.Header.Set("x-request-id", test.header)
+		}
+		w := httptest.NewRecorder()
+		config := &Config{Origin: "https://test", Logger: logging.New(new(bytes.Buffer), logging.Info)}
+		buildHandler(&fakeUserService{}, config).ServeHTTP(w, request)
+		id := w.Result().Header.Get("x-request-id")
+		if test.preserved && id != test.header {
+			t.Fatalf("Expected request ID %q to be kept, got %q", test.header, id)
+		}
+		if !test.preserved && (id == test.header || len(id) != 16) {
+			t.Fatalf("Expected a new request ID instead of %q, got %q", test.header, id)
+		}
+	}
+}
+
+func TestLogsServerErrorsWithRequestID(t *testing.T) {
+	var out bytes.Buffer
+	service := &fakeUserService{custom: true, resultError: &shorturl.ErrRepoInternal{Err: errors.New("pushing to remote: timeout")}}
+	config := &Config{Origin: "https://test", Logger: logging.New(&out, logging.Info)}
+	request := httptest.NewRequest("GET", "/id", nil)
+	request.Header.Set("x-request-id", "trace-1")
+	w := httptest.NewRecorder()
+	buildHandler(service, config).ServeHTTP(w, request)
+	if status := w.Result().StatusCode; status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %v, got %v", http.StatusServiceUnavailable, status)
+	}
+	if strings.Contains(w.Body.String(), "pushing") {
+		t.Fatalf("Expected the cause to be hidden from the client, got %v", w.Body.String())
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected the error and the request to be logged, got %v", lines)
+	}
+	for _, line := range lines {
+		fields := make(map[string]interface{})
+		err := json.Unmarshal([]byte(line), &fields)
+		if err != nil {
+			t.Fatalf("Expected JSON, got %v: %v", line, err)
+		}
+		if fields["request_id"] != "trace-1" {
+			t.Fatalf("Expected the request ID in %v", line)
+		}
+	}
+	if !strings.Contains(lines[0], `"level":"error"`) || !strings.Contains(lines[0], "pushing to remote: timeout") {
+		t.Fatalf("Expected the cause to be logged as an error, got %v", lines[0])
+	}
+	if !strings.Contains(lines[1], `"status":503`) {
+		t.Fatalf("Expected the request to be logged with its status, got %v", lines[1])
+	}
+}
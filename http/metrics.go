@@ -0,0 +1,93 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/carlos-marchal/shorty/logging"
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+// Metrics records what the server does, and exports it on /metrics.
+type Metrics interface {
+	ObserveRequest(route string, status int, duration time.Duration)
+	// CountResolve counts a resolved ID by its outcome, which is one of hit,
+	// miss, expired, quarantined or error.
+	CountResolve(outcome string)
+	// Export writes every metric in the Prometheus text format.
+	Export(w io.Writer) error
+}
+
+// noMetrics is used when the configuration sets no metrics.
+type noMetrics struct{}
+
+func (noMetrics) ObserveRequest(route string, status int, duration time.Duration) {}
+func (noMetrics) CountResolve(outcome string)                                     {}
+func (noMetrics) Export(w io.Writer) error                                        { return nil }
+
+// statusRecorder remembers the status sent by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(content []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(content)
+}
+
+// instrument records the status and duration of every request to a route.
+// The route is the pattern it is registered with, so that the number of
+// label values stays bounded.
+func instrument(metrics Metrics, route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		metrics.ObserveRequest(route, recorder.status, time.Since(start))
+	}
+}
+
+// resolveOutcome classifies the result of resolving an ID for the metrics.
+func resolveOutcome(err error) string {
+	switch err.(type) {
+	case nil:
+		return "hit"
+	case *shorturl.ErrRepoNotFound:
+		return "miss"
+	case *shorturl.ErrURLExpired:
+		return "expired"
+	case *shorturl.ErrURLQuarantined:
+		return "quarantined"
+	default:
+		return "error"
+	}
+}
+
+func metricsHandler(metrics Metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			sendErrorJSON(w, codeMethodNotAllowed, fmt.Sprintf("Method %v not supported.", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("content-type", "text/plain; version=0.0.4; charset=utf-8")
+		err := metrics.Export(w)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Could not export metrics", "error", err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carlos-marchal/shorty/entities"
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+type fakeMetrics struct {
+	requests []string
+	resolves []string
+}
+
+func (metrics *fakeMetrics) ObserveRequest(route string, status int, duration time.Duration) {
+	metrics.requests = append(metrics.requests, fmt.Sprintf("%v %v", route, status))
+}
+
+func (metrics *fakeMetrics) CountResolve(outcome string) {
+	metrics.resolves = append(metrics.resolves, outcome)
+}
+
+func (metrics *fakeMetrics) Export(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "requests %v\n", len(metrics.requests))
+	return err
+}
+
+func TestRecordsRequestMetrics(t *testing.T) {
+	url := &entities.ShortURL{Target: "https://example.com", ShortID: "GA", Expires: time.Now().Add(time.Hour)}
+	tests := []struct {
+		service *fakeUserService
+		path    string
+		request string
+		resolve string
+	}{
+		{service: &fakeUserService{custom: true, resultURL: url}, path: "/GA", request: "/ 307", resolve: "hit"},
+		{service: &fakeUserService{custom: true, resultError: &shorturl.ErrRepoNotFound{ID: "GE"}}, path: "/GE", request: "/ 404", resolve: "miss"},
+		{service: &fakeUserService{custom: true, resultError: &shorturl.ErrURLExpired{}}, path: "/GI", request: "/ 410", resolve: "expired"},
+		{service: &fakeUserService{}, path: "/healthz", request: "/healthz 200"},
+		{service: &fakeUserService{}, path: "/ui/unknown", request: "/ui/ 404"},
+	}
+	for _, test := range tests {
+		metrics := new(fakeMetrics)
+		w := httptest.NewRecorder()
+		buildHandler(test.service, &Config{Origin: "https://test", Metrics: metrics}).ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if len(metrics.requests) != 1 || metrics.requests[0] != test.request {
+			t.Fatalf("Expected request %q but got %v", test.request, metrics.requests)
+		}
+		if test.resolve == "" && len(metrics.resolves) > 0 || test.resolve != "" && (len(metrics.resolves) != 1 || metrics.resolves[0] != test.resolve) {
+			t.Fatalf("Expected resolve %q but got %v", test.resolve, metrics.resolves)
+		}
+	}
+
+	metrics := &fakeMetrics{requests: []string{"/ 307"}}
+	w := httptest.NewRecorder()
+	buildHandler(&fakeUserService{}, &Config{Origin: "https://test", Metrics: metrics}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if status := w.Result().StatusCode; status != http.StatusOK || !strings.Contains(w.Body.String(), "requests 1") {
+		t.Fatalf("Expected exported metrics, got %v: %v", status, w.Body.String())
+	}
+}
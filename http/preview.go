@@ -0,0 +1,61 @@
+package http
+
+import (
+	"embed"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/carlos-marchal/shorty/entities"
+	"github.com/carlos-marchal/shorty/logging"
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+//go:embed templates
+var templateFiles embed.FS
+
+var templates = template.Must(template.ParseFS(templateFiles, "templates/*.html"))
+
+// previewPage is the data rendered by the preview template.
+type previewPage struct {
+	Target      string
+	Host        string
+	Shortened   string
+	Title       string
+	Description string
+	Created     time.Time
+	Expires     time.Time
+	Warning     bool
+}
+
+// isExternal reports whether target is outside of the internal domains. With
+// no internal domains configured every target is external.
+func isExternal(target string, config *Config) bool {
+	return !shorturl.MatchesDomain(target, config.InternalDomains)
+}
+
+// sendPreview renders a page describing where the link goes, with a button to
+// continue there. With warning set it also cautions about leaving for an
+// external domain.
+func sendPreview(w http.ResponseWriter, shortURL *entities.ShortURL, config *Config, warning bool) {
+	host := shortURL.Target
+	if parsed, err := url.Parse(shortURL.Target); err == nil {
+		host = parsed.Host
+	}
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.Header().Set("cache-control", "private, no-cache")
+	err := templates.ExecuteTemplate(w, "preview.html", &previewPage{
+		Target:      shortURL.Target,
+		Host:        host,
+		Shortened:   newResponseBody(shortURL, config).Shortened,
+		Title:       shortURL.Title,
+		Description: shortURL.Description,
+		Created:     shortURL.Created,
+		Expires:     shortURL.Expires,
+		Warning:     warning,
+	})
+	if err != nil {
+		logging.Default().Error("Could not render the preview", "id", shortURL.ShortID, "error", err)
+	}
+}
@@ -0,0 +1,166 @@
+package http
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+// RateLimit configures a token bucket that allows Burst requests at once and
+// refills at PerMinute requests per minute. A zero PerMinute disables it.
+type RateLimit struct {
+	PerMinute float64
+	Burst     int
+}
+
+type RateLimits struct {
+	RedirectsPerIP RateLimit
+	ShortensPerIP  RateLimit
+	ShortensPerKey RateLimit
+	// Writes is shared by every request that commits to the repository,
+	// whoever makes it, and counts commits rather than requests: shortening
+	// a single URL makes two. Requests that end up changing nothing don't
+	// count.
+	Writes RateLimit
+	// TrustForwardedFor identifies clients by the last address in the
+	// x-forwarded-for header, as added by the proxy in front of the server,
+	// instead of by the connection address.
+	TrustForwardedFor bool
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter keeps a token bucket per key, such as a client IP or an API key.
+type limiter struct {
+	limit     RateLimit
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newLimiter(limit RateLimit) *limiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &limiter{
+		limit:   limit,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// take consumes tokens from the bucket of key, or all of a full bucket if it
+// holds fewer, so that no request needs more than the burst. If the bucket has
+// too few it returns false and how long until they are available.
+func (limiter *limiter) take(key string, tokens int) (bool, time.Duration) {
+	if limiter.limit.PerMinute <= 0 {
+		return true, 0
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	now := limiter.now()
+	limiter.sweep(now)
+	perSecond := limiter.limit.PerMinute / 60
+	current, ok := limiter.buckets[key]
+	if !ok {
+		current = &bucket{float64(limiter.limit.Burst), now}
+		limiter.buckets[key] = current
+	}
+	current.tokens = math.Min(
+		float64(limiter.limit.Burst),
+		current.tokens+now.Sub(current.last).Seconds()*perSecond,
+	)
+	current.last = now
+	needed := math.Min(float64(tokens), float64(limiter.limit.Burst))
+	if current.tokens < needed {
+		return false, time.Duration((needed - current.tokens) / perSecond * float64(time.Second))
+	}
+	current.tokens -= needed
+	return true, 0
+}
+
+// sweep drops buckets that have refilled completely, since they are the same
+// as a new one. It runs at most once a minute.
+func (limiter *limiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < time.Minute {
+		return
+	}
+	limiter.lastSweep = now
+	refill := time.Duration(float64(limiter.limit.Burst) / limiter.limit.PerMinute * float64(time.Minute))
+	for key, bucket := range limiter.buckets {
+		if now.Sub(bucket.last) > refill {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// wrap wraps handler so that requests are rejected once the bucket for the
+// key of the request runs out. Requests with an empty key are not limited.
+func (limiter *limiter) wrap(keyOf func(r *http.Request) string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := keyOf(r)
+		if key == "" {
+			handler(w, r)
+			return
+		}
+		ok, wait := limiter.take(key, 1)
+		if !ok {
+			seconds := retrySeconds(wait)
+			w.Header().Set("retry-after", fmt.Sprint(seconds))
+			sendErrorJSON(w, codeRateLimited, fmt.Sprintf("Too many requests, try again in %v seconds.", seconds), http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// gate lets every request through to handler, but has the use cases take a
+// token per commit from the bucket of key right before they write. Requests that end up
+// writing nothing, such as shortening a target that is already shortened,
+// aren't limited.
+func (limiter *limiter) gate(key string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := shorturl.WithWriteGate(r.Context(), func(commits int) error {
+			ok, wait := limiter.take(key, commits)
+			if !ok {
+				w.Header().Set("retry-after", fmt.Sprint(retrySeconds(wait)))
+				return &shorturl.ErrWriteLimited{Wait: wait}
+			}
+			return nil
+		})
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// retrySeconds rounds wait up to whole seconds, as clients are told to wait.
+func retrySeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// everyone is the key of the bucket shared by all clients.
+const everyone = "*"
+
+// clientIP returns the address identifying the client of the request.
+func clientIP(limits *RateLimits) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if forwarded := r.Header.Get("x-forwarded-for"); limits.TrustForwardedFor && forwarded != "" {
+			addresses := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+}
@@ -0,0 +1,183 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketRefillsOverTime(t *testing.T) {
+	now := time.Now()
+	testLimiter := newLimiter(RateLimit{PerMinute: 60, Burst: 2})
+	testLimiter.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if ok, _ := testLimiter.take("client", 1); !ok {
+			t.Fatalf("Expected request %v within burst to be allowed", i)
+		}
+	}
+	ok, wait := testLimiter.take("client", 1)
+	if ok || wait <= 0 || wait > time.Second {
+		t.Fatalf("Expected request over burst to wait up to a second, got %v and %v", ok, wait)
+	}
+	if ok, _ := testLimiter.take("other", 1); !ok {
+		t.Fatal("Expected other keys to have their own bucket")
+	}
+	now = now.Add(time.Second)
+	if ok, _ := testLimiter.take("client", 1); !ok {
+		t.Fatal("Expected bucket to refill after a second")
+	}
+}
+
+func TestTakesSeveralTokensUpToBurst(t *testing.T) {
+	now := time.Now()
+	testLimiter := newLimiter(RateLimit{PerMinute: 60, Burst: 3})
+	testLimiter.now = func() time.Time { return now }
+	if ok, _ := testLimiter.take("client", 2); !ok {
+		t.Fatal("Expected two tokens within burst to be allowed")
+	}
+	ok, wait := testLimiter.take("client", 2)
+	if ok || wait <= 0 || wait > time.Second {
+		t.Fatalf("Expected two tokens with one left to wait up to a second, got %v and %v", ok, wait)
+	}
+	if ok, _ := testLimiter.take("other", 5); !ok {
+		t.Fatal("Expected more tokens than the burst to take a full bucket")
+	}
+	if ok, _ := testLimiter.take("other", 1); ok {
+		t.Fatal("Expected the bucket to be empty after taking more than the burst")
+	}
+}
+
+func newShortenRequest(remoteAddr string, key string) *http.Request {
+	request := httptest.NewRequest("POST", "/shorten", strings.NewReader(`{"url": "https://example.com"}`))
+	request.Header.Set("content-type", "application/json")
+	request.RemoteAddr = remoteAddr
+	if key != "" {
+		request.Header.Set("x-api-key", key)
+	}
+	return request
+}
+
+func TestRejectsRequestsOverLimit(t *testing.T) {
+	testHandler := buildHandler(&fakeUserService{}, &Config{
+		Origin:     "https://test",
+		RateLimits: RateLimits{ShortensPerIP: RateLimit{PerMinute: 1, Burst: 1}},
+	})
+	w := httptest.NewRecorder()
+	testHandler.ServeHTTP(w, newShortenRequest("192.0.2.1:1234", ""))
+	if status := w.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("Expected first request to succeed, got %v", status)
+	}
+	w = httptest.NewRecorder()
+	testHandler.ServeHTTP(w, newShortenRequest("192.0.2.1:1234", ""))
+	response := w.Result()
+	if response.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected too many requests, got %v", response.StatusCode)
+	}
+	if retry := response.Header.Get("retry-after"); retry != "60" {
+		t.Fatalf("Expected to retry after 60 seconds, got %q", retry)
+	}
+	parsed := new(struct {
+		Error string `json:"error"`
+	})
+	err := json.NewDecoder(response.Body).Decode(parsed)
+	if err != nil || parsed.Error == "" {
+		t.Fatalf("Expected json error body, got %v", err)
+	}
+	w = httptest.NewRecorder()
+	testHandler.ServeHTTP(w, newShortenRequest("192.0.2.2:1234", ""))
+	if status := w.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("Expected other clients not to be limited, got %v", status)
+	}
+}
+
+func TestLimitsRedirectsSeparately(t *testing.T) {
+	testHandler := buildHandler(&fakeUserService{}, &Config{
+		Origin: "https://test",
+		RateLimits: RateLimits{
+			RedirectsPerIP: RateLimit{PerMinute: 1, Burst: 1},
+			ShortensPerIP:  RateLimit{PerMinute: 1, Burst: 1},
+		},
+	})
+	w := httptest.NewRecorder()
+	testHandler.ServeHTTP(w, newShortenRequest("192.0.2.1:1234", ""))
+	for i, expected := range []int{http.StatusTemporaryRedirect, http.StatusTooManyRequests} {
+		request := httptest.NewRequest("GET", "/id", nil)
+		request.RemoteAddr = "192.0.2.1:1234"
+		w = httptest.NewRecorder()
+		testHandler.ServeHTTP(w, request)
+		if status := w.Result().StatusCode; status != expected {
+			t.Fatalf("Expected status %v for redirect %v, got %v", expected, i, status)
+		}
+	}
+}
+
+func TestLimitsEachKey(t *testing.T) {
+	keys := NewStaticKeys(map[string]string{"first": "first-key", "second": "second-key"})
+	testHandler := buildHandler(&fakeUserService{}, &Config{
+		Origin:     "https://test",
+		Keys:       []KeyStore{keys},
+		RateLimits: RateLimits{ShortensPerKey: RateLimit{PerMinute: 1, Burst: 1}},
+	})
+	tests := []struct {
+		key      string
+		expected int
+	}{
+		{key: "first-key", expected: http.StatusOK},
+		{key: "first-key", expected: http.StatusTooManyRequests},
+		{key: "second-key", expected: http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		testHandler.ServeHTTP(w, newShortenRequest("192.0.2.1:1234", test.key))
+		if status := w.Result().StatusCode; status != test.expected {
+			t.Fatalf("Expected status %v for %v, got %v", test.expected, test.key, status)
+		}
+	}
+}
+
+func TestCapsWritesGlobally(t *testing.T) {
+	testHandler := buildHandler(&fakeUserService{}, &Config{
+		Origin:     "https://test",
+		Keys:       []KeyStore{testKeys},
+		RateLimits: RateLimits{Writes: RateLimit{PerMinute: 2, Burst: 2}},
+	})
+	deleteRequest := httptest.NewRequest("DELETE", "/api/links/id", nil)
+	deleteRequest.Header.Set("x-api-key", "secret-key")
+	requests := []*http.Request{
+		newShortenRequest("192.0.2.1:1234", "secret-key"),
+		deleteRequest,
+		newShortenRequest("192.0.2.3:1234", "secret-key"),
+	}
+	for i, expected := range []int{http.StatusOK, http.StatusNoContent, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		testHandler.ServeHTTP(w, requests[i])
+		if status := w.Result().StatusCode; status != expected {
+			t.Fatalf("Expected status %v for write %v, got %v", expected, i, status)
+		}
+		if expected == http.StatusTooManyRequests && w.Result().Header.Get("retry-after") == "" {
+			t.Fatalf("Expected a retry-after header")
+		}
+	}
+	request := httptest.NewRequest("GET", "/api/links/id", nil)
+	request.Header.Set("x-api-key", "secret-key")
+	w := httptest.NewRecorder()
+	testHandler.ServeHTTP(w, request)
+	if status := w.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("Expected reads not to count as writes, got %v", status)
+	}
+}
+
+func TestIdentifiesClientsBehindProxy(t *testing.T) {
+	request := httptest.NewRequest("GET", "/id", nil)
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Set("x-forwarded-for", "203.0.113.7, 198.51.100.2")
+	if ip := clientIP(&RateLimits{})(request); ip != "10.0.0.1" {
+		t.Fatalf("Expected connection address without trusting proxy, got %v", ip)
+	}
+	if ip := clientIP(&RateLimits{TrustForwardedFor: true})(request); ip != "198.51.100.2" {
+		t.Fatalf("Expected address added by proxy, got %v", ip)
+	}
+}
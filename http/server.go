@@ -1,109 +1,433 @@
 package http
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/carlos-marchal/shorty/entities"
+	"github.com/carlos-marchal/shorty/logging"
 	"github.com/carlos-marchal/shorty/usecases/shorturl"
 )
 
+type metadataBody struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	Creator     string   `json:"creator"`
+}
+
+func (body *metadataBody) toEntity() *entities.Metadata {
+	return &entities.Metadata{
+		Title:       body.Title,
+		Description: body.Description,
+		Tags:        body.Tags,
+		Creator:     body.Creator,
+	}
+}
+
 type requestBody struct {
-	URL *string `json:"url"`
+	URL          *string `json:"url"`
+	Dedupe       string  `json:"dedupe"`
+	Redirect     int     `json:"redirect"`
+	Interstitial bool    `json:"interstitial"`
+	metadataBody
 }
 
 type responseBody struct {
-	Target    string    `json:"target"`
-	Shortened string    `json:"shortened"`
-	Expires   time.Time `json:"expires"`
+	Target       string     `json:"target"`
+	Shortened    string     `json:"shortened"`
+	Expires      time.Time  `json:"expires"`
+	Created      *time.Time `json:"created,omitempty"`
+	Owner        string     `json:"owner,omitempty"`
+	Redirect     int        `json:"redirect,omitempty"`
+	Interstitial bool       `json:"interstitial,omitempty"`
+	Title        string     `json:"title,omitempty"`
+	Description  string     `json:"description,omitempty"`
+	Tags         []string   `json:"tags,omitempty"`
+	Creator      string     `json:"creator,omitempty"`
+}
+
+type listResponseBody struct {
+	Links []*responseBody `json:"links"`
+	Next  string          `json:"next,omitempty"`
+}
+
+// cursorBody is the JSON form of a list cursor. It is handed to clients base64
+// encoded, and they should treat it as opaque.
+type cursorBody struct {
+	Created time.Time `json:"c"`
+	ShortID string    `json:"i"`
+}
+
+var listStatuses = map[string]shorturl.Status{
+	"":        shorturl.AnyStatus,
+	"all":     shorturl.AnyStatus,
+	"active":  shorturl.ActiveStatus,
+	"expired": shorturl.ExpiredStatus,
+}
+
+var dedupeModes = map[string]shorturl.DedupeMode{
+	"":       shorturl.DefaultDedupe,
+	"always": shorturl.AlwaysReuse,
+	"never":  shorturl.NeverReuse,
+	"owner":  shorturl.ReuseOwn,
+}
+
+// parseFilter reads the filter of a listing from the query. It fails if the
+// status is not one of the known ones.
+func parseFilter(query url.Values) (*shorturl.Filter, bool) {
+	status, ok := listStatuses[query.Get("status")]
+	if !ok {
+		return nil, false
+	}
+	return &shorturl.Filter{
+		Tag:     query.Get("tag"),
+		Target:  query.Get("target"),
+		Creator: query.Get("creator"),
+		Status:  status,
+	}, true
+}
+
+func encodeCursor(cursor *shorturl.Cursor) string {
+	content, _ := json.Marshal(&cursorBody{cursor.Created, cursor.ShortID})
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func decodeCursor(value string) (*shorturl.Cursor, error) {
+	content, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	parsed := new(cursorBody)
+	err = json.Unmarshal(content, parsed)
+	if err != nil {
+		return nil, err
+	}
+	return &shorturl.Cursor{Created: parsed.Created, ShortID: parsed.ShortID}, nil
+}
+
+const badShortenBody = "The body must be a json object with a url string field, and optionally title, description, creator, tags, dedupe, redirect and interstitial fields."
+
+const badShortenForm = "Please enter a valid URL, and a numeric redirect status if any."
+
+const badMetadataBody = "The body must be a json object with optional title, description, creator and tags fields."
+
+func newResponseBody(url *entities.ShortURL, config *Config) *responseBody {
+	response := &responseBody{
+		Target:       url.Target,
+		Shortened:    fmt.Sprintf("%v/%v", config.Origin, url.ShortID),
+		Expires:      url.Expires,
+		Owner:        url.Owner,
+		Redirect:     int(url.Redirect),
+		Interstitial: url.Interstitial,
+		Title:        url.Title,
+		Description:  url.Description,
+		Tags:         url.Tags,
+		Creator:      url.Creator,
+	}
+	if !url.Created.IsZero() {
+		response.Created = &url.Created
+	}
+	return response
+}
+
+func sendJSON(w http.ResponseWriter, body interface{}) {
+	content, err := json.MarshalIndent(body, "", "  ")
+	if err != nil {
+		sendErrorJSON(w, codeInternal, "Internal server error.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("content-type", "application/json")
+	w.Write(content)
 }
 
 type Config struct {
 	Port   uint
 	Origin string
+	// Keys are checked in order to authenticate API requests. If there are
+	// none, the API is open to anyone.
+	Keys       []KeyStore
+	RateLimits RateLimits
+	// DefaultRedirect is used for links created without a redirect type. If
+	// unset it is 307 Temporary Redirect.
+	DefaultRedirect entities.RedirectType
+	// InternalDomains are the domain patterns of the organization. Links with
+	// an interstitial only show it when leaving for any other domain.
+	InternalDomains []string
+	// Bookmarklet enables shortening with GET /shorten?url=, so that a
+	// bookmark can shorten the page being viewed.
+	Bookmarklet bool
+	// AdminOwners are the owners of the keys allowed to import and export
+	// links.
+	AdminOwners []string
+	// Health reports the state of the repository on /readyz and /status. If
+	// nil the server is always ready.
+	Health shorturl.HealthReporter
+	// ReadyWithin is how recently the repository must have synced for the
+	// server to be ready. It defaults to five minutes.
+	ReadyWithin time.Duration
+	// Version is the version of the build shown on /status.
+	Version string
+	// Metrics records requests and resolves. If set, they are exported on
+	// /metrics.
+	Metrics Metrics
+	// Logger logs every request, and is handed to the use cases through the
+	// request context. It defaults to logging.Default().
+	Logger *logging.Logger
+	// ReadTimeout bounds how long GET requests may wait for the use cases,
+	// and WriteTimeout how long any other request may. Requests that run out
+	// of time get a 504 response. Zero means no limit.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
 }
 
-func Start(urls shorturl.UseCase, config *Config) error {
-	handler := buildHandler(urls, config)
-	return http.ListenAndServe(fmt.Sprintf("0.0.0.0:%v", config.Port), handler)
+// NewServer builds the server for the given configuration. It is started with
+// ListenAndServe and stopped with Shutdown, which lets the requests in
+// progress finish.
+func NewServer(urls shorturl.UseCase, config *Config) *http.Server {
+	return &http.Server{
+		Addr:    fmt.Sprintf("0.0.0.0:%v", config.Port),
+		Handler: buildHandler(urls, config),
+	}
 }
 
-func sendErrorJSON(w http.ResponseWriter, error string, code int) {
-	body, _ := json.MarshalIndent(struct {
-		Error string `json:"error"`
-	}{error}, "", "  ")
-	w.Header().Set("content-type", "application/json")
-	w.WriteHeader(code)
-	fmt.Fprintln(w, string(body))
+// withTimeout cancels the context of requests once the timeout configured for
+// their method passes, or the write timeout for routes that always write. The
+// context is also cancelled when the client goes away, so that the use cases
+// stop working for nobody.
+func withTimeout(config *Config, writes bool, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeout := config.WriteTimeout
+		if !writes && (r.Method == "GET" || r.Method == "HEAD") {
+			timeout = config.ReadTimeout
+		}
+		if timeout <= 0 {
+			handler(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// maxRedirectAge caps how long permanent redirects may be cached.
+const maxRedirectAge = 365 * 24 * time.Hour
+
+// cacheControl lets clients cache permanent redirects until the link expires,
+// and makes them check back on every use of temporary ones.
+func cacheControl(url *entities.ShortURL, redirect entities.RedirectType) string {
+	age := time.Until(url.Expires)
+	if !redirect.Permanent() || age <= 0 {
+		return "private, no-cache"
+	}
+	if age > maxRedirectAge {
+		age = maxRedirectAge
+	}
+	return fmt.Sprintf("public, max-age=%v", int(age.Seconds()))
 }
 
 func buildHandler(urls shorturl.UseCase, config *Config) http.Handler {
 	mux := http.NewServeMux()
+	limits := &config.RateLimits
+	redirectsPerIP := newLimiter(limits.RedirectsPerIP)
+	shortensPerIP := newLimiter(limits.ShortensPerIP)
+	shortensPerKey := newLimiter(limits.ShortensPerKey)
+	writes := newLimiter(limits.Writes)
+	metrics := config.Metrics
+	if metrics == nil {
+		metrics = noMetrics{}
+	}
+	handle := func(route string, handler http.HandlerFunc) {
+		mux.HandleFunc(route, instrument(metrics, route, withTimeout(config, false, handler)))
+	}
+	// handleWrites is like handle, for routes that write whatever the method,
+	// such as /shorten with the bookmarklet.
+	handleWrites := func(route string, handler http.HandlerFunc) {
+		mux.HandleFunc(route, instrument(metrics, route, withTimeout(config, true, handler)))
+	}
 
-	mux.HandleFunc("/shorten", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			sendErrorJSON(w, fmt.Sprintf("Method %v not supported.", r.Method), http.StatusMethodNotAllowed)
+	handleWrites("/shorten", shortensPerIP.wrap(clientIP(limits),
+		authenticate(config, shortensPerKey.wrap(ownerOf, writes.gate(everyone, shortenHandler(urls, config))))))
+
+	// A batch counts as a single shorten against the rate limits, as it is
+	// stored in a single write.
+	handle("/api/links:batch", shortensPerIP.wrap(clientIP(limits),
+		authenticate(config, shortensPerKey.wrap(ownerOf, writes.gate(everyone, batchHandler(urls, config))))))
+
+	handle("/api/links", authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			sendErrorJSON(w, codeMethodNotAllowed, fmt.Sprintf("Method %v not supported.", r.Method), http.StatusMethodNotAllowed)
 			return
 		}
-		if r.Header.Get("content-type") != "application/json" {
-			sendErrorJSON(w, "The body must be a json object with a single url string field.", http.StatusBadRequest)
+		query := r.URL.Query()
+		filter, ok := parseFilter(query)
+		if !ok {
+			sendErrorJSON(w, codeBadRequest, "The status must be one of all, active or expired.", http.StatusBadRequest)
 			return
 		}
-		parsed := new(requestBody)
-		decoder := json.NewDecoder(r.Body)
-		decoder.DisallowUnknownFields()
-		err := decoder.Decode(parsed)
-		if err != nil || parsed.URL == nil || decoder.More() {
-			sendErrorJSON(w, "The body must be a json object with a single url string field.", http.StatusBadRequest)
+		page := new(shorturl.Page)
+		if limit := query.Get("limit"); limit != "" {
+			parsed, err := strconv.ParseUint(limit, 10, 16)
+			if err != nil {
+				sendErrorJSON(w, codeBadRequest, "The limit must be a positive integer.", http.StatusBadRequest)
+				return
+			}
+			page.Limit = int(parsed)
+		}
+		if cursor := query.Get("cursor"); cursor != "" {
+			after, err := decodeCursor(cursor)
+			if err != nil {
+				sendErrorJSON(w, codeBadRequest, "The cursor is not valid.", http.StatusBadRequest)
+				return
+			}
+			page.After = after
+		}
+		result, err := urls.ListURLs(r.Context(), filter, page)
+		if err != nil {
+			sendUseCaseError(w, r, err, "")
 			return
 		}
-		log.Printf("%+v\n", parsed)
-		url, err := urls.ShortenURL(*parsed.URL)
-		switch err.(type) {
-		case *entities.ErrInvalidURL:
-			sendErrorJSON(w, "URL must be a valid HTTP or HTTPS URL.", http.StatusBadRequest)
+		response := &listResponseBody{Links: make([]*responseBody, len(result.URLs))}
+		for i, url := range result.URLs {
+			response.Links[i] = newResponseBody(url, config)
+		}
+		if result.Next != nil {
+			response.Next = encodeCursor(result.Next)
+		}
+		sendJSON(w, response)
+	}))
+
+	handle("/api/links/", authenticate(config, writes.gate(everyone, func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/links/")
+		if id == "" || strings.Contains(id, "/") {
+			sendErrorJSON(w, codeNotFound, "You must provide the ID of a link after /api/links/.", http.StatusNotFound)
 			return
-		case nil:
-			break
-		default:
-			sendErrorJSON(w, "Internal server error.", http.StatusInternalServerError)
+		}
+		if (r.Method == "PUT" || r.Method == "DELETE") && len(config.Keys) == 0 {
+			sendErrorJSON(w, codeForbidden, "Links can only be changed with an API key, and the server accepts none.", http.StatusForbidden)
 			return
 		}
-		response := &responseBody{
-			Target:    url.Target,
-			Shortened: fmt.Sprintf("%v/%v", config.Origin, url.ShortID),
-			Expires:   url.Expires,
+		var url *entities.ShortURL
+		var err error
+		switch r.Method {
+		case "GET":
+			url, err = urls.ResolveURL(r.Context(), id)
+		case "PUT":
+			var mediaType string
+			mediaType, _, err = mime.ParseMediaType(r.Header.Get("content-type"))
+			if err != nil || mediaType != jsonType {
+				sendErrorJSON(w, codeBadRequest, badMetadataBody, http.StatusBadRequest)
+				return
+			}
+			parsed := new(metadataBody)
+			decoder := json.NewDecoder(r.Body)
+			decoder.DisallowUnknownFields()
+			err = decoder.Decode(parsed)
+			if err != nil || decoder.More() {
+				sendErrorJSON(w, codeBadRequest, badMetadataBody, http.StatusBadRequest)
+				return
+			}
+			url, err = urls.UpdateURL(r.Context(), id, ownerOf(r), parsed.toEntity())
+		case "DELETE":
+			err = urls.DeleteURL(r.Context(), id, ownerOf(r))
+		default:
+			sendErrorJSON(w, codeMethodNotAllowed, fmt.Sprintf("Method %v not supported.", r.Method), http.StatusMethodNotAllowed)
+			return
 		}
-		responseBody, err := json.MarshalIndent(response, "", "  ")
 		if err != nil {
-			sendErrorJSON(w, "Internal server error.", http.StatusInternalServerError)
+			sendUseCaseError(w, r, err, id)
+			return
+		}
+		if url == nil {
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-		w.Header().Add("content-type", "application/json")
-		w.Write(responseBody)
+		sendJSON(w, newResponseBody(url, config))
+	})))
+
+	handle("/api/admin/import", requireAdmin(config, writes.gate(everyone, importHandler(urls))))
+	handle("/api/admin/export", requireAdmin(config, exportHandler(urls)))
+	handle("/healthz", healthzHandler)
+	handle("/readyz", readyzHandler(config))
+	handle("/status", requireAdmin(config, statusHandler(config)))
+	if config.Metrics != nil {
+		handle("/metrics", metricsHandler(config.Metrics))
+	}
+
+	handle("/ui/static/", staticHandler().ServeHTTP)
+	handle("/ui/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			sendErrorJSON(w, codeMethodNotAllowed, fmt.Sprintf("Method %v not supported.", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		switch r.URL.Path {
+		case "/ui/":
+			sendHTML(w, "index.html", &indexPage{
+				CSRFToken: csrfToken(w, r, config),
+				NeedsKey:  len(config.Keys) > 0,
+			}, http.StatusOK)
+		case "/ui/links":
+			sendHTML(w, "links.html", &linksPage{NeedsKey: len(config.Keys) > 0}, http.StatusOK)
+		default:
+			sendErrorJSON(w, codeNotFound, "Page not found.", http.StatusNotFound)
+		}
 	})
 
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	handle("/", redirectsPerIP.wrap(clientIP(limits), func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
-			sendErrorJSON(w, fmt.Sprintf("Method %v not supported.", r.Method), http.StatusMethodNotAllowed)
+			sendErrorJSON(w, codeMethodNotAllowed, fmt.Sprintf("Method %v not supported.", r.Method), http.StatusMethodNotAllowed)
 			return
 		}
 		id := r.URL.Path[1:]
+		info := strings.HasSuffix(id, "/info")
+		id = strings.TrimSuffix(id, "/info")
+		_, preview := r.URL.Query()["preview"]
+		if strings.HasSuffix(id, "+") {
+			id, preview = strings.TrimSuffix(id, "+"), true
+		}
 		if id == "" {
-			sendErrorJSON(w, "You must provide some ID to resolve as the path.", http.StatusBadRequest)
+			sendErrorJSON(w, codeBadRequest, "You must provide some ID to resolve as the path.", http.StatusBadRequest)
 			return
 		}
-		url, err := urls.ResolveURL(id)
+		url, err := urls.ResolveURL(r.Context(), id)
+		metrics.CountResolve(resolveOutcome(err))
 		if err != nil {
-			sendErrorJSON(w, fmt.Sprintf("URL for ID %v not found.", id), http.StatusNotFound)
+			sendUseCaseError(w, r, err, id)
 			return
 		}
+		if info {
+			sendJSON(w, newResponseBody(url, config))
+			return
+		}
+		warning := url.Interstitial && isExternal(url.Target, config)
+		if preview || warning {
+			sendPreview(w, url, config, warning)
+			return
+		}
+		redirect := url.Redirect
+		if redirect == entities.DefaultRedirect {
+			redirect = config.DefaultRedirect
+		}
+		if redirect == entities.DefaultRedirect {
+			redirect = entities.TemporaryRedirect
+		}
+		w.Header().Set("cache-control", cacheControl(url, redirect))
 		w.Header().Set("location", url.Target)
-		w.WriteHeader(http.StatusTemporaryRedirect)
-	})
+		w.WriteHeader(int(redirect))
+	}))
 
-	return mux
+	logger := config.Logger
+	if logger == nil {
+		logger = logging.Default()
+	}
+	return logRequests(logger, mux)
 }
@@ -1,39 +1,118 @@
 package http
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/carlos-marchal/shorty/entities"
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
 )
 
 type fakeUserService struct {
 	resultURL   *entities.ShortURL
 	resultError error
+	resultPage  *shorturl.URLPage
 	custom      bool
+	listFilter  *shorturl.Filter
+	listPage    *shorturl.Page
+	owner       string
+	batchError  error
+	imported    []*shorturl.ImportRecord
+	conflicts   shorturl.ConflictMode
+	ctx         context.Context
 }
 
-var defaultTestResponse = &entities.ShortURL{"http://example.com", "1", time.Now()}
+var defaultTestResponse = &entities.ShortURL{Target: "http://example.com", ShortID: "1", Expires: time.Now()}
 
-func (service *fakeUserService) ShortenURL(target string) (*entities.ShortURL, error) {
+func (service *fakeUserService) ShortenURL(ctx context.Context, target string, options *shorturl.ShortenOptions) (*entities.ShortURL, error) {
+	service.ctx = ctx
+	service.owner = options.Owner
+	if service.custom {
+		return service.resultURL, service.resultError
+	}
+	if err := shorturl.AllowWrite(ctx, 1); err != nil {
+		return nil, err
+	}
+	return defaultTestResponse, nil
+}
+
+func (service *fakeUserService) ShortenURLs(ctx context.Context, requests []*shorturl.ShortenRequest) ([]*shorturl.ShortenResult, error) {
+	if service.batchError != nil {
+		return nil, service.batchError
+	}
+	results := make([]*shorturl.ShortenResult, len(requests))
+	for i, request := range requests {
+		url, err := service.ShortenURL(ctx, request.Target, request.Options)
+		results[i] = &shorturl.ShortenResult{URL: url, Err: err}
+	}
+	return results, nil
+}
+
+func (service *fakeUserService) ResolveURL(ctx context.Context, shortID string) (*entities.ShortURL, error) {
+	service.ctx = ctx
 	if service.custom {
 		return service.resultURL, service.resultError
 	}
 	return defaultTestResponse, nil
 }
 
-func (service *fakeUserService) ResolveURL(shortID string) (*entities.ShortURL, error) {
+func (service *fakeUserService) ListURLs(ctx context.Context, filter *shorturl.Filter, page *shorturl.Page) (*shorturl.URLPage, error) {
+	service.listFilter, service.listPage = filter, page
+	if service.custom {
+		return service.resultPage, service.resultError
+	}
+	return &shorturl.URLPage{URLs: []*entities.ShortURL{defaultTestResponse}}, nil
+}
+
+func (service *fakeUserService) UpdateURL(ctx context.Context, shortID string, owner string, metadata *entities.Metadata) (*entities.ShortURL, error) {
+	service.ctx = ctx
+	service.owner = owner
 	if service.custom {
 		return service.resultURL, service.resultError
 	}
 	return defaultTestResponse, nil
 }
 
+func (service *fakeUserService) DeleteURL(ctx context.Context, shortID string, owner string) error {
+	service.ctx = ctx
+	service.owner = owner
+	if service.custom {
+		return service.resultError
+	}
+	return shorturl.AllowWrite(ctx, 1)
+}
+
+func (service *fakeUserService) ImportURLs(ctx context.Context, records []*shorturl.ImportRecord, conflicts shorturl.ConflictMode) (*shorturl.ImportResult, error) {
+	service.imported, service.conflicts = records, conflicts
+	if service.custom {
+		return nil, service.resultError
+	}
+	result := &shorturl.ImportResult{Rejected: make([]*shorturl.ImportReject, 0)}
+	for i, record := range records {
+		if record.Err != nil {
+			result.Rejected = append(result.Rejected, &shorturl.ImportReject{Index: i, ShortID: record.ShortID, Err: record.Err})
+		} else {
+			result.Imported++
+		}
+	}
+	return result, nil
+}
+
+func (service *fakeUserService) ExportURLs(ctx context.Context, filter *shorturl.Filter) ([]*entities.ShortURL, error) {
+	service.listFilter = filter
+	if service.custom {
+		return service.resultPage.URLs, service.resultError
+	}
+	return []*entities.ShortURL{defaultTestResponse}, nil
+}
+
 func TestShortenAcceptsOnlyPOST(t *testing.T) {
 	tests := []struct {
 		method   string
@@ -73,7 +152,17 @@ func TestShortenRequestHasProperFormat(t *testing.T) {
 		expectOK    bool
 		fakeUserService
 	}{
-		{contentType: "text/plain", content: "hello!", expectOK: false},
+		{contentType: "text/plain", content: "hello!", expectOK: false,
+			fakeUserService: fakeUserService{
+				custom:      true,
+				resultError: &entities.ErrInvalidURL{},
+			}},
+		{contentType: "text/plain", content: "https://example.com\n", expectOK: true},
+		{contentType: "text/plain; charset=utf-8", content: "https://example.com", expectOK: true},
+		{contentType: "text/plain; charset=latin1", content: "https://example.com", expectOK: false},
+		{contentType: "application/json; charset=UTF-8", content: `{"url": "https://example.com"}`, expectOK: true},
+		{contentType: formType, content: "url=https%3A%2F%2Fexample.com&tags=docs", expectOK: true},
+		{contentType: formType, content: "title=Example", expectOK: false},
 		{contentType: "text/html", content: "<div>Hello!</div>", expectOK: false},
 		{contentType: "application/json", content: "{ bad json ]", expectOK: false},
 		{contentType: "application/json", content: `{"unexpected-field": "baad"}`, expectOK: false},
@@ -84,7 +173,16 @@ func TestShortenRequestHasProperFormat(t *testing.T) {
 				resultError: &entities.ErrInvalidURL{},
 			}},
 		{contentType: "application/json", content: `{"url": "https://example.com", "unexpected-field": "baad"}`, expectOK: false},
+		{contentType: "application/json", content: `{"url": "https://example.com", "title": "Example", "tags": ["docs"]}`, expectOK: true},
+		{contentType: "application/json", content: `{"url": "https://example.com", "tags": "docs"}`, expectOK: false},
+		{contentType: "application/json", content: `{"url": "https://example.com", "tags": ["not a tag"]}`, expectOK: false,
+			fakeUserService: fakeUserService{
+				custom:      true,
+				resultError: &entities.ErrInvalidTag{},
+			}},
 		{contentType: "text/plain", content: `{"url": "https://example.com"}`, expectOK: false},
+		{contentType: "application/json", content: `{"url": "https://example.com", "dedupe": "owner"}`, expectOK: true},
+		{contentType: "application/json", content: `{"url": "https://example.com", "dedupe": "sometimes"}`, expectOK: false},
 	}
 	for _, test := range tests {
 		request := httptest.NewRequest("POST", "/shorten", strings.NewReader(test.content))
@@ -192,3 +290,291 @@ func TestResolveRedirectsToURL(t *testing.T) {
 		}
 	}
 }
+
+func TestRedirectsWithLinkStatus(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	tests := []struct {
+		redirect        entities.RedirectType
+		defaultRedirect entities.RedirectType
+		status          int
+		cacheControl    string
+	}{
+		{status: http.StatusTemporaryRedirect, cacheControl: "private, no-cache"},
+		{defaultRedirect: entities.Found, status: http.StatusFound, cacheControl: "private, no-cache"},
+		{redirect: entities.MovedPermanently, defaultRedirect: entities.Found, status: http.StatusMovedPermanently, cacheControl: "public, max-age=35"},
+		{redirect: entities.PermanentRedirect, status: http.StatusPermanentRedirect, cacheControl: "public, max-age=35"},
+		{redirect: entities.TemporaryRedirect, defaultRedirect: entities.PermanentRedirect, status: http.StatusTemporaryRedirect, cacheControl: "private, no-cache"},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/id", nil)
+		w := httptest.NewRecorder()
+		testHandler := buildHandler(&fakeUserService{
+			custom:    true,
+			resultURL: &entities.ShortURL{ShortID: "id", Target: "https://example.com", Expires: expires, Redirect: test.redirect},
+		}, &Config{Origin: "https://test", DefaultRedirect: test.defaultRedirect})
+		testHandler.ServeHTTP(w, request)
+		if status := w.Result().StatusCode; status != test.status {
+			t.Fatalf("expected status %v but got %v for %+v", test.status, status, test)
+		}
+		if cacheControl := w.Header().Get("cache-control"); !strings.HasPrefix(cacheControl, test.cacheControl) {
+			t.Fatalf("expected cache-control %q but got %q for %+v", test.cacheControl, cacheControl, test)
+		}
+	}
+}
+
+func TestShowsPreviewInsteadOfRedirecting(t *testing.T) {
+	tests := []struct {
+		path         string
+		interstitial bool
+		target       string
+		preview      bool
+		warning      bool
+	}{
+		{path: "/id", target: "https://example.com", preview: false},
+		{path: "/id+", target: "https://example.com", preview: true},
+		{path: "/id?preview", target: "https://example.com", preview: true},
+		{path: "/id", interstitial: true, target: "https://example.com", preview: true, warning: true},
+		{path: "/id+", interstitial: true, target: "https://example.com", preview: true, warning: true},
+		{path: "/id", interstitial: true, target: "https://docs.internal.test", preview: false},
+		{path: "/id+", interstitial: true, target: "https://docs.internal.test", preview: true, warning: false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", test.path, nil)
+		w := httptest.NewRecorder()
+		testHandler := buildHandler(&fakeUserService{
+			custom: true,
+			resultURL: &entities.ShortURL{
+				ShortID:      "id",
+				Target:       test.target,
+				Expires:      time.Now().Add(time.Hour),
+				Interstitial: test.interstitial,
+				Metadata:     entities.Metadata{Title: "<Example>"},
+			},
+		}, &Config{Origin: "https://test", InternalDomains: []string{"*.internal.test"}})
+		testHandler.ServeHTTP(w, request)
+		response := w.Result()
+		if preview := response.StatusCode == http.StatusOK; preview != test.preview {
+			t.Fatalf("expected preview to be %v for %+v, got status %v", test.preview, test, response.StatusCode)
+		}
+		if !test.preview {
+			continue
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, `href="`+test.target+`"`) || !strings.Contains(body, "&lt;Example&gt;") {
+			t.Fatalf("expected escaped title and continue link in preview, got %v", body)
+		}
+		if warning := strings.Contains(body, "outside of the organization"); warning != test.warning {
+			t.Fatalf("expected warning to be %v for %+v", test.warning, test)
+		}
+	}
+}
+
+func TestInfoReturnsMetadata(t *testing.T) {
+	created := time.Now().UTC().Round(0)
+	stored := &entities.ShortURL{
+		Target:  "https://example.com",
+		ShortID: "id",
+		Expires: created.Add(time.Hour),
+		Created: created,
+		Metadata: entities.Metadata{
+			Title:       "Example",
+			Description: "An example",
+			Tags:        []string{"docs"},
+			Creator:     "someone",
+		},
+	}
+	request := httptest.NewRequest("GET", "/id/info", nil)
+	w := httptest.NewRecorder()
+	testHandler := buildHandler(&fakeUserService{custom: true, resultURL: stored}, &Config{Origin: "https://test"})
+	testHandler.ServeHTTP(w, request)
+	response := w.Result()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected ok status but got %v", response.StatusCode)
+	}
+	parsed := new(responseBody)
+	decoder := json.NewDecoder(response.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(parsed)
+	if err != nil {
+		t.Fatalf("Expected response to match json schema: %v", err)
+	}
+	expected := &responseBody{
+		Target:      stored.Target,
+		Shortened:   "https://test/id",
+		Expires:     stored.Expires,
+		Created:     &created,
+		Title:       stored.Title,
+		Description: stored.Description,
+		Tags:        stored.Tags,
+		Creator:     stored.Creator,
+	}
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Fatalf("Expected %+v but got %+v", expected, parsed)
+	}
+}
+
+func TestListPassesFilterAndPage(t *testing.T) {
+	cursor := &shorturl.Cursor{Created: time.Now().UTC().Round(0), ShortID: "abc"}
+	request := httptest.NewRequest("GET", fmt.Sprintf(
+		"/api/links?tag=docs&target=example&creator=me&status=expired&limit=5&cursor=%v", encodeCursor(cursor),
+	), nil)
+	w := httptest.NewRecorder()
+	service := &fakeUserService{}
+	testHandler := buildHandler(service, &Config{Origin: "https://test"})
+	testHandler.ServeHTTP(w, request)
+	if status := w.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("Unexpected status code %v", status)
+	}
+	expectedFilter := &shorturl.Filter{Tag: "docs", Target: "example", Creator: "me", Status: shorturl.ExpiredStatus}
+	if !reflect.DeepEqual(service.listFilter, expectedFilter) {
+		t.Fatalf("Expected filter %+v but got %+v", expectedFilter, service.listFilter)
+	}
+	expectedPage := &shorturl.Page{After: cursor, Limit: 5}
+	if !reflect.DeepEqual(service.listPage, expectedPage) {
+		t.Fatalf("Expected page %+v but got %+v", expectedPage, service.listPage)
+	}
+}
+
+func TestListReturnsNextCursor(t *testing.T) {
+	next := &shorturl.Cursor{Created: time.Now().UTC().Round(0), ShortID: "next"}
+	request := httptest.NewRequest("GET", "/api/links", nil)
+	w := httptest.NewRecorder()
+	testHandler := buildHandler(&fakeUserService{
+		custom:     true,
+		resultPage: &shorturl.URLPage{URLs: []*entities.ShortURL{defaultTestResponse}, Next: next},
+	}, &Config{Origin: "https://test"})
+	testHandler.ServeHTTP(w, request)
+	parsed := new(listResponseBody)
+	err := json.NewDecoder(w.Result().Body).Decode(parsed)
+	if err != nil {
+		t.Fatalf("Expected response to be json: %v", err)
+	}
+	if len(parsed.Links) != 1 || parsed.Links[0].Shortened != "https://test/1" {
+		t.Fatalf("Unexpected links %+v", parsed.Links)
+	}
+	decoded, err := decodeCursor(parsed.Next)
+	if err != nil || !reflect.DeepEqual(decoded, next) {
+		t.Fatalf("Expected cursor for %+v but got %v", next, parsed.Next)
+	}
+}
+
+func TestListRejectsBadParameters(t *testing.T) {
+	queries := []string{"status=gone", "limit=-1", "limit=many", "cursor=%21%21"}
+	for _, query := range queries {
+		request := httptest.NewRequest("GET", "/api/links?"+query, nil)
+		w := httptest.NewRecorder()
+		testHandler := buildHandler(&fakeUserService{}, &Config{Origin: "https://test"})
+		testHandler.ServeHTTP(w, request)
+		if status := w.Result().StatusCode; status != http.StatusBadRequest {
+			t.Fatalf("Expected bad request for %v but got %v", query, status)
+		}
+	}
+}
+
+func TestLinkEndpointHandlesMethods(t *testing.T) {
+	tests := []struct {
+		method      string
+		body        string
+		contentType string
+		expected    int
+		fakeUserService
+	}{
+		{method: "GET", expected: http.StatusOK},
+		{method: "PUT", body: `{"title": "New title", "tags": ["docs"]}`, expected: http.StatusOK},
+		{method: "PUT", body: `{"title": "New title"}`, contentType: "application/json; charset=utf-8", expected: http.StatusOK},
+		{method: "PUT", body: `{"title": "New title"}`, contentType: "text/plain", expected: http.StatusBadRequest},
+		{method: "PUT", body: `{"url": "https://example.com"}`, expected: http.StatusBadRequest},
+		{method: "DELETE", expected: http.StatusNoContent},
+		{method: "POST", expected: http.StatusMethodNotAllowed},
+		{method: "GET", expected: http.StatusNotFound,
+			fakeUserService: fakeUserService{custom: true, resultError: &shorturl.ErrRepoNotFound{}}},
+		{method: "PUT", body: `{"title": "Stolen"}`, expected: http.StatusForbidden,
+			fakeUserService: fakeUserService{custom: true, resultError: &shorturl.ErrNotOwner{}}},
+		{method: "DELETE", expected: http.StatusForbidden,
+			fakeUserService: fakeUserService{custom: true, resultError: &shorturl.ErrNotOwner{}}},
+		{method: "GET", expected: http.StatusForbidden,
+			fakeUserService: fakeUserService{custom: true, resultError: &shorturl.ErrURLQuarantined{}}},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, "/api/links/id", strings.NewReader(test.body))
+		if test.contentType == "" {
+			test.contentType = "application/json"
+		}
+		request.Header.Set("content-type", test.contentType)
+		request.Header.Set("x-api-key", "secret-key")
+		w := httptest.NewRecorder()
+		testHandler := buildHandler(&test.fakeUserService, &Config{Origin: "https://test", Keys: []KeyStore{testKeys}})
+		testHandler.ServeHTTP(w, request)
+		if status := w.Result().StatusCode; status != test.expected {
+			t.Fatalf("Expected status %v but got %v for %v %v", test.expected, status, test.method, test.body)
+		}
+	}
+}
+
+func TestLinksCantBeChangedWithoutKeys(t *testing.T) {
+	for _, method := range []string{"PUT", "DELETE"} {
+		service := new(fakeUserService)
+		request := httptest.NewRequest(method, "/api/links/id", strings.NewReader(`{"title": "Defaced"}`))
+		request.Header.Set("content-type", "application/json")
+		w := httptest.NewRecorder()
+		buildHandler(service, &Config{Origin: "https://test"}).ServeHTTP(w, request)
+		if status := w.Result().StatusCode; status != http.StatusForbidden {
+			t.Fatalf("Expected %v to be forbidden without keys, got %v", method, status)
+		}
+		if service.ctx != nil {
+			t.Fatalf("Expected %v not to reach the service", method)
+		}
+	}
+}
+
+func TestBoundsRequestsWithTimeouts(t *testing.T) {
+	tests := []struct {
+		method   string
+		path     string
+		read     time.Duration
+		write    time.Duration
+		expected time.Duration
+	}{
+		{method: "GET", path: "/api/links/id", read: time.Minute, write: time.Hour, expected: time.Minute},
+		{method: "DELETE", path: "/api/links/id", read: time.Minute, write: time.Hour, expected: time.Hour},
+		{method: "GET", path: "/api/links/id", read: 0, write: time.Hour, expected: 0},
+		{method: "GET", path: "/shorten?url=https%3A%2F%2Fexample.com", read: time.Minute, write: time.Hour, expected: time.Hour},
+	}
+	for _, test := range tests {
+		service := new(fakeUserService)
+		config := &Config{Origin: "https://test", Keys: []KeyStore{testKeys}, Bookmarklet: true, ReadTimeout: test.read, WriteTimeout: test.write}
+		request := httptest.NewRequest(test.method, test.path, nil)
+		request.Header.Set("x-api-key", "secret-key")
+		w := httptest.NewRecorder()
+		buildHandler(service, config).ServeHTTP(w, request)
+		deadline, ok := service.ctx.Deadline()
+		if test.expected == 0 && ok {
+			t.Fatalf("Expected no deadline for %v, got %v", test.method, deadline)
+		}
+		if test.expected != 0 && (!ok || time.Until(deadline) > test.expected || time.Until(deadline) < test.expected-time.Second) {
+			t.Fatalf("Expected a deadline in %v for %v, got %v", test.expected, test.method, deadline)
+		}
+	}
+}
+
+func TestShortenRejectsDisallowedTargets(t *testing.T) {
+	request := httptest.NewRequest("POST", "/shorten", strings.NewReader(`{"url": "http://127.0.0.1"}`))
+	request.Header.Set("content-type", "application/json")
+	w := httptest.NewRecorder()
+	testHandler := buildHandler(&fakeUserService{
+		custom:      true,
+		resultError: &shorturl.ErrTargetNotAllowed{Target: "http://127.0.0.1", Reason: "it points to a private or loopback address"},
+	}, &Config{Origin: "https://test"})
+	testHandler.ServeHTTP(w, request)
+	response := w.Result()
+	if response.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected unprocessable entity but got %v", response.StatusCode)
+	}
+	parsed := new(struct {
+		Error string `json:"error"`
+	})
+	err := json.NewDecoder(response.Body).Decode(parsed)
+	if err != nil || !strings.Contains(parsed.Error, "private or loopback") {
+		t.Fatalf("Expected error to explain the reason, got %q", parsed.Error)
+	}
+}
@@ -0,0 +1,223 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/carlos-marchal/shorty/entities"
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+const (
+	jsonType = "application/json"
+	formType = "application/x-www-form-urlencoded"
+	textType = "text/plain"
+	htmlType = "text/html"
+)
+
+// maxShortenBody limits how much of a shorten request body is read.
+const maxShortenBody = 64 << 10
+
+// negotiate picks the offered media type the client prefers according to its
+// accept header. Ties go to the earliest offer, and so do clients with no
+// preference or that accept none of the offers.
+func negotiate(accept string, offers ...string) string {
+	best, bestQuality := offers[0], 0.0
+	if strings.TrimSpace(accept) == "" {
+		return best
+	}
+	for _, offer := range offers {
+		quality, specificity := 0.0, -1
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+			if err != nil {
+				continue
+			}
+			var matches int
+			switch {
+			case mediaType == offer:
+				matches = 2
+			case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaType, "*")):
+				matches = 1
+			case mediaType == "*/*":
+				matches = 0
+			default:
+				continue
+			}
+			if matches <= specificity {
+				continue
+			}
+			specificity, quality = matches, 1
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil {
+				quality = q
+			}
+		}
+		if quality > bestQuality {
+			best, bestQuality = offer, quality
+		}
+	}
+	return best
+}
+
+// fromBrowser reports whether a request was sent by a browser, which always
+// adds some of these headers to form posts. Other clients can't be made to
+// send requests by another site, so they need no CSRF token.
+func fromBrowser(r *http.Request) bool {
+	if _, err := r.Cookie(csrfCookie); err == nil {
+		return true
+	}
+	return r.Header.Get("origin") != "" || r.Header.Get("referer") != "" || r.Header.Get("sec-fetch-site") != ""
+}
+
+// parseShortenBody reads a shorten request in any of the supported media
+// types: a JSON object, a form with the same fields, or just the URL as plain
+// text.
+func parseShortenBody(r *http.Request) (*requestBody, *errorBody, int) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("content-type"))
+	if err != nil {
+		return nil, &errorBody{Error: badShortenBody, Code: codeBadRequest}, http.StatusBadRequest
+	}
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+		return nil, &errorBody{Error: "Only the utf-8 charset is supported.", Code: codeBadRequest}, http.StatusBadRequest
+	}
+	r.Body = http.MaxBytesReader(nil, r.Body, maxShortenBody)
+	switch mediaType {
+	case jsonType:
+		parsed := new(requestBody)
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(parsed)
+		if err != nil || parsed.URL == nil || decoder.More() {
+			return nil, &errorBody{Error: badShortenBody, Code: codeBadRequest}, http.StatusBadRequest
+		}
+		return parsed, nil, 0
+	case formType:
+		if fromBrowser(r) && !validCSRF(r) {
+			return nil, &errorBody{Error: "The form expired, please submit it again.", Code: codeCSRF}, http.StatusForbidden
+		}
+		parsed, ok := parseShortenForm(r)
+		if !ok {
+			return nil, &errorBody{Error: badShortenForm, Code: codeBadRequest}, http.StatusBadRequest
+		}
+		return parsed, nil, 0
+	case textType:
+		content, err := ioutil.ReadAll(io.LimitReader(r.Body, maxShortenBody))
+		url := strings.TrimSpace(string(content))
+		if err != nil || url == "" || strings.ContainsAny(url, " \t\r\n") {
+			return nil, &errorBody{Error: "A plain text body must be a single URL.", Code: codeBadRequest}, http.StatusBadRequest
+		}
+		return &requestBody{URL: &url}, nil, 0
+	default:
+		return nil, &errorBody{Error: badShortenBody, Code: codeBadRequest}, http.StatusBadRequest
+	}
+}
+
+// shortenOptions turns the fields of a shorten request body into the options
+// of the use case, with the caller as the owner.
+func shortenOptions(parsed *requestBody, r *http.Request) (*shorturl.ShortenOptions, *errorBody) {
+	dedupe, ok := dedupeModes[parsed.Dedupe]
+	if !ok {
+		return nil, &errorBody{Error: "The dedupe field must be always, never or owner.", Code: codeBadRequest}
+	}
+	return &shorturl.ShortenOptions{
+		Owner:        ownerOf(r),
+		Metadata:     parsed.toEntity(),
+		Dedupe:       dedupe,
+		Redirect:     entities.RedirectType(parsed.Redirect),
+		Interstitial: parsed.Interstitial,
+	}, nil
+}
+
+// sendShortenError responds in the negotiated format. HTML clients get the
+// form of the web UI back, with the values they sent.
+func sendShortenError(w http.ResponseWriter, r *http.Request, config *Config, format string, body *errorBody, status int) {
+	switch format {
+	case htmlType:
+		sendFormError(w, r, config, body.Error, status)
+	case textType:
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintln(w, body.Error)
+	default:
+		sendErrorBody(w, body, status)
+	}
+}
+
+// responseTypes lists the response formats in order of preference for clients
+// with none, starting with the one matching the request body. The web UI
+// thus gets pages back, and JSON stays the default for everything else.
+func responseTypes(r *http.Request) []string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("content-type"))
+	switch {
+	case mediaType == formType, r.Method == "GET":
+		return []string{htmlType, jsonType, textType}
+	case mediaType == textType:
+		return []string{textType, jsonType, htmlType}
+	default:
+		return []string{jsonType, textType, htmlType}
+	}
+}
+
+func shortenHandler(urls shorturl.UseCase, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := negotiate(r.Header.Get("accept"), responseTypes(r)...)
+		fail := func(body *errorBody, status int) {
+			sendShortenError(w, r, config, format, body, status)
+		}
+		var parsed *requestBody
+		switch {
+		case r.Method == "POST":
+			var body *errorBody
+			var status int
+			parsed, body, status = parseShortenBody(r)
+			if body != nil {
+				fail(body, status)
+				return
+			}
+		case r.Method == "GET" && config.Bookmarklet:
+			// Any page can make browsers send a GET, so the bookmarklet
+			// has to carry an API key, which keeps it out of referers.
+			if len(config.Keys) == 0 {
+				fail(&errorBody{Error: "The bookmarklet needs an API key, and the server accepts none.", Code: codeForbidden}, http.StatusForbidden)
+				return
+			}
+			w.Header().Set("referrer-policy", "no-referrer")
+			url := r.URL.Query().Get("url")
+			if url == "" {
+				fail(&errorBody{Error: "The url query parameter is required.", Code: codeBadRequest}, http.StatusBadRequest)
+				return
+			}
+			parsed = &requestBody{URL: &url}
+		default:
+			fail(&errorBody{Error: fmt.Sprintf("Method %v not supported.", r.Method), Code: codeMethodNotAllowed}, http.StatusMethodNotAllowed)
+			return
+		}
+		options, body := shortenOptions(parsed, r)
+		if body != nil {
+			fail(body, http.StatusBadRequest)
+			return
+		}
+		url, err := urls.ShortenURL(r.Context(), *parsed.URL, options)
+		if err != nil {
+			body, status := useCaseError(err, "")
+			logServerError(r, err, status)
+			fail(body, status)
+			return
+		}
+		switch format {
+		case htmlType:
+			sendResult(w, url, config)
+		case textType:
+			w.Header().Set("content-type", "text/plain; charset=utf-8")
+			fmt.Fprintln(w, newResponseBody(url, config).Shortened)
+		default:
+			sendJSON(w, newResponseBody(url, config))
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiatesMediaType(t *testing.T) {
+	offers := []string{jsonType, textType, htmlType}
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{accept: "", expected: jsonType},
+		{accept: "*/*", expected: jsonType},
+		{accept: "text/plain", expected: textType},
+		{accept: "text/*", expected: textType},
+		{accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", expected: htmlType},
+		{accept: "application/json;q=0.5, text/plain", expected: textType},
+		{accept: "text/*;q=0.5, text/html", expected: htmlType},
+		{accept: "image/png", expected: jsonType},
+		{accept: "text/plain;q=0, */*", expected: jsonType},
+	}
+	for _, test := range tests {
+		if result := negotiate(test.accept, offers...); result != test.expected {
+			t.Fatalf("Expected %v for %q but got %v", test.expected, test.accept, result)
+		}
+	}
+}
+
+func TestShortenResponseFollowsAccept(t *testing.T) {
+	shortened := "https://test/" + defaultTestResponse.ShortID
+	tests := []struct {
+		contentType string
+		content     string
+		accept      string
+		mediaType   string
+		contains    string
+	}{
+		{contentType: jsonType, content: `{"url": "https://example.com"}`, accept: "", mediaType: jsonType, contains: `"shortened"`},
+		{contentType: jsonType, content: `{"url": "https://example.com"}`, accept: "text/plain", mediaType: textType, contains: shortened + "\n"},
+		{contentType: textType, content: "https://example.com", accept: "", mediaType: textType, contains: shortened + "\n"},
+		{contentType: textType, content: "https://example.com", accept: "application/json", mediaType: jsonType, contains: `"shortened"`},
+		{contentType: textType, content: "https://example.com", accept: "text/html", mediaType: htmlType, contains: `value="` + shortened + `"`},
+		{contentType: formType, content: "url=https%3A%2F%2Fexample.com", accept: "", mediaType: htmlType, contains: `value="` + shortened + `"`},
+		{contentType: formType, content: "url=https%3A%2F%2Fexample.com", accept: "application/json", mediaType: jsonType, contains: `"shortened"`},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/shorten", strings.NewReader(test.content))
+		request.Header.Set("content-type", test.contentType)
+		request.Header.Set("accept", test.accept)
+		w := httptest.NewRecorder()
+		buildHandler(&fakeUserService{}, &Config{Origin: "https://test"}).ServeHTTP(w, request)
+		if status := w.Result().StatusCode; status != http.StatusOK {
+			t.Fatalf("Expected ok but got %v for %+v", status, test)
+		}
+		if contentType := w.Header().Get("content-type"); !strings.HasPrefix(contentType, test.mediaType) {
+			t.Fatalf("Expected %v but got %v for %+v", test.mediaType, contentType, test)
+		}
+		if !strings.Contains(w.Body.String(), test.contains) {
+			t.Fatalf("Expected body to contain %q, got %v", test.contains, w.Body.String())
+		}
+	}
+}
+
+func TestShortensFromBookmarklet(t *testing.T) {
+	tests := []struct {
+		bookmarklet bool
+		keys        []KeyStore
+		path        string
+		expected    int
+	}{
+		{bookmarklet: false, keys: []KeyStore{testKeys}, path: "/shorten?url=https%3A%2F%2Fexample.com&api_key=secret-key", expected: http.StatusMethodNotAllowed},
+		{bookmarklet: true, keys: []KeyStore{testKeys}, path: "/shorten?url=https%3A%2F%2Fexample.com&api_key=secret-key", expected: http.StatusOK},
+		{bookmarklet: true, keys: []KeyStore{testKeys}, path: "/shorten?api_key=secret-key", expected: http.StatusBadRequest},
+		{bookmarklet: true, keys: []KeyStore{testKeys}, path: "/shorten?url=https%3A%2F%2Fexample.com", expected: http.StatusUnauthorized},
+		{bookmarklet: true, keys: []KeyStore{testKeys}, path: "/shorten?url=https%3A%2F%2Fexample.com&api_key=wrong-key", expected: http.StatusUnauthorized},
+		{bookmarklet: true, path: "/shorten?url=https%3A%2F%2Fexample.com", expected: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", test.path, nil)
+		w := httptest.NewRecorder()
+		buildHandler(&fakeUserService{}, &Config{Origin: "https://test", Keys: test.keys, Bookmarklet: test.bookmarklet}).ServeHTTP(w, request)
+		if status := w.Result().StatusCode; status != test.expected {
+			t.Fatalf("Expected status %v but got %v for %+v", test.expected, status, test)
+		}
+	}
+}
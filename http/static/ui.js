@@ -0,0 +1,83 @@
+// Progressive enhancements for the web UI. Every page works without them,
+// except for the link list, which is loaded from the links API.
+"use strict";
+
+document.querySelectorAll("[data-copy]").forEach((button) => {
+  const input = document.getElementById(button.dataset.copy);
+  button.hidden = !navigator.clipboard;
+  button.addEventListener("click", async () => {
+    await navigator.clipboard.writeText(input.value);
+    button.textContent = "Copied";
+  });
+});
+
+const filters = document.getElementById("filters");
+if (filters) {
+  const table = document.getElementById("links");
+  const rows = table.querySelector("tbody");
+  const next = document.getElementById("next");
+  const error = document.getElementById("list-error");
+  const key = filters.elements.namedItem("api_key");
+  if (key) {
+    key.value = sessionStorage.getItem("shorty-api-key") || "";
+  }
+  let cursor = "";
+
+  const cell = (row, content) => {
+    const td = row.insertCell();
+    if (content instanceof Node) {
+      td.appendChild(content);
+    } else {
+      td.textContent = content;
+    }
+  };
+
+  const load = async (reset) => {
+    const params = new URLSearchParams();
+    for (const name of ["tag", "target", "status"]) {
+      const value = filters.elements.namedItem(name).value;
+      if (value) {
+        params.set(name, value);
+      }
+    }
+    if (!reset && cursor) {
+      params.set("cursor", cursor);
+    }
+    const headers = { accept: "application/json" };
+    if (key && key.value) {
+      sessionStorage.setItem("shorty-api-key", key.value);
+      headers["x-api-key"] = key.value;
+    }
+    const response = await fetch("/api/links?" + params, { headers });
+    const body = await response.json();
+    error.hidden = response.ok;
+    if (!response.ok) {
+      error.textContent = body.error;
+      return;
+    }
+    if (reset) {
+      rows.replaceChildren();
+    }
+    for (const link of body.links) {
+      const row = rows.insertRow();
+      const anchor = document.createElement("a");
+      anchor.href = link.shortened;
+      anchor.textContent = link.shortened;
+      cell(row, anchor);
+      cell(row, link.target);
+      cell(row, link.title || "");
+      cell(row, (link.tags || []).join(", "));
+      cell(row, new Date(link.expires).toLocaleString());
+    }
+    table.hidden = false;
+    cursor = body.next || "";
+    next.hidden = !cursor;
+  };
+
+  filters.addEventListener("submit", (event) => {
+    event.preventDefault();
+    load(true);
+  });
+  next.addEventListener("click", () => load(false));
+  load(true);
+}
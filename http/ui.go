@@ -0,0 +1,152 @@
+package http
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/carlos-marchal/shorty/entities"
+	"github.com/carlos-marchal/shorty/logging"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+const (
+	csrfCookie = "shorty_csrf"
+	csrfField  = "csrf_token"
+)
+
+type indexPage struct {
+	CSRFToken   string
+	NeedsKey    bool
+	Error       string
+	URL         string
+	Title       string
+	Description string
+	Tags        string
+}
+
+type resultPage struct {
+	Target    string
+	Shortened string
+	Expires   time.Time
+}
+
+type linksPage struct {
+	NeedsKey bool
+}
+
+func staticHandler() http.Handler {
+	static, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/ui/static/", http.FileServer(http.FS(static)))
+}
+
+func sendHTML(w http.ResponseWriter, name string, data interface{}, status int) {
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.Header().Set("cache-control", "private, no-cache")
+	w.WriteHeader(status)
+	err := templates.ExecuteTemplate(w, name, data)
+	if err != nil {
+		logging.Default().Error("Could not render the page", "template", name, "error", err)
+	}
+}
+
+// csrfToken returns the CSRF token of the browser, issuing a new one in a
+// cookie if it has none. Forms must send it back in the csrf_token field.
+func csrfToken(w http.ResponseWriter, r *http.Request, config *Config) string {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && len(cookie.Value) == 64 {
+		return cookie.Value
+	}
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		panic(err)
+	}
+	value := hex.EncodeToString(token)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.Origin, "https:"),
+		SameSite: http.SameSiteStrictMode,
+	})
+	return value
+}
+
+// validCSRF checks that a form carries the same token as the cookie, which
+// other sites can neither read nor set.
+func validCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.PostFormValue(csrfField))) == 1
+}
+
+// parseShortenForm reads the same fields as the JSON body from a form, with
+// tags separated by commas.
+func parseShortenForm(r *http.Request) (*requestBody, bool) {
+	url := strings.TrimSpace(r.PostFormValue("url"))
+	parsed := &requestBody{
+		URL:          &url,
+		Dedupe:       r.PostFormValue("dedupe"),
+		Interstitial: r.PostFormValue("interstitial") != "",
+		metadataBody: metadataBody{
+			Title:       r.PostFormValue("title"),
+			Description: r.PostFormValue("description"),
+			Creator:     r.PostFormValue("creator"),
+			Tags:        splitTags(r.PostFormValue("tags")),
+		},
+	}
+	if redirect := r.PostFormValue("redirect"); redirect != "" {
+		value, err := strconv.Atoi(redirect)
+		if err != nil {
+			return nil, false
+		}
+		parsed.Redirect = value
+	}
+	return parsed, url != ""
+}
+
+func splitTags(value string) []string {
+	tags := make([]string, 0)
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// sendFormError renders the shorten form again with the values the user sent,
+// so that they can fix them.
+func sendFormError(w http.ResponseWriter, r *http.Request, config *Config, message string, status int) {
+	sendHTML(w, "index.html", &indexPage{
+		CSRFToken:   csrfToken(w, r, config),
+		NeedsKey:    len(config.Keys) > 0,
+		Error:       message,
+		URL:         r.PostFormValue("url"),
+		Title:       r.PostFormValue("title"),
+		Description: r.PostFormValue("description"),
+		Tags:        r.PostFormValue("tags"),
+	}, status)
+}
+
+func sendResult(w http.ResponseWriter, url *entities.ShortURL, config *Config) {
+	sendHTML(w, "result.html", &resultPage{
+		Target:    url.Target,
+		Shortened: newResponseBody(url, config).Shortened,
+		Expires:   url.Expires,
+	}, http.StatusOK)
+}
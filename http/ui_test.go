@@ -0,0 +1,85 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestUIIssuesCSRFToken(t *testing.T) {
+	request := httptest.NewRequest("GET", "/ui/", nil)
+	w := httptest.NewRecorder()
+	buildHandler(&fakeUserService{}, &Config{Origin: "https://test"}).ServeHTTP(w, request)
+	response := w.Result()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected ok but got %v", response.StatusCode)
+	}
+	cookies := response.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookie || !cookies[0].HttpOnly || !cookies[0].Secure {
+		t.Fatalf("Expected a secure http only CSRF cookie, got %v", cookies)
+	}
+	if !strings.Contains(w.Body.String(), `value="`+cookies[0].Value+`"`) {
+		t.Fatalf("Expected the form to carry the CSRF token")
+	}
+}
+
+func TestShortenFormChecksCSRFToken(t *testing.T) {
+	tests := []struct {
+		origin   string
+		cookie   string
+		field    string
+		expected int
+	}{
+		{origin: "https://test", cookie: "", field: "", expected: http.StatusForbidden},
+		{origin: "https://evil", cookie: "", field: "", expected: http.StatusForbidden},
+		{origin: "", cookie: "token", field: "", expected: http.StatusForbidden},
+		{origin: "https://test", cookie: "token", field: "other", expected: http.StatusForbidden},
+		{origin: "https://test", cookie: "token", field: "token", expected: http.StatusOK},
+		{origin: "", cookie: "", field: "", expected: http.StatusOK},
+	}
+	for _, test := range tests {
+		form := url.Values{"url": {"https://example.com"}, csrfField: {test.field}}
+		request := httptest.NewRequest("POST", "/shorten", strings.NewReader(form.Encode()))
+		request.Header.Set("content-type", formType)
+		if test.origin != "" {
+			request.Header.Set("origin", test.origin)
+		}
+		if test.cookie != "" {
+			request.AddCookie(&http.Cookie{Name: csrfCookie, Value: test.cookie})
+		}
+		w := httptest.NewRecorder()
+		buildHandler(&fakeUserService{}, &Config{Origin: "https://test"}).ServeHTTP(w, request)
+		if status := w.Result().StatusCode; status != test.expected {
+			t.Fatalf("Expected status %v but got %v for %+v", test.expected, status, test)
+		}
+		if contentType := w.Header().Get("content-type"); !strings.HasPrefix(contentType, "text/html") {
+			t.Fatalf("Expected an HTML page but got %v", contentType)
+		}
+	}
+}
+
+func TestShortenFormShowsResult(t *testing.T) {
+	form := url.Values{"url": {"https://example.com"}, "tags": {"docs, team-a"}, csrfField: {"token"}}
+	request := httptest.NewRequest("POST", "/shorten", strings.NewReader(form.Encode()))
+	request.Header.Set("content-type", formType)
+	request.AddCookie(&http.Cookie{Name: csrfCookie, Value: "token"})
+	w := httptest.NewRecorder()
+	service := &fakeUserService{}
+	buildHandler(service, &Config{Origin: "https://test"}).ServeHTTP(w, request)
+	if !strings.Contains(w.Body.String(), `value="https://test/`+defaultTestResponse.ShortID+`"`) {
+		t.Fatalf("Expected the shortened URL in the result page, got %v", w.Body.String())
+	}
+}
+
+func TestServesStaticFiles(t *testing.T) {
+	for _, path := range []string{"/ui/static/ui.js", "/ui/static/style.css", "/ui/links"} {
+		request := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		buildHandler(&fakeUserService{}, &Config{Origin: "https://test"}).ServeHTTP(w, request)
+		if status := w.Result().StatusCode; status != http.StatusOK {
+			t.Fatalf("Expected ok for %v but got %v", path, status)
+		}
+	}
+}
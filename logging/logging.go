@@ -0,0 +1,152 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = map[Level]string{
+	Debug: "debug",
+	Info:  "info",
+	Warn:  "warn",
+	Error: "error",
+}
+
+func (level Level) String() string {
+	return levelNames[level]
+}
+
+// ParseLevel reads one of debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if name == levelName {
+			return level, nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q, must be debug, info, warn or error", name)
+}
+
+// Logger writes one JSON object per line, with the time, level and message
+// followed by its fields. Fields are given as alternating keys and values,
+// and errors are written as their message.
+type Logger struct {
+	out    io.Writer
+	mutex  *sync.Mutex
+	level  Level
+	fields []interface{}
+}
+
+func New(out io.Writer, level Level) *Logger {
+	return &Logger{out: out, mutex: new(sync.Mutex), level: level}
+}
+
+// With returns a logger that adds the given fields to every line.
+func (logger *Logger) With(fields ...interface{}) *Logger {
+	with := *logger
+	with.fields = append(logger.fields[:len(logger.fields):len(logger.fields)], fields...)
+	return &with
+}
+
+func (logger *Logger) Debug(message string, fields ...interface{}) {
+	logger.log(Debug, message, fields)
+}
+
+func (logger *Logger) Info(message string, fields ...interface{}) {
+	logger.log(Info, message, fields)
+}
+
+func (logger *Logger) Warn(message string, fields ...interface{}) {
+	logger.log(Warn, message, fields)
+}
+
+func (logger *Logger) Error(message string, fields ...interface{}) {
+	logger.log(Error, message, fields)
+}
+
+func (logger *Logger) log(level Level, message string, fields []interface{}) {
+	if level < logger.level {
+		return
+	}
+	var line bytes.Buffer
+	line.WriteString(`{"time":`)
+	writeValue(&line, time.Now().UTC().Format(time.RFC3339Nano))
+	line.WriteString(`,"level":`)
+	writeValue(&line, level.String())
+	line.WriteString(`,"msg":`)
+	writeValue(&line, message)
+	all := append(logger.fields[:len(logger.fields):len(logger.fields)], fields...)
+	for i := 0; i < len(all); i += 2 {
+		line.WriteByte(',')
+		writeValue(&line, fmt.Sprint(all[i]))
+		line.WriteByte(':')
+		if i+1 < len(all) {
+			writeValue(&line, all[i+1])
+		} else {
+			line.WriteString("null")
+		}
+	}
+	line.WriteString("}\n")
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	logger.out.Write(line.Bytes())
+}
+
+func writeValue(line *bytes.Buffer, value interface{}) {
+	switch typed := value.(type) {
+	case error:
+		value = typed.Error()
+	case fmt.Stringer:
+		value = typed.String()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	line.Write(encoded)
+}
+
+var defaultLogger = New(os.Stderr, Info)
+
+// Default is the logger used when a context carries none.
+func Default() *Logger {
+	return defaultLogger
+}
+
+// SetDefault replaces the default logger. It must be called before logging
+// starts.
+func SetDefault(logger *Logger) {
+	defaultLogger = logger
+}
+
+type contextKey int
+
+const loggerContextKey contextKey = iota
+
+// NewContext returns a context carrying logger, so that everything done on
+// behalf of a request logs with its fields.
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, logger)
+}
+
+// FromContext returns the logger of ctx, or the default one.
+func FromContext(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(loggerContextKey).(*Logger); ok {
+		return logger
+	}
+	return defaultLogger
+}
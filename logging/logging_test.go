@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWritesJSONLines(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, Info).With("request_id", "abc")
+	logger.Debug("hidden")
+	logger.Warn("push failed", "error", errors.New("non-fast-forward"), "attempt", 2)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one line above the level, got %v", lines)
+	}
+	line := make(map[string]interface{})
+	err := json.Unmarshal([]byte(lines[0]), &line)
+	if err != nil {
+		t.Fatalf("expected JSON, got %v: %v", lines[0], err)
+	}
+	expected := map[string]interface{}{"level": "warn", "msg": "push failed", "request_id": "abc", "error": "non-fast-forward", "attempt": 2.0}
+	for key, value := range expected {
+		if line[key] != value {
+			t.Fatalf("expected %v to be %v, got %v", key, value, line[key])
+		}
+	}
+}
+
+func TestCarriesLoggerInContext(t *testing.T) {
+	if FromContext(context.Background()) != Default() {
+		t.Fatalf("expected default logger without one in the context")
+	}
+	logger := New(new(bytes.Buffer), Debug)
+	if FromContext(NewContext(context.Background(), logger)) != logger {
+		t.Fatalf("expected logger from the context")
+	}
+}
+
+func TestParsesLevels(t *testing.T) {
+	for _, name := range []string{"debug", "info", "warn", "error"} {
+		level, err := ParseLevel(name)
+		if err != nil || level.String() != name {
+			t.Fatalf("expected level %v, got %v and %v", name, level, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatalf("expected unknown level to fail")
+	}
+}
@@ -1,59 +1,150 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"fmt"
 	"os"
-	"strconv"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/carlos-marchal/shorty/blocklist"
 	"github.com/carlos-marchal/shorty/git"
 	"github.com/carlos-marchal/shorty/http"
+	"github.com/carlos-marchal/shorty/logging"
+	"github.com/carlos-marchal/shorty/metrics"
 	"github.com/carlos-marchal/shorty/usecases/shorturl"
 )
 
-var defaultEnv = map[string]string{
-	"REPO_URL":         "",
-	"REPO_PRIVATE_KEY": "",
-	"URL_FILE_PATH":    "urls.json",
-	"COMMIT_NAME":      "Shorty Bot",
-	"COMMIT_EMAIL":     "shorty.bot@carlos.marchal.page",
-	"PORT":             "8080",
-	"ORIGIN":           "http://localhost:8080",
+// version is set when building releases, with -ldflags "-X main.version=...".
+var version string
+
+// app holds what the commands need, built from the configuration. The
+// repository and service are only set for commands that use them.
+type app struct {
+	config     *config
+	repository *git.Repository
+	service    *shorturl.Service
+	// shutdownDeadline is when the server has to be done shutting down, set
+	// once it starts to. Closing the repository uses what is left until then.
+	shutdownDeadline time.Time
 }
 
 func main() {
-	env := make(map[string]string)
-	for key, defaultValue := range defaultEnv {
-		var value string
-		if passedValue := os.Getenv(key); passedValue != "" {
-			value = passedValue
-		} else if defaultValue != "" {
-			value = defaultValue
-		} else {
-			log.Fatalf("You need to provide an env value for %v\n", key)
+	flags := configFlags()
+	flags.Usage = func() { printUsage(flags.Output(), flags) }
+	err := flags.Parse(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+	name, args := "serve", []string{}
+	if flags.NArg() > 0 {
+		name, args = flags.Arg(0), flags.Args()[1:]
+	}
+	if name == "help" {
+		printUsage(os.Stdout, flags)
+		return
+	}
+	command, ok := commands[name]
+	if !ok {
+		printUsage(os.Stderr, flags)
+		os.Exit(2)
+	}
+	config, err := loadConfig(flags, os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger := logging.New(os.Stderr, config.logLevel)
+	logging.SetDefault(logger)
+	app := &app{config: config}
+	if !command.offline {
+		err = app.open()
+		if err != nil {
+			logger.Error("Could not start", "error", err)
+			os.Exit(1)
 		}
-		env[key] = value
-	}
-	repository, err := git.NewRepository(&git.Config{
-		RepoURL:     env["REPO_URL"],
-		PrivateKey:  env["REPO_PRIVATE_KEY"],
-		URLFilePath: env["URL_FILE_PATH"],
-		CommitName:  env["COMMIT_NAME"],
-		CommitEmail: env["COMMIT_EMAIL"],
-	})
+	}
+	err = command.run(app, args)
+	if app.repository != nil {
+		ctx, cancel := app.closeContext()
+		closeErr := app.repository.Close(ctx)
+		cancel()
+		if closeErr != nil {
+			logger.Error("Could not close the repository", "error", closeErr)
+		}
+	}
 	if err != nil {
-		log.Fatalf("Error initializing repository: %v", err)
+		logger.Error("Command failed", "command", name, "error", err)
+		os.Exit(1)
 	}
-	service, err := shorturl.NewService(repository)
+}
+
+// open connects to the repository and builds the service on top of it.
+func (app *app) open() error {
+	registry := metrics.NewRegistry()
+	app.config.repository.Metrics = registry
+	app.config.server.Metrics = registry
+	repository, err := git.NewRepository(context.Background(), &app.config.repository)
 	if err != nil {
-		log.Fatalf("Error initializing use case handler: %v", err)
+		return fmt.Errorf("initializing repository: %v", err)
+	}
+	if len(app.config.blocklist.Sources) > 0 {
+		app.config.policy.Blocklist, err = blocklist.NewList(&app.config.blocklist)
+		if err != nil {
+			return fmt.Errorf("loading blocklists: %v", err)
+		}
 	}
-	port, err := strconv.ParseUint(env["PORT"], 10, 16)
+	service, err := shorturl.NewService(repository, &app.config.service)
 	if err != nil {
-		log.Fatalf("Error parsing port number: %v", env["PORT"])
+		return fmt.Errorf("initializing use case handler: %v", err)
+	}
+	app.repository, app.service = repository, service
+	return nil
+}
+
+// closeContext bounds closing the repository by what is left of the shutdown
+// timeout, or by the whole of it if the command wasn't a server shutting down.
+func (app *app) closeContext() (context.Context, context.CancelFunc) {
+	if app.shutdownDeadline.IsZero() {
+		return context.WithTimeout(context.Background(), app.config.shutdownTimeout)
+	}
+	return context.WithDeadline(context.Background(), app.shutdownDeadline)
+}
+
+// serve runs the HTTP server until it fails or an interrupt or termination
+// signal arrives, in which case the requests in progress are given some time
+// to finish.
+func serve(app *app, args []string) error {
+	server := app.config.server
+	server.Keys = make([]http.KeyStore, 0)
+	if app.config.apiKeys != nil {
+		server.Keys = append(server.Keys, app.config.apiKeys)
+	}
+	if app.config.repository.KeysFilePath != "" {
+		server.Keys = append(server.Keys, app.repository)
+	}
+	server.Health = app.repository
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	httpServer := http.NewServer(app.service, &server)
+	failed := make(chan error, 1)
+	go func() {
+		failed <- httpServer.ListenAndServe()
+	}()
+	select {
+	case err := <-failed:
+		return err
+	case received := <-stop:
+		logging.Default().Info("Shutting down", "signal", received)
 	}
-	err = http.Start(service, &http.Config{
-		Port:   uint(port),
-		Origin: env["ORIGIN"],
-	})
-	log.Fatalf("Error initializing use case handler: %v", err)
+	app.shutdownDeadline = time.Now().Add(app.config.shutdownTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), app.shutdownDeadline)
+	defer cancel()
+	return httpServer.Shutdown(ctx)
 }
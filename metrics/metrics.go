@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets are the upper bounds, in seconds, of the duration histograms.
+var Buckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type kind string
+
+const (
+	counter   kind = "counter"
+	gauge     kind = "gauge"
+	histogram kind = "histogram"
+)
+
+// family is a metric with all its label combinations.
+type family struct {
+	name   string
+	help   string
+	kind   kind
+	labels []string
+	series map[string]*series
+}
+
+// series is the value of a metric for one combination of labels. Histograms
+// count each observation in the first bucket that holds it, and are made
+// cumulative when exported.
+type series struct {
+	labels []string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Registry holds the metrics of the HTTP server and the git repository, and
+// exports them in the Prometheus text format.
+type Registry struct {
+	mutex            sync.Mutex
+	families         []*family
+	requests         *family
+	requestDurations *family
+	resolves         *family
+	gitDurations     *family
+	gitFailures      *family
+	pushConflicts    *family
+	activeLinks      *family
+}
+
+func NewRegistry() *Registry {
+	registry := new(Registry)
+	registry.requests = registry.add("shorty_http_requests_total", "HTTP requests by route and status.", counter, "route", "status")
+	registry.requestDurations = registry.add("shorty_http_request_duration_seconds", "Duration of HTTP requests by route and status.", histogram, "route", "status")
+	registry.resolves = registry.add("shorty_resolves_total", "Resolved IDs by outcome, hit, miss, expired or quarantined.", counter, "outcome")
+	registry.gitDurations = registry.add("shorty_git_operation_duration_seconds", "Duration of git operations.", histogram, "operation")
+	registry.gitFailures = registry.add("shorty_git_operation_failures_total", "Failed git operations.", counter, "operation")
+	registry.pushConflicts = registry.add("shorty_git_push_conflicts_total", "Pushes rejected because the remote changed in the meantime.", counter)
+	registry.activeLinks = registry.add("shorty_active_links", "Links that haven't expired.", gauge)
+	return registry
+}
+
+func (registry *Registry) add(name string, help string, kind kind, labels ...string) *family {
+	family := &family{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+	if len(labels) == 0 {
+		family.get()
+	}
+	registry.families = append(registry.families, family)
+	return family
+}
+
+// get returns the series with the given label values, creating it if needed.
+func (family *family) get(values ...string) *series {
+	key := strings.Join(values, "\xff")
+	found, ok := family.series[key]
+	if !ok {
+		found = &series{labels: values}
+		if family.kind == histogram {
+			found.counts = make([]uint64, len(Buckets))
+		}
+		family.series[key] = found
+	}
+	return found
+}
+
+func (series *series) observe(value float64) {
+	for i, bound := range Buckets {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+func (registry *Registry) ObserveRequest(route string, status int, duration time.Duration) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	code := strconv.Itoa(status)
+	registry.requests.get(route, code).value++
+	registry.requestDurations.get(route, code).observe(duration.Seconds())
+}
+
+func (registry *Registry) CountResolve(outcome string) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.resolves.get(outcome).value++
+}
+
+func (registry *Registry) ObserveOperation(operation string, duration time.Duration, failed bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.gitDurations.get(operation).observe(duration.Seconds())
+	if failed {
+		registry.gitFailures.get(operation).value++
+	}
+}
+
+func (registry *Registry) CountPushConflict() {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.pushConflicts.get().value++
+}
+
+func (registry *Registry) SetActiveLinks(count int) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.activeLinks.get().value = float64(count)
+}
+
+// Export writes every metric in the Prometheus text format, with the series
+// of each metric sorted by their labels.
+func (registry *Registry) Export(w io.Writer) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	var out strings.Builder
+	for _, family := range registry.families {
+		fmt.Fprintf(&out, "# HELP %v %v\n# TYPE %v %v\n", family.name, family.help, family.name, family.kind)
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			series := family.series[key]
+			labels := formatLabels(family.labels, series.labels)
+			if family.kind != histogram {
+				fmt.Fprintf(&out, "%v%v %v\n", family.name, labels, formatValue(series.value))
+				continue
+			}
+			names := append(family.labels[:len(family.labels):len(family.labels)], "le")
+			values := append(series.labels[:len(series.labels):len(series.labels)], "")
+			var cumulative uint64
+			for i, bound := range Buckets {
+				cumulative += series.counts[i]
+				values[len(values)-1] = formatValue(bound)
+				fmt.Fprintf(&out, "%v_bucket%v %v\n", family.name, formatLabels(names, values), cumulative)
+			}
+			values[len(values)-1] = "+Inf"
+			le := formatLabels(names, values)
+			fmt.Fprintf(&out, "%v_bucket%v %v\n", family.name, le, series.count)
+			fmt.Fprintf(&out, "%v_sum%v %v\n", family.name, labels, formatValue(series.sum))
+			fmt.Fprintf(&out, "%v_count%v %v\n", family.name, labels, series.count)
+		}
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%v="%v"`, name, labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
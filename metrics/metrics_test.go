@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportsPrometheusText(t *testing.T) {
+	registry := NewRegistry()
+	registry.ObserveRequest("/", 307, 20*time.Millisecond)
+	registry.ObserveRequest("/", 307, 2*time.Second)
+	registry.CountResolve("hit")
+	registry.ObserveOperation("push", 300*time.Millisecond, true)
+	registry.CountPushConflict()
+	registry.SetActiveLinks(42)
+	var out strings.Builder
+	err := registry.Export(&out)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, line := range []string{
+		"# TYPE shorty_http_requests_total counter",
+		`shorty_http_requests_total{route="/",status="307"} 2`,
+		`shorty_http_request_duration_seconds_bucket{route="/",status="307",le="0.025"} 1`,
+		`shorty_http_request_duration_seconds_bucket{route="/",status="307",le="2.5"} 2`,
+		`shorty_http_request_duration_seconds_bucket{route="/",status="307",le="+Inf"} 2`,
+		`shorty_http_request_duration_seconds_sum{route="/",status="307"} 2.02`,
+		`shorty_http_request_duration_seconds_count{route="/",status="307"} 2`,
+		`shorty_resolves_total{outcome="hit"} 1`,
+		`shorty_git_operation_failures_total{operation="push"} 1`,
+		"shorty_git_push_conflicts_total 1",
+		"# TYPE shorty_active_links gauge",
+		"shorty_active_links 42",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Fatalf("expected line %q in\n%v", line, out.String())
+		}
+	}
+}
+
+func TestEscapesLabelValues(t *testing.T) {
+	registry := NewRegistry()
+	registry.CountResolve("say \"hi\"\n")
+	var out strings.Builder
+	registry.Export(&out)
+	if !strings.Contains(out.String(), `shorty_resolves_total{outcome="say \"hi\"\n"} 1`) {
+		t.Fatalf("expected escaped label in\n%v", out.String())
+	}
+}
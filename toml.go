@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// tomlParser reads the part of TOML that config files need: top level keys
+// set to strings, integers, floats, booleans or arrays of them. Tables, dates
+// and dotted keys are rejected, as no setting takes them.
+type tomlParser struct {
+	content string
+	pos     int
+}
+
+// parseTOML returns the values of a TOML document by key, as strings, int64,
+// float64, bool or []interface{} values.
+func parseTOML(content []byte) (map[string]interface{}, error) {
+	parser := &tomlParser{content: string(content)}
+	values := make(map[string]interface{})
+	for {
+		parser.skipBlank()
+		if parser.done() {
+			return values, nil
+		}
+		if parser.peek() == '[' {
+			return nil, parser.errorf("tables are not supported, every setting is top level")
+		}
+		key, err := parser.key()
+		if err != nil {
+			return nil, err
+		}
+		parser.skipSpaces()
+		if !parser.consume("=") {
+			return nil, parser.errorf("expected = after %v", key)
+		}
+		parser.skipSpaces()
+		value, err := parser.value()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := values[key]; ok {
+			return nil, parser.errorf("%v is set more than once", key)
+		}
+		values[key] = value
+		parser.skipSpaces()
+		parser.skipComment()
+		if !parser.done() && !parser.consume("\n") && !parser.consume("\r\n") {
+			return nil, parser.errorf("expected a new line after the value of %v", key)
+		}
+	}
+}
+
+func (parser *tomlParser) errorf(format string, args ...interface{}) error {
+	line := strings.Count(parser.content[:parser.pos], "\n") + 1
+	return fmt.Errorf("line %v: %v", line, fmt.Sprintf(format, args...))
+}
+
+func (parser *tomlParser) done() bool {
+	return parser.pos >= len(parser.content)
+}
+
+func (parser *tomlParser) peek() byte {
+	if parser.done() {
+		return 0
+	}
+	return parser.content[parser.pos]
+}
+
+// consume skips prefix if the rest of the content starts with it.
+func (parser *tomlParser) consume(prefix string) bool {
+	if !strings.HasPrefix(parser.content[parser.pos:], prefix) {
+		return false
+	}
+	parser.pos += len(prefix)
+	return true
+}
+
+func (parser *tomlParser) skipSpaces() {
+	for parser.peek() == ' ' || parser.peek() == '\t' {
+		parser.pos++
+	}
+}
+
+func (parser *tomlParser) skipComment() {
+	if parser.peek() != '#' {
+		return
+	}
+	for !parser.done() && parser.peek() != '\n' {
+		parser.pos++
+	}
+}
+
+// skipBlank skips whitespace, new lines and comments.
+func (parser *tomlParser) skipBlank() {
+	for {
+		parser.skipSpaces()
+		parser.skipComment()
+		if !parser.consume("\n") && !parser.consume("\r\n") {
+			return
+		}
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (parser *tomlParser) key() (string, error) {
+	switch parser.peek() {
+	case '"':
+		return parser.basicString()
+	case '\'':
+		return parser.literalString()
+	}
+	start := parser.pos
+	for isBareKeyChar(parser.peek()) {
+		parser.pos++
+	}
+	if parser.pos == start {
+		return "", parser.errorf("expected a key")
+	}
+	return parser.content[start:parser.pos], nil
+}
+
+func (parser *tomlParser) value() (interface{}, error) {
+	switch {
+	case strings.HasPrefix(parser.content[parser.pos:], `"""`):
+		return parser.multilineBasicString()
+	case strings.HasPrefix(parser.content[parser.pos:], "'''"):
+		return parser.multilineLiteralString()
+	case parser.peek() == '"':
+		return parser.basicString()
+	case parser.peek() == '\'':
+		return parser.literalString()
+	case parser.peek() == '[':
+		return parser.array()
+	case parser.peek() == '{':
+		return nil, parser.errorf("inline tables are not supported")
+	}
+	start := parser.pos
+	for isBareKeyChar(parser.peek()) || parser.peek() == '+' || parser.peek() == '.' || parser.peek() == ':' {
+		parser.pos++
+	}
+	token := parser.content[start:parser.pos]
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "":
+		return nil, parser.errorf("expected a value")
+	}
+	return parser.number(token)
+}
+
+// number parses integers, in decimal, hex, octal or binary, and floats, which
+// may all be split with underscores.
+func (parser *tomlParser) number(token string) (interface{}, error) {
+	digits := strings.ReplaceAll(token, "_", "")
+	unsigned := strings.TrimLeft(digits, "+-")
+	if strings.HasPrefix(unsigned, "0x") || strings.HasPrefix(unsigned, "0o") || strings.HasPrefix(unsigned, "0b") {
+		if unsigned != digits {
+			return nil, parser.errorf("%v can't have a sign", token)
+		}
+		integer, err := strconv.ParseInt(digits, 0, 64)
+		if err != nil {
+			return nil, parser.errorf("invalid integer %v", token)
+		}
+		return integer, nil
+	}
+	if len(unsigned) > 1 && unsigned[0] == '0' && unsigned[1] != '.' && unsigned[1] != 'e' && unsigned[1] != 'E' {
+		return nil, parser.errorf("%v can't have leading zeros", token)
+	}
+	if integer, err := strconv.ParseInt(digits, 10, 64); err == nil {
+		return integer, nil
+	}
+	float, err := strconv.ParseFloat(digits, 64)
+	if err != nil {
+		return nil, parser.errorf("unsupported value %v, strings must be quoted", token)
+	}
+	return float, nil
+}
+
+func (parser *tomlParser) array() ([]interface{}, error) {
+	parser.pos++
+	items := make([]interface{}, 0)
+	for {
+		parser.skipBlank()
+		if parser.consume("]") {
+			return items, nil
+		}
+		item, err := parser.value()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		parser.skipBlank()
+		if parser.consume("]") {
+			return items, nil
+		}
+		if !parser.consume(",") {
+			return nil, parser.errorf("expected , or ] in array")
+		}
+	}
+}
+
+func (parser *tomlParser) literalString() (string, error) {
+	parser.pos++
+	end := strings.IndexAny(parser.content[parser.pos:], "'\n")
+	if end < 0 || parser.content[parser.pos+end] != '\'' {
+		return "", parser.errorf("unterminated string")
+	}
+	value := parser.content[parser.pos : parser.pos+end]
+	parser.pos += end + 1
+	return value, nil
+}
+
+func (parser *tomlParser) multilineLiteralString() (string, error) {
+	parser.pos += len("'''")
+	parser.consume("\n")
+	parser.consume("\r\n")
+	end := strings.Index(parser.content[parser.pos:], "'''")
+	if end < 0 {
+		return "", parser.errorf("unterminated string")
+	}
+	value := parser.content[parser.pos : parser.pos+end]
+	parser.pos += end + len("'''")
+	return value, nil
+}
+
+func (parser *tomlParser) basicString() (string, error) {
+	parser.pos++
+	var value strings.Builder
+	for {
+		switch c := parser.peek(); {
+		case parser.done(), c == '\n':
+			return "", parser.errorf("unterminated string")
+		case c == '"':
+			parser.pos++
+			return value.String(), nil
+		case c == '\\':
+			err := parser.escape(&value)
+			if err != nil {
+				return "", err
+			}
+		default:
+			value.WriteByte(c)
+			parser.pos++
+		}
+	}
+}
+
+func (parser *tomlParser) multilineBasicString() (string, error) {
+	parser.pos += len(`"""`)
+	parser.consume("\n")
+	parser.consume("\r\n")
+	var value strings.Builder
+	for {
+		switch c := parser.peek(); {
+		case parser.done():
+			return "", parser.errorf("unterminated string")
+		case parser.consume(`"""`):
+			return value.String(), nil
+		case c == '\\':
+			// A backslash at the end of a line trims the line break and
+			// the whitespace after it.
+			rest := strings.TrimLeft(parser.content[parser.pos+1:], " \t")
+			if strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n") {
+				parser.pos = len(parser.content) - len(strings.TrimLeft(rest, " \t\r\n"))
+				continue
+			}
+			err := parser.escape(&value)
+			if err != nil {
+				return "", err
+			}
+		default:
+			value.WriteByte(c)
+			parser.pos++
+		}
+	}
+}
+
+var tomlEscapes = map[byte]string{
+	'b':  "\b",
+	't':  "\t",
+	'n':  "\n",
+	'f':  "\f",
+	'r':  "\r",
+	'"':  "\"",
+	'\\': "\\",
+}
+
+// escape writes the character escaped at the current backslash to value.
+func (parser *tomlParser) escape(value *strings.Builder) error {
+	parser.pos++
+	c := parser.peek()
+	if escaped, ok := tomlEscapes[c]; ok {
+		value.WriteString(escaped)
+		parser.pos++
+		return nil
+	}
+	length := map[byte]int{'u': 4, 'U': 8}[c]
+	if length == 0 || parser.pos+1+length > len(parser.content) {
+		return parser.errorf("invalid escape sequence")
+	}
+	code, err := strconv.ParseUint(parser.content[parser.pos+1:parser.pos+1+length], 16, 32)
+	if err != nil || !utf8.ValidRune(rune(code)) {
+		return parser.errorf("invalid escape sequence")
+	}
+	value.WriteRune(rune(code))
+	parser.pos += 1 + length
+	return nil
+}
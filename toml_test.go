@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsesTOML(t *testing.T) {
+	tests := []struct {
+		content  string
+		expected map[string]interface{}
+	}{
+		{content: "", expected: map[string]interface{}{}},
+		{content: "a = 'C:\\\\path' # comment\r\nb = \"tab\\there \\u00e9\"\n", expected: map[string]interface{}{"a": `C:\\path`, "b": "tab\there é"}},
+		{content: "\"quoted key\" = 1_000\nhex = 0xff\nneg = -5\nfloat = 2.5e3\n", expected: map[string]interface{}{"quoted key": int64(1000), "hex": int64(255), "neg": int64(-5), "float": 2500.0}},
+		{content: "s = \"\"\"\\\n    joined \\\n    line\"\"\"\nl = '''\nraw \\n'''\n", expected: map[string]interface{}{"s": "joined line", "l": "raw \\n"}},
+		{content: "empty = []\nnested = [[1, 2], [\"a\"]]\nflag = false", expected: map[string]interface{}{"empty": []interface{}{}, "nested": []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{"a"}}, "flag": false}},
+	}
+	for _, test := range tests {
+		parsed, err := parseTOML([]byte(test.content))
+		if err != nil {
+			t.Fatalf("unexpected error %v parsing %q", err, test.content)
+		}
+		if !reflect.DeepEqual(parsed, test.expected) {
+			t.Fatalf("expected %#v parsing %q, got %#v", test.expected, test.content, parsed)
+		}
+	}
+}
+
+func TestRejectsUnsupportedTOML(t *testing.T) {
+	for _, content := range []string{
+		"[server]\nport = 9000\n",
+		"server.port = 9000\n",
+		"port = 9000 9001\n",
+		"port = 09000\n",
+		"origin = https://sho.rt\n",
+		"started = 1979-05-27\n",
+		"name = \"unterminated\n",
+		"name = 'a'\nname = 'b'\n",
+		"limits = { rate = 1 }\n",
+		"list = [1 2]\n",
+		"escape = \"\\x41\"\n",
+	} {
+		_, err := parseTOML([]byte(content))
+		if err == nil {
+			t.Fatalf("expected an error parsing %q", content)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Package transfer reads and writes the files used to import and export links.
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/carlos-marchal/shorty/entities"
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+// Format is the syntax of an import or export file. Every format holds the
+// same fields, named as in columns.
+type Format int
+
+const (
+	// JSON holds an array of objects.
+	JSON Format = iota
+	// CSV holds a header row naming the columns, then a row per link. Tags
+	// are separated by spaces.
+	CSV
+	// NDJSON holds an object per line.
+	NDJSON
+)
+
+// Formats maps the names of the formats to their values.
+var Formats = map[string]Format{
+	"json":   JSON,
+	"csv":    CSV,
+	"ndjson": NDJSON,
+}
+
+// columns are the fields of a record. Only id and target are required.
+var columns = []string{"id", "target", "expires", "created", "owner", "redirect", "interstitial", "title", "description", "tags", "creator"}
+
+// maxLine limits the length of a line of an NDJSON file.
+const maxLine = 1 << 20
+
+type record struct {
+	ID           string     `json:"id"`
+	Target       string     `json:"target"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	Created      *time.Time `json:"created,omitempty"`
+	Owner        string     `json:"owner,omitempty"`
+	Redirect     int        `json:"redirect,omitempty"`
+	Interstitial bool       `json:"interstitial,omitempty"`
+	Title        string     `json:"title,omitempty"`
+	Description  string     `json:"description,omitempty"`
+	Tags         []string   `json:"tags,omitempty"`
+	Creator      string     `json:"creator,omitempty"`
+}
+
+// ErrInvalidRecord is set on the records that couldn't be read.
+type ErrInvalidRecord struct {
+	Reason string
+}
+
+func (err *ErrInvalidRecord) Error() string {
+	return fmt.Sprintf("invalid record: %v", err.Reason)
+}
+
+// ErrInvalidFile is returned when a file can't be read at all.
+type ErrInvalidFile struct {
+	Reason string
+}
+
+func (err *ErrInvalidFile) Error() string {
+	return fmt.Sprintf("invalid file: %v", err.Reason)
+}
+
+func newRecord(url *entities.ShortURL) *record {
+	created := url.Created
+	expires := url.Expires
+	return &record{
+		ID:           url.ShortID,
+		Target:       url.Target,
+		Expires:      &expires,
+		Created:      &created,
+		Owner:        url.Owner,
+		Redirect:     int(url.Redirect),
+		Interstitial: url.Interstitial,
+		Title:        url.Title,
+		Description:  url.Description,
+		Tags:         url.Tags,
+		Creator:      url.Creator,
+	}
+}
+
+func (record *record) toImport() *shorturl.ImportRecord {
+	imported := &shorturl.ImportRecord{
+		ShortID:      record.ID,
+		Target:       record.Target,
+		Owner:        record.Owner,
+		Redirect:     entities.RedirectType(record.Redirect),
+		Interstitial: record.Interstitial,
+		Metadata: entities.Metadata{
+			Title:       record.Title,
+			Description: record.Description,
+			Tags:        record.Tags,
+			Creator:     record.Creator,
+		},
+	}
+	if record.Expires != nil {
+		imported.Expires = *record.Expires
+	}
+	if record.Created != nil {
+		imported.Created = *record.Created
+	}
+	return imported
+}
+
+// Decode reads the records of a file. Records that can't be read are returned
+// with Err set, so that they are rejected along with the invalid ones. An
+// error is only returned when the file as a whole can't be read.
+func Decode(r io.Reader, format Format) ([]*shorturl.ImportRecord, error) {
+	switch format {
+	case JSON:
+		return decodeJSON(r)
+	case CSV:
+		return decodeCSV(r)
+	case NDJSON:
+		return decodeNDJSON(r)
+	default:
+		return nil, fmt.Errorf("unknown format %v", format)
+	}
+}
+
+func decodeRecord(raw []byte) *shorturl.ImportRecord {
+	parsed := new(record)
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(parsed)
+	if err != nil {
+		return &shorturl.ImportRecord{ShortID: parsed.ID, Err: &ErrInvalidRecord{err.Error()}}
+	}
+	return parsed.toImport()
+}
+
+func decodeJSON(r io.Reader) ([]*shorturl.ImportRecord, error) {
+	var raw []json.RawMessage
+	err := json.NewDecoder(r).Decode(&raw)
+	if err != nil {
+		return nil, &ErrInvalidFile{err.Error()}
+	}
+	records := make([]*shorturl.ImportRecord, len(raw))
+	for i, item := range raw {
+		records[i] = decodeRecord(item)
+	}
+	return records, nil
+}
+
+func decodeNDJSON(r io.Reader) ([]*shorturl.ImportRecord, error) {
+	records := make([]*shorturl.ImportRecord, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLine)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) > 0 {
+			records = append(records, decodeRecord(line))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &ErrInvalidFile{err.Error()}
+	}
+	return records, nil
+}
+
+func decodeCSV(r io.Reader) ([]*shorturl.ImportRecord, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, &ErrInvalidFile{fmt.Sprintf("reading header: %v", err)}
+	}
+	known := make(map[string]bool)
+	for _, column := range columns {
+		known[column] = true
+	}
+	index := make(map[string]int)
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if !known[column] {
+			return nil, &ErrInvalidFile{fmt.Sprintf("unknown column %q", column)}
+		}
+		index[column] = i
+	}
+	for _, required := range []string{"id", "target"} {
+		if _, ok := index[required]; !ok {
+			return nil, &ErrInvalidFile{fmt.Sprintf("missing column %q", required)}
+		}
+	}
+	records := make([]*shorturl.ImportRecord, 0)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil && !errors.Is(err, csv.ErrFieldCount) {
+			return nil, &ErrInvalidFile{err.Error()}
+		}
+		field := func(column string) string {
+			if i, ok := index[column]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		if err != nil {
+			records = append(records, &shorturl.ImportRecord{ShortID: field("id"), Err: &ErrInvalidRecord{err.Error()}})
+			continue
+		}
+		parsed, err := parseRow(field)
+		if err != nil {
+			records = append(records, &shorturl.ImportRecord{ShortID: field("id"), Err: err})
+			continue
+		}
+		records = append(records, parsed.toImport())
+	}
+}
+
+// parseRow reads a CSV row through field, which returns the value of a column
+// or an empty string if the file doesn't have it.
+func parseRow(field func(column string) string) (*record, error) {
+	parsed := &record{
+		ID:          field("id"),
+		Target:      field("target"),
+		Owner:       field("owner"),
+		Title:       field("title"),
+		Description: field("description"),
+		Tags:        strings.Fields(field("tags")),
+		Creator:     field("creator"),
+	}
+	for column, value := range map[string]**time.Time{"expires": &parsed.Expires, "created": &parsed.Created} {
+		if field(column) == "" {
+			continue
+		}
+		parsedTime, err := time.Parse(time.RFC3339, field(column))
+		if err != nil {
+			return nil, &ErrInvalidRecord{fmt.Sprintf("%v is not an RFC 3339 time", column)}
+		}
+		*value = &parsedTime
+	}
+	if redirect := field("redirect"); redirect != "" {
+		value, err := strconv.Atoi(redirect)
+		if err != nil {
+			return nil, &ErrInvalidRecord{"redirect is not a number"}
+		}
+		parsed.Redirect = value
+	}
+	if interstitial := field("interstitial"); interstitial != "" {
+		value, err := strconv.ParseBool(interstitial)
+		if err != nil {
+			return nil, &ErrInvalidRecord{"interstitial is not a boolean"}
+		}
+		parsed.Interstitial = value
+	}
+	return parsed, nil
+}
+
+// Encode writes urls in the given format, preserving everything needed to
+// import them back.
+func Encode(w io.Writer, urls []*entities.ShortURL, format Format) error {
+	switch format {
+	case JSON:
+		records := make([]*record, len(urls))
+		for i, url := range urls {
+			records[i] = newRecord(url)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	case NDJSON:
+		encoder := json.NewEncoder(w)
+		for _, url := range urls {
+			err := encoder.Encode(newRecord(url))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case CSV:
+		return encodeCSV(w, urls)
+	default:
+		return fmt.Errorf("unknown format %v", format)
+	}
+}
+
+func encodeCSV(w io.Writer, urls []*entities.ShortURL) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write(columns)
+	if err != nil {
+		return err
+	}
+	for _, url := range urls {
+		redirect := ""
+		if url.Redirect != entities.DefaultRedirect {
+			redirect = strconv.Itoa(int(url.Redirect))
+		}
+		err = writer.Write([]string{
+			url.ShortID,
+			url.Target,
+			url.Expires.Format(time.RFC3339Nano),
+			url.Created.Format(time.RFC3339Nano),
+			url.Owner,
+			redirect,
+			strconv.FormatBool(url.Interstitial),
+			url.Title,
+			url.Description,
+			strings.Join(url.Tags, " "),
+			url.Creator,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
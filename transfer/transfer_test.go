@@ -0,0 +1,117 @@
+package transfer
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carlos-marchal/shorty/entities"
+	"github.com/carlos-marchal/shorty/usecases/shorturl"
+)
+
+func TestRoundTripsEveryFormat(t *testing.T) {
+	created := time.Date(2021, 3, 12, 17, 6, 35, 120000000, time.UTC)
+	urls := []*entities.ShortURL{
+		{
+			Target:       "https://example.com/a",
+			ShortID:      "GA",
+			Created:      created,
+			Expires:      created.Add(7 * 24 * time.Hour),
+			Owner:        "team",
+			Redirect:     entities.PermanentRedirect,
+			Interstitial: true,
+			Metadata: entities.Metadata{
+				Title:       "Example, with a comma",
+				Description: "Multiple\nlines",
+				Tags:        []string{"docs", "team-a"},
+				Creator:     "someone",
+			},
+		},
+		{Target: "https://example.com/b", ShortID: "GE", Created: created, Expires: created.Add(time.Hour)},
+	}
+	expected := []*shorturl.ImportRecord{
+		{
+			ShortID:      "GA",
+			Target:       "https://example.com/a",
+			Created:      created,
+			Expires:      created.Add(7 * 24 * time.Hour),
+			Owner:        "team",
+			Redirect:     entities.PermanentRedirect,
+			Interstitial: true,
+			Metadata:     urls[0].Metadata,
+		},
+		{ShortID: "GE", Target: "https://example.com/b", Created: created, Expires: created.Add(time.Hour)},
+	}
+	for name, format := range Formats {
+		var file bytes.Buffer
+		err := Encode(&file, urls, format)
+		if err != nil {
+			t.Fatalf("unexpected error encoding %v: %v", name, err)
+		}
+		records, err := Decode(&file, format)
+		if err != nil {
+			t.Fatalf("unexpected error decoding %v: %v", name, err)
+		}
+		if len(records) != len(expected) {
+			t.Fatalf("expected %v records in %v, got %v", len(expected), name, len(records))
+		}
+		for i, record := range records {
+			if len(record.Metadata.Tags) == 0 {
+				record.Metadata.Tags = nil
+			}
+			if !record.Created.Equal(expected[i].Created) || !record.Expires.Equal(expected[i].Expires) {
+				t.Fatalf("expected times to be kept in %v, got %+v", name, record)
+			}
+			record.Created, record.Expires = expected[i].Created, expected[i].Expires
+			if !reflect.DeepEqual(record, expected[i]) {
+				t.Fatalf("expected %+v in %v, got %+v", expected[i], name, record)
+			}
+		}
+	}
+}
+
+func TestRejectsUnreadableRecords(t *testing.T) {
+	tests := []struct {
+		format  Format
+		content string
+		valid   []bool
+	}{
+		{format: JSON, content: `[{"id": "GA", "target": "https://example.com"}, {"id": "GE", "tags": "docs"}, {"id": "GI", "unknown": 1}]`, valid: []bool{true, false, false}},
+		{format: NDJSON, content: "{\"id\": \"GA\", \"target\": \"https://example.com\"}\n\n{ bad json ]\n", valid: []bool{true, false}},
+		{format: CSV, content: "id,target,expires,redirect\nGA,https://example.com,,\nGE,https://example.com,yesterday,\nGI,https://example.com,,moved\nGM,https://example.com\n", valid: []bool{true, false, false, false}},
+	}
+	for _, test := range tests {
+		records, err := Decode(strings.NewReader(test.content), test.format)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(records) != len(test.valid) {
+			t.Fatalf("expected %v records, got %v", len(test.valid), len(records))
+		}
+		for i, record := range records {
+			if _, invalid := record.Err.(*ErrInvalidRecord); invalid == test.valid[i] {
+				t.Fatalf("expected record %v valid to be %v, got error %v", i, test.valid[i], record.Err)
+			}
+		}
+	}
+}
+
+func TestRejectsUnreadableFiles(t *testing.T) {
+	tests := []struct {
+		format  Format
+		content string
+	}{
+		{format: JSON, content: `{"id": "GA"}`},
+		{format: CSV, content: "id,url\nGA,https://example.com\n"},
+		{format: CSV, content: "id,title\nGA,example\n"},
+		{format: CSV, content: ""},
+	}
+	for _, test := range tests {
+		_, err := Decode(strings.NewReader(test.content), test.format)
+		if _, ok := err.(*ErrInvalidFile); !ok {
+			t.Fatalf("expected invalid file error for %q, got %v", test.content, err)
+		}
+	}
+}
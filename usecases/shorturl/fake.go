@@ -1,34 +1,32 @@
 package shorturl
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/carlos-marchal/shorty/entities"
 )
 
 type fakeRepository struct {
 	byID  map[string]*entities.ShortURL
-	byURL map[string]*entities.ShortURL
+	byURL map[string][]*entities.ShortURL
 	n     uint
 }
 
 func newfakeRepository() *fakeRepository {
 	return &fakeRepository{
 		byID:  make(map[string]*entities.ShortURL),
-		byURL: make(map[string]*entities.ShortURL),
+		byURL: make(map[string][]*entities.ShortURL),
 		n:     0,
 	}
 }
 
-func (repository *fakeRepository) GetByURL(target string) (*entities.ShortURL, error) {
-	url := repository.byURL[target]
-	if url == nil {
-		return nil, &ErrRepoNotFound{target}
-	}
-	return url, nil
+func (repository *fakeRepository) GetByURL(ctx context.Context, canonical string) ([]*entities.ShortURL, error) {
+	return repository.byURL[canonical], nil
 }
 
-func (repository *fakeRepository) GetByID(shortID string) (*entities.ShortURL, error) {
+func (repository *fakeRepository) GetByID(ctx context.Context, shortID string) (*entities.ShortURL, error) {
 	url := repository.byID[shortID]
 	if url == nil {
 		return nil, &ErrRepoNotFound{shortID}
@@ -36,13 +34,74 @@ func (repository *fakeRepository) GetByID(shortID string) (*entities.ShortURL, e
 	return url, nil
 }
 
-func (repository *fakeRepository) SaveURL(url *entities.ShortURL) error {
+func (repository *fakeRepository) SaveURL(ctx context.Context, url *entities.ShortURL) error {
+	if previous := repository.byID[url.ShortID]; previous != nil {
+		repository.unindexURL(previous)
+	}
 	repository.byID[url.ShortID] = url
-	repository.byURL[url.Target] = url
+	repository.byURL[url.Canonical] = append(repository.byURL[url.Canonical], url)
+	return nil
+}
+
+func (repository *fakeRepository) SaveNewURLs(ctx context.Context, urls []*entities.ShortURL) error {
+	for _, url := range urls {
+		url.ShortID, _ = repository.GenerateShortID(ctx)
+		repository.SaveURL(ctx, url)
+	}
 	return nil
 }
 
-func (repository *fakeRepository) GenerateShortID() (string, error) {
+func (repository *fakeRepository) SaveURLs(ctx context.Context, urls []*entities.ShortURL) error {
+	for _, url := range urls {
+		repository.SaveURL(ctx, url)
+	}
+	return nil
+}
+
+func (repository *fakeRepository) unindexURL(url *entities.ShortURL) {
+	indexed := make([]*entities.ShortURL, 0)
+	for _, stored := range repository.byURL[url.Canonical] {
+		if stored.ShortID != url.ShortID {
+			indexed = append(indexed, stored)
+		}
+	}
+	repository.byURL[url.Canonical] = indexed
+}
+
+func (repository *fakeRepository) DeleteURL(ctx context.Context, shortID string) error {
+	url := repository.byID[shortID]
+	if url == nil {
+		return &ErrRepoNotFound{shortID}
+	}
+	delete(repository.byID, shortID)
+	repository.unindexURL(url)
+	return nil
+}
+
+func (repository *fakeRepository) DeleteURLs(ctx context.Context, shortIDs []string) error {
+	for _, shortID := range shortIDs {
+		repository.DeleteURL(ctx, shortID)
+	}
+	return nil
+}
+
+func (repository *fakeRepository) GenerateShortID(ctx context.Context) (string, error) {
 	repository.n++
 	return fmt.Sprintf("%x", repository.n), nil
 }
+
+func (repository *fakeRepository) ListURLs(ctx context.Context, filter *Filter, page *Page) (*URLPage, error) {
+	urls := make([]*entities.ShortURL, 0, len(repository.byID))
+	for _, url := range repository.byID {
+		urls = append(urls, url)
+	}
+	return Paginate(urls, filter, page, time.Now()), nil
+}
+
+// fakeBlocklist blocks the targets it holds, mapped to the rule blocking them.
+type fakeBlocklist map[string]string
+
+func (blocklist fakeBlocklist) Match(target string) (string, bool) {
+	rule, ok := blocklist[target]
+	return rule, ok
+}
@@ -0,0 +1,40 @@
+package shorturl
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// WriteGate is asked right before a use case writes to the repository, with
+// the number of commits it is about to make, and returns an error if they may
+// not go ahead, such as when writes are rate limited. Use cases that end up
+// writing nothing never ask it.
+type WriteGate func(commits int) error
+
+type writeGateKey struct{}
+
+// WithWriteGate returns a copy of ctx whose writes are checked by gate.
+func WithWriteGate(ctx context.Context, gate WriteGate) context.Context {
+	return context.WithValue(ctx, writeGateKey{}, gate)
+}
+
+// AllowWrite asks the write gate of ctx, if any, whether a write of the given
+// number of commits may go ahead. Use cases call it right before writing.
+func AllowWrite(ctx context.Context, commits int) error {
+	gate, ok := ctx.Value(writeGateKey{}).(WriteGate)
+	if !ok {
+		return nil
+	}
+	return gate(commits)
+}
+
+// ErrWriteLimited means that a write was refused because too many were made
+// recently. Wait is how long until the next one may go ahead.
+type ErrWriteLimited struct {
+	Wait time.Duration
+}
+
+func (err *ErrWriteLimited) Error() string {
+	return fmt.Sprintf("too many writes, next one allowed in %v", err.Wait)
+}
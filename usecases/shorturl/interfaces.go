@@ -1,6 +1,7 @@
 package shorturl
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -8,10 +9,55 @@ import (
 )
 
 type Repository interface {
-	GetByURL(shortID string) (*entities.ShortURL, error)
-	GetByID(shortID string) (*entities.ShortURL, error)
-	GenerateShortID() (string, error)
-	SaveURL(url *entities.ShortURL) error
+	// GetByURL returns every URL with the given canonical target, or none.
+	GetByURL(ctx context.Context, canonical string) ([]*entities.ShortURL, error)
+	GetByID(ctx context.Context, shortID string) (*entities.ShortURL, error)
+	GenerateShortID(ctx context.Context) (string, error)
+	// SaveURL stores url, replacing the stored URL with the same ID if any.
+	SaveURL(ctx context.Context, url *entities.ShortURL) error
+	// SaveNewURLs gives each URL a newly generated ID, overwriting its ShortID,
+	// and stores them all in a single write. Either all or none are saved.
+	SaveNewURLs(ctx context.Context, urls []*entities.ShortURL) error
+	// SaveURLs stores urls as they are in a single write, replacing the
+	// stored URLs with the same IDs.
+	SaveURLs(ctx context.Context, urls []*entities.ShortURL) error
+	DeleteURL(ctx context.Context, shortID string) error
+	// DeleteURLs removes the URLs with the given IDs in a single write. IDs
+	// that aren't stored are ignored.
+	DeleteURLs(ctx context.Context, shortIDs []string) error
+	ListURLs(ctx context.Context, filter *Filter, page *Page) (*URLPage, error)
+}
+
+// HealthReporter is implemented by repositories that can describe the state
+// of their backend, for health checks. It is optional.
+type HealthReporter interface {
+	// Health describes the backend as of the last operation, without
+	// contacting it.
+	Health() *Health
+	// Sync contacts the backend to bring the state up to date.
+	Sync(ctx context.Context) error
+}
+
+// Health describes the backend of a repository.
+type Health struct {
+	Backend string
+	// Online is whether the backend was reachable on the last attempt.
+	Online        bool
+	LastFetch     time.Time
+	LastPush      time.Time
+	PendingWrites int
+	// Head identifies the stored version, such as a commit hash.
+	Head   string
+	Links  int
+	Serial uint
+}
+
+// LastSync is the last time the backend was reached successfully.
+func (health *Health) LastSync() time.Time {
+	if health.LastPush.After(health.LastFetch) {
+		return health.LastPush
+	}
+	return health.LastFetch
 }
 
 type ErrRepoNotFound struct {
@@ -22,15 +68,92 @@ func (err *ErrRepoNotFound) Error() string {
 	return fmt.Sprintf("identifier %v not found in repo", err.ID)
 }
 
-type ErrRepoInternal struct{}
+// ErrRepoInternal is a failure of the repository itself, such as an
+// unreachable remote. Err is the cause, which is logged but never shown to
+// clients.
+type ErrRepoInternal struct {
+	Err error
+}
 
 func (err *ErrRepoInternal) Error() string {
-	return "internal repo error"
+	if err.Err == nil {
+		return "internal repo error"
+	}
+	return fmt.Sprintf("internal repo error: %v", err.Err)
+}
+
+func (err *ErrRepoInternal) Unwrap() error {
+	return err.Err
+}
+
+// ErrRepoTimeout means that the repository didn't finish in time, or that
+// whoever asked stopped waiting. Err tells what it was doing.
+type ErrRepoTimeout struct {
+	Err error
+}
+
+func (err *ErrRepoTimeout) Error() string {
+	return fmt.Sprintf("repo timed out: %v", err.Err)
+}
+
+func (err *ErrRepoTimeout) Unwrap() error {
+	return err.Err
+}
+
+// DedupeMode decides whether shortening a target that was already shortened
+// reuses the existing URL. Expired and quarantined URLs are never reused.
+type DedupeMode int
+
+const (
+	// DefaultDedupe uses the mode configured for the service.
+	DefaultDedupe DedupeMode = iota
+	AlwaysReuse
+	NeverReuse
+	// ReuseOwn only reuses URLs with the same owner, so that each owner gets
+	// their own link and stats for a target.
+	ReuseOwn
+)
+
+// ShortenOptions are the optional settings of a new short URL.
+type ShortenOptions struct {
+	Owner    string
+	Metadata *entities.Metadata
+	Dedupe   DedupeMode
+	Redirect entities.RedirectType
+	// Interstitial sets the same field of the new URL.
+	Interstitial bool
+}
+
+// ShortenRequest is one of the targets to shorten in a batch.
+type ShortenRequest struct {
+	Target  string
+	Options *ShortenOptions
+}
+
+// ShortenResult is the outcome of a request of a batch. Either URL or Err is
+// set.
+type ShortenResult struct {
+	URL *entities.ShortURL
+	Err error
 }
 
 type UseCase interface {
-	ShortenURL(target string) (*entities.ShortURL, error)
-	ResolveURL(shortID string) (*entities.ShortURL, error)
+	ShortenURL(ctx context.Context, target string, options *ShortenOptions) (*entities.ShortURL, error)
+	ShortenURLs(ctx context.Context, requests []*ShortenRequest) ([]*ShortenResult, error)
+	ResolveURL(ctx context.Context, shortID string) (*entities.ShortURL, error)
+	ListURLs(ctx context.Context, filter *Filter, page *Page) (*URLPage, error)
+	UpdateURL(ctx context.Context, shortID string, owner string, metadata *entities.Metadata) (*entities.ShortURL, error)
+	DeleteURL(ctx context.Context, shortID string, owner string) error
+	ImportURLs(ctx context.Context, records []*ImportRecord, conflicts ConflictMode) (*ImportResult, error)
+	ExportURLs(ctx context.Context, filter *Filter) ([]*entities.ShortURL, error)
+}
+
+type ErrNotOwner struct {
+	ID string
+}
+
+func (err *ErrNotOwner) Error() string {
+	return fmt.Sprintf("url %v belongs to somebody else", err.ID)
 }
 
 type ErrURLExpired struct {
@@ -41,3 +164,12 @@ type ErrURLExpired struct {
 func (err *ErrURLExpired) Error() string {
 	return fmt.Sprintf("url %v expired on %v", err.URL, err.Time)
 }
+
+type ErrURLQuarantined struct {
+	URL    string
+	Reason string
+}
+
+func (err *ErrURLQuarantined) Error() string {
+	return fmt.Sprintf("url %v is quarantined: %v", err.URL, err.Reason)
+}
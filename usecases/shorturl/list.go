@@ -0,0 +1,115 @@
+package shorturl
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/carlos-marchal/shorty/entities"
+)
+
+// Status selects URLs depending on whether they have expired.
+type Status int
+
+const (
+	AnyStatus Status = iota
+	ActiveStatus
+	ExpiredStatus
+)
+
+// Filter restricts which URLs are listed. Zero valued fields match any URL.
+type Filter struct {
+	Tag     string
+	Target  string
+	Creator string
+	Status  Status
+}
+
+// Matches reports whether url passes the filter at the given time. The target
+// is matched as a case insensitive substring, the rest must match exactly.
+func (filter *Filter) Matches(url *entities.ShortURL, now time.Time) bool {
+	if filter.Target != "" && !strings.Contains(strings.ToLower(url.Target), strings.ToLower(filter.Target)) {
+		return false
+	}
+	if filter.Creator != "" && url.Creator != filter.Creator {
+		return false
+	}
+	if filter.Tag != "" && !hasTag(url, strings.ToLower(filter.Tag)) {
+		return false
+	}
+	expired := url.Expires.Before(now)
+	switch filter.Status {
+	case ActiveStatus:
+		return !expired
+	case ExpiredStatus:
+		return expired
+	default:
+		return true
+	}
+}
+
+func hasTag(url *entities.ShortURL, tag string) bool {
+	for _, candidate := range url.Tags {
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Cursor is a position in the listing order, which is newest first with ties
+// broken by short ID. It stays valid when URLs are added or removed.
+type Cursor struct {
+	Created time.Time
+	ShortID string
+}
+
+func cursorOf(url *entities.ShortURL) *Cursor {
+	return &Cursor{url.Created, url.ShortID}
+}
+
+// precedes reports whether the cursor position comes before url.
+func (cursor *Cursor) precedes(url *entities.ShortURL) bool {
+	if !cursor.Created.Equal(url.Created) {
+		return cursor.Created.After(url.Created)
+	}
+	return cursor.ShortID < url.ShortID
+}
+
+// Page selects up to Limit URLs placed after the cursor, or from the start if
+// After is nil. Repositories return every URL when Limit is zero.
+type Page struct {
+	After *Cursor
+	Limit int
+}
+
+// URLPage is a page of listed URLs. Next is nil when there are no more.
+type URLPage struct {
+	URLs []*entities.ShortURL
+	Next *Cursor
+}
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// Paginate filters, sorts and slices the given URLs. It is meant for
+// repositories that keep every URL in memory.
+func Paginate(urls []*entities.ShortURL, filter *Filter, page *Page, now time.Time) *URLPage {
+	matching := make([]*entities.ShortURL, 0)
+	for _, url := range urls {
+		if filter.Matches(url, now) && (page.After == nil || page.After.precedes(url)) {
+			matching = append(matching, url)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return cursorOf(matching[i]).precedes(matching[j])
+	})
+	result := &URLPage{URLs: matching}
+	if page.Limit > 0 && len(matching) > page.Limit {
+		result.URLs = matching[:page.Limit]
+		result.Next = cursorOf(result.URLs[page.Limit-1])
+	}
+	return result
+}
@@ -0,0 +1,104 @@
+package shorturl
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/carlos-marchal/shorty/entities"
+)
+
+// Problem is something wrong with a stored URL, found by VerifyURLs.
+type Problem struct {
+	ShortID string
+	Err     error
+}
+
+// ErrStaleCanonical means that the stored canonical target of a URL is not
+// the one the current options give, so the URL isn't reused when it should.
+type ErrStaleCanonical struct {
+	Stored   string
+	Expected string
+}
+
+func (err *ErrStaleCanonical) Error() string {
+	return fmt.Sprintf("canonical target is %v but should be %v", err.Stored, err.Expected)
+}
+
+// RemoveURL deletes a URL whatever its owner, for administrators.
+func (service *Service) RemoveURL(ctx context.Context, shortID string) error {
+	return service.repository.DeleteURL(ctx, shortID)
+}
+
+// DeleteExpiredURLs removes every expired URL in a single write, and returns
+// how many there were.
+func (service *Service) DeleteExpiredURLs(ctx context.Context) (int, error) {
+	expired, err := service.repository.ListURLs(ctx, &Filter{Status: ExpiredStatus}, new(Page))
+	if err != nil {
+		return 0, err
+	}
+	if len(expired.URLs) == 0 {
+		return 0, nil
+	}
+	ids := make([]string, len(expired.URLs))
+	for i, url := range expired.URLs {
+		ids[i] = url.ShortID
+	}
+	err = service.repository.DeleteURLs(ctx, ids)
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// VerifyURLs checks every stored URL as if it was created now, and reports
+// the ones that would be rejected, the expired ones and the ones with a stale
+// canonical target. Quarantined URLs are not checked against the policy, as
+// they are already disabled.
+func (service *Service) VerifyURLs(ctx context.Context) ([]*Problem, error) {
+	stored, err := service.repository.ListURLs(ctx, new(Filter), new(Page))
+	if err != nil {
+		return nil, err
+	}
+	problems := make([]*Problem, 0)
+	now := time.Now()
+	for _, url := range stored.URLs {
+		err := service.verifyURL(url, now)
+		if err != nil {
+			problems = append(problems, &Problem{url.ShortID, err})
+		}
+	}
+	return problems, nil
+}
+
+func (service *Service) verifyURL(url *entities.ShortURL, now time.Time) error {
+	if url.Quarantined == "" {
+		err := service.policy.check(url.Target)
+		if err != nil {
+			return err
+		}
+	}
+	canonical, err := entities.CanonicalURL(url.Target, &service.config.Canonical)
+	if err != nil {
+		return err
+	}
+	check, err := entities.NewShortURL(url.Target, url.ShortID)
+	if err != nil {
+		return err
+	}
+	err = check.SetRedirect(url.Redirect)
+	if err != nil {
+		return err
+	}
+	err = check.SetMetadata(&url.Metadata)
+	if err != nil {
+		return err
+	}
+	if url.Expires.Before(now) {
+		return &ErrURLExpired{url.Target, url.Expires}
+	}
+	if url.Canonical != canonical {
+		return &ErrStaleCanonical{url.Canonical, canonical}
+	}
+	return nil
+}
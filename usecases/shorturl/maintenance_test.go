@@ -0,0 +1,106 @@
+package shorturl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/carlos-marchal/shorty/entities"
+)
+
+func TestDeletesExpiredURLs(t *testing.T) {
+	repository := newfakeRepository()
+	service, err := NewService(repository, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, id := range []string{"active", "old", "older"} {
+		url, _ := entities.NewShortURL("https://example.com/"+id, id)
+		if id != "active" {
+			url.Expires = time.Now().Add(-time.Hour)
+		}
+		repository.SaveURL(context.Background(), url)
+	}
+	deleted, err := service.DeleteExpiredURLs(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if deleted != 2 {
+		t.Fatalf("expected 2 deleted URLs, got %v", deleted)
+	}
+	if _, err := repository.GetByID(context.Background(), "old"); err == nil {
+		t.Fatalf("expected expired URL to be deleted")
+	}
+	if _, err := repository.GetByID(context.Background(), "active"); err != nil {
+		t.Fatalf("expected active URL to be kept, got %v", err)
+	}
+	deleted, err = service.DeleteExpiredURLs(context.Background())
+	if err != nil || deleted != 0 {
+		t.Fatalf("expected nothing left to delete, got %v and %v", deleted, err)
+	}
+}
+
+func TestRemovesURLsOfAnyOwner(t *testing.T) {
+	repository := newfakeRepository()
+	service, err := NewService(repository, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	url, _ := entities.NewShortURL("https://example.com", "owned")
+	url.Owner = "someone"
+	repository.SaveURL(context.Background(), url)
+	err = service.RemoveURL(context.Background(), "owned")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := repository.GetByID(context.Background(), "owned"); err == nil {
+		t.Fatalf("expected URL to be deleted")
+	}
+}
+
+func TestVerifiesStoredURLs(t *testing.T) {
+	repository := newfakeRepository()
+	service, err := NewService(repository, &Config{Policy: &TargetPolicy{Deny: []string{"denied.com"}}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	tests := []struct {
+		id      string
+		target  string
+		modify  func(url *entities.ShortURL)
+		problem bool
+	}{
+		{id: "fine", target: "https://example.com/fine"},
+		{id: "denied", target: "https://denied.com", problem: true},
+		{id: "quarantined", target: "https://denied.com/q", modify: func(url *entities.ShortURL) { url.Quarantined = "denied" }},
+		{id: "expired", target: "https://example.com/e", modify: func(url *entities.ShortURL) { url.Expires = time.Now().Add(-time.Hour) }, problem: true},
+		{id: "stale", target: "https://example.com/s", modify: func(url *entities.ShortURL) { url.Canonical = "https://example.com/s?old" }, problem: true},
+	}
+	for _, test := range tests {
+		url, err := entities.NewShortURL(test.target, test.id)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		url.Canonical, _ = entities.CanonicalURL(test.target, &service.config.Canonical)
+		if test.modify != nil {
+			test.modify(url)
+		}
+		repository.SaveURL(context.Background(), url)
+	}
+	problems, err := service.VerifyURLs(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	found := make(map[string]error)
+	for _, problem := range problems {
+		found[problem.ShortID] = problem.Err
+	}
+	for _, test := range tests {
+		if _, ok := found[test.id]; ok != test.problem {
+			t.Fatalf("expected problem for %v to be %v, got %v", test.id, test.problem, found[test.id])
+		}
+	}
+	if _, ok := found["stale"].(*ErrStaleCanonical); !ok {
+		t.Fatalf("expected stale canonical error, got %v", found["stale"])
+	}
+}
@@ -0,0 +1,199 @@
+package shorturl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// TargetPolicy restricts which targets can be shortened. Domains are matched
+// exactly, or as any subdomain when prefixed with "*.".
+type TargetPolicy struct {
+	// Allow lists the only domains that can be shortened. If empty, any domain
+	// not in Deny can be.
+	Allow []string
+	Deny  []string
+	// Origin is where the shortener itself is served. Targets on the same host
+	// are rejected, since they would redirect back to it.
+	Origin string
+	// Blocklist, if set, rejects known malicious targets. Stored URLs whose
+	// target is added to it later are quarantined when next resolved.
+	Blocklist Blocklist
+}
+
+// Blocklist tells whether a target is known to host malware or phishing.
+type Blocklist interface {
+	// Match returns a description of the rule matching target, if any.
+	Match(target string) (string, bool)
+}
+
+type ErrTargetNotAllowed struct {
+	Target string
+	Reason string
+}
+
+func (err *ErrTargetNotAllowed) Error() string {
+	return fmt.Sprintf("target %v is not allowed: %v", err.Target, err.Reason)
+}
+
+// blockedNetworks are private, shared, loopback, link local and unspecified
+// ranges, which point to hosts that are either internal or not reachable by
+// others.
+var blockedNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+func validateDomainPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		domain := strings.TrimPrefix(pattern, "*.")
+		if domain == "" || strings.ContainsAny(domain, "*/:@ ") {
+			return fmt.Errorf("domain pattern %q must be a domain, optionally prefixed by *.", pattern)
+		}
+	}
+	return nil
+}
+
+func matchesDomain(host string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesDomain reports whether the host of target matches any of patterns,
+// following the same rules as TargetPolicy.
+func MatchesDomain(target string, patterns []string) bool {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	return matchesDomain(normalizeHost(parsed.Hostname()), patterns)
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// parseNumericIPv4 reads hosts the way browsers do when their last label is a
+// number, such as 2130706433, 0x7f.1 or 017700000001 for 127.0.0.1. Labels may
+// be decimal, hex with 0x or octal with a leading 0, and the last one fills the
+// bytes that the others leave. numeric tells whether host is meant as an IPv4
+// address at all, in which case a nil ip means it is invalid.
+func parseNumericIPv4(host string) (ip net.IP, numeric bool) {
+	labels := strings.Split(host, ".")
+	if !isNumericLabel(labels[len(labels)-1]) {
+		return nil, false
+	}
+	if len(labels) > 4 {
+		return nil, true
+	}
+	var address uint32
+	for i, label := range labels {
+		bits := 8
+		if i == len(labels)-1 {
+			bits = 8 * (5 - len(labels))
+		}
+		value, err := parseIPv4Label(label, bits)
+		if err != nil {
+			return nil, true
+		}
+		address = address<<bits | uint32(value)
+	}
+	ip = make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, address)
+	return ip, true
+}
+
+func isNumericLabel(label string) bool {
+	digits := label
+	if strings.HasPrefix(label, "0x") {
+		digits = label[len("0x"):]
+	}
+	return label != "" && strings.Trim(digits, "0123456789abcdef") == "" && (digits != label || strings.Trim(label, "0123456789") == "")
+}
+
+func parseIPv4Label(label string, bits int) (uint64, error) {
+	switch {
+	case label == "0x":
+		return 0, nil
+	case strings.HasPrefix(label, "0x"):
+		return strconv.ParseUint(label[len("0x"):], 16, bits)
+	case len(label) > 1 && label[0] == '0':
+		return strconv.ParseUint(label[1:], 8, bits)
+	}
+	return strconv.ParseUint(label, 10, bits)
+}
+
+// check returns an ErrTargetNotAllowed if target breaks the policy. Targets
+// that can't be parsed are left for entities.NewShortURL to reject.
+func (policy *TargetPolicy) check(target string) error {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return nil
+	}
+	host := normalizeHost(parsed.Hostname())
+	ip := net.ParseIP(host)
+	if ip == nil {
+		var numeric bool
+		ip, numeric = parseNumericIPv4(host)
+		if numeric && ip == nil {
+			return &ErrTargetNotAllowed{target, "its host is neither a domain nor a valid IP address"}
+		}
+	}
+	if ip != nil {
+		for _, network := range blockedNetworks {
+			if network.Contains(ip) {
+				return &ErrTargetNotAllowed{target, "it points to a private or loopback address"}
+			}
+		}
+	} else if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return &ErrTargetNotAllowed{target, "it points to a private or loopback address"}
+	}
+	if origin, err := url.Parse(policy.Origin); err == nil && policy.Origin != "" && host == normalizeHost(origin.Hostname()) {
+		return &ErrTargetNotAllowed{target, "it points back to this shortener"}
+	}
+	if matchesDomain(host, policy.Deny) {
+		return &ErrTargetNotAllowed{target, "its domain is denied"}
+	}
+	if len(policy.Allow) > 0 && !matchesDomain(host, policy.Allow) {
+		return &ErrTargetNotAllowed{target, "its domain is not in the allowed list"}
+	}
+	if policy.Blocklist != nil {
+		if _, ok := policy.Blocklist.Match(target); ok {
+			return &ErrTargetNotAllowed{target, "it is listed as malware or phishing"}
+		}
+	}
+	return nil
+}
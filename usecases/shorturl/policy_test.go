@@ -0,0 +1,150 @@
+package shorturl
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAppliesTargetPolicy(t *testing.T) {
+	policy := &TargetPolicy{
+		Allow:  []string{"example.com", "*.example.org", "shorty.example.net"},
+		Deny:   []string{"private.example.org"},
+		Origin: "https://shorty.example.net",
+	}
+	tests := []struct {
+		target  string
+		allowed bool
+	}{
+		{target: "https://example.com/page", allowed: true},
+		{target: "https://EXAMPLE.com./page", allowed: true},
+		{target: "https://www.example.com", allowed: false},
+		{target: "https://docs.example.org", allowed: true},
+		{target: "https://example.org", allowed: false},
+		{target: "https://private.example.org", allowed: false},
+		{target: "https://other.net", allowed: false},
+		{target: "https://shorty.example.net/GA", allowed: false},
+		{target: "http://shorty.example.net:8080/GA", allowed: false},
+	}
+	for _, test := range tests {
+		err := policy.check(test.target)
+		if err == nil && !test.allowed {
+			t.Fatalf("allowed %v when supposed to reject", test.target)
+		} else if err != nil && test.allowed {
+			t.Fatalf("rejected %v with %v when supposed to allow", test.target, err)
+		}
+	}
+}
+
+func TestRejectsPrivateTargets(t *testing.T) {
+	tests := []struct {
+		target  string
+		allowed bool
+	}{
+		{target: "http://127.0.0.1/admin", allowed: false},
+		{target: "http://10.1.2.3", allowed: false},
+		{target: "http://172.20.0.1:8080", allowed: false},
+		{target: "http://192.168.1.1", allowed: false},
+		{target: "http://169.254.169.254/latest/meta-data", allowed: false},
+		{target: "http://0.0.0.0", allowed: false},
+		{target: "http://[::1]/", allowed: false},
+		{target: "http://[::ffff:127.0.0.1]/", allowed: false},
+		{target: "http://[fd00::1]/", allowed: false},
+		{target: "http://localhost:8080", allowed: false},
+		{target: "http://api.localhost", allowed: false},
+		{target: "http://100.64.0.1", allowed: false},
+		{target: "http://2130706433/", allowed: false},
+		{target: "http://0x7f.1/", allowed: false},
+		{target: "http://017700000001/", allowed: false},
+		{target: "http://0x7F000001/", allowed: false},
+		{target: "http://127.1/", allowed: false},
+		{target: "http://10.0.258/", allowed: false},
+		{target: "http://127.0.0.01/", allowed: false},
+		{target: "http://0/", allowed: false},
+		{target: "http://256.0.0.1/", allowed: false},
+		{target: "http://1.2.3.4.5/", allowed: false},
+		{target: "http://08.1.2.3/", allowed: false},
+		{target: "http://1563286562/", allowed: true},
+		{target: "http://0x5d.0xb8.0xd8.0x22/", allowed: true},
+		{target: "http://1.example.com/", allowed: true},
+		{target: "http://example.123abc/", allowed: true},
+		{target: "http://100.128.0.1", allowed: true},
+		{target: "http://93.184.216.34", allowed: true},
+		{target: "http://[2606:2800:220:1:248:1893:25c8:1946]/", allowed: true},
+		{target: "http://172.32.0.1", allowed: true},
+	}
+	policy := new(TargetPolicy)
+	for _, test := range tests {
+		err := policy.check(test.target)
+		if err == nil && !test.allowed {
+			t.Fatalf("allowed %v when supposed to reject", test.target)
+		} else if err != nil && test.allowed {
+			t.Fatalf("rejected %v with %v when supposed to allow", test.target, err)
+		}
+	}
+}
+
+func TestRejectsMalformedDomainPatterns(t *testing.T) {
+	for _, pattern := range []string{"", "*.", "*.*.example.com", "https://example.com", "example.com/path"} {
+		_, err := NewService(newfakeRepository(), &Config{Policy: &TargetPolicy{Deny: []string{pattern}}})
+		if err == nil {
+			t.Fatalf("accepted domain pattern %q", pattern)
+		}
+	}
+}
+
+func TestShortenChecksPolicyBeforeGeneratingID(t *testing.T) {
+	repository := newfakeRepository()
+	service, err := NewService(repository, &Config{Policy: &TargetPolicy{Deny: []string{"example.com"}}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_, err = service.ShortenURL(context.Background(), "https://example.com", nil)
+	if _, ok := err.(*ErrTargetNotAllowed); !ok {
+		t.Fatalf("expected target not allowed error, got %v", err)
+	}
+	if repository.n != 0 {
+		t.Fatalf("generated %v IDs for a rejected target", repository.n)
+	}
+}
+
+func TestShortenRejectsBlocklistedTargets(t *testing.T) {
+	blocklist := fakeBlocklist{"https://phishing.example.com": "phishing.txt:1"}
+	service, err := NewService(newfakeRepository(), &Config{Policy: &TargetPolicy{Blocklist: blocklist}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_, err = service.ShortenURL(context.Background(), "https://phishing.example.com", nil)
+	if _, ok := err.(*ErrTargetNotAllowed); !ok {
+		t.Fatalf("expected target not allowed error, got %v", err)
+	}
+	_, err = service.ShortenURL(context.Background(), "https://example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestResolveQuarantinesNewlyBlocklistedURLs(t *testing.T) {
+	repository := newfakeRepository()
+	blocklist := fakeBlocklist{}
+	service, err := NewService(repository, &Config{Policy: &TargetPolicy{Blocklist: blocklist}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	url, err := service.ShortenURL(context.Background(), "https://phishing.example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	blocklist["https://phishing.example.com"] = "phishing.txt:1"
+	_, err = service.ResolveURL(context.Background(), url.ShortID)
+	if _, ok := err.(*ErrURLQuarantined); !ok {
+		t.Fatalf("expected quarantined error, got %v", err)
+	}
+	if repository.byID[url.ShortID].Quarantined == "" {
+		t.Fatalf("quarantine was not saved")
+	}
+	delete(blocklist, "https://phishing.example.com")
+	_, err = service.ResolveURL(context.Background(), url.ShortID)
+	if _, ok := err.(*ErrURLQuarantined); !ok {
+		t.Fatalf("expected quarantine to outlive the blocklist rule, got %v", err)
+	}
+}
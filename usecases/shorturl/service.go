@@ -1,51 +1,297 @@
 package shorturl
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	"github.com/carlos-marchal/shorty/entities"
+	"github.com/carlos-marchal/shorty/logging"
 )
 
+type Config struct {
+	// Policy restricts which targets can be shortened. If nil only private and
+	// loopback targets are rejected.
+	Policy *TargetPolicy
+	// Canonical selects the optional normalizations applied to targets before
+	// looking for an existing URL to reuse.
+	Canonical entities.CanonicalOptions
+	// Dedupe is the mode used when a request doesn't choose one. It defaults
+	// to AlwaysReuse.
+	Dedupe DedupeMode
+}
+
 type Service struct {
 	repository Repository
+	policy     *TargetPolicy
+	config     Config
 }
 
-func NewService(repository Repository) (*Service, error) {
-	return &Service{repository}, nil
+// NewService builds the service on top of a repository. A nil config uses the
+// defaults described in Config.
+func NewService(repository Repository, config *Config) (*Service, error) {
+	if config == nil {
+		config = new(Config)
+	}
+	policy := config.Policy
+	if policy == nil {
+		policy = new(TargetPolicy)
+	}
+	if config.Dedupe == DefaultDedupe {
+		config = &Config{config.Policy, config.Canonical, AlwaysReuse}
+	}
+	err := validateDomainPatterns(policy.Allow)
+	if err != nil {
+		return nil, err
+	}
+	err = validateDomainPatterns(policy.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &Service{repository, policy, *config}, nil
 }
 
-func (service *Service) ShortenURL(target string) (*entities.ShortURL, error) {
-	url, err := service.repository.GetByURL(target)
-	switch err.(type) {
-	case nil:
+func (service *Service) ShortenURL(ctx context.Context, target string, options *ShortenOptions) (*entities.ShortURL, error) {
+	if options == nil {
+		options = new(ShortenOptions)
+	}
+	canonical, url, err := service.prepare(ctx, target, options)
+	if url != nil || err != nil {
 		return url, err
-	case *ErrRepoNotFound:
-		break
-	default:
+	}
+	new, err := newURL(target, canonical, batchID, options)
+	if err != nil {
+		return nil, err
+	}
+	// Generating the ID and saving the URL are a commit each.
+	err = AllowWrite(ctx, 2)
+	if err != nil {
+		return nil, err
+	}
+	new.ShortID, err = service.repository.GenerateShortID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = service.repository.SaveURL(ctx, new)
+	if err != nil {
+		return nil, err
+	}
+	return new, nil
+}
+
+// batchID stands in for the IDs of new URLs until the repository generates
+// them, so that invalid URLs are rejected without using any, or writing.
+const batchID = "batch"
+
+// ShortenURLs shortens every request of a batch, saving all the new URLs in a
+// single write. A failed request doesn't stop the rest. The returned error is
+// only set when the new URLs can't be saved, in which case none is.
+func (service *Service) ShortenURLs(ctx context.Context, requests []*ShortenRequest) ([]*ShortenResult, error) {
+	results := make([]*ShortenResult, len(requests))
+	pending := make([]*entities.ShortURL, 0)
+	// created holds the new URLs of the batch by dedupe key, so that repeated
+	// targets reuse them as they would reuse stored URLs.
+	created := make(map[string]*entities.ShortURL)
+	for i, request := range requests {
+		options := request.Options
+		if options == nil {
+			options = new(ShortenOptions)
+		}
+		canonical, url, err := service.prepare(ctx, request.Target, options)
+		if url == nil && err == nil {
+			key, reusable := service.dedupeKey(canonical, options)
+			url = created[key]
+			if url == nil {
+				url, err = newURL(request.Target, canonical, batchID, options)
+				if err == nil {
+					pending = append(pending, url)
+				}
+				if err == nil && reusable {
+					created[key] = url
+				}
+			}
+		}
+		results[i] = &ShortenResult{url, err}
+	}
+	if len(pending) == 0 {
+		return results, nil
+	}
+	err := AllowWrite(ctx, 1)
+	if err != nil {
 		return nil, err
 	}
-	id, err := service.repository.GenerateShortID()
+	err = service.repository.SaveNewURLs(ctx, pending)
 	if err != nil {
 		return nil, err
 	}
+	return results, nil
+}
+
+// prepare checks target against the policy and returns its canonical form,
+// along with the existing URL to reuse for it, if any.
+func (service *Service) prepare(ctx context.Context, target string, options *ShortenOptions) (string, *entities.ShortURL, error) {
+	err := service.policy.check(target)
+	if err != nil {
+		return "", nil, err
+	}
+	canonical, err := entities.CanonicalURL(target, &service.config.Canonical)
+	if err != nil {
+		return "", nil, err
+	}
+	url, err := service.reusableURL(ctx, canonical, options)
+	return canonical, url, err
+}
+
+func newURL(target string, canonical string, id string, options *ShortenOptions) (*entities.ShortURL, error) {
 	new, err := entities.NewShortURL(target, id)
 	if err != nil {
 		return nil, err
 	}
-	err = service.repository.SaveURL(new)
+	new.Canonical = canonical
+	new.Owner = options.Owner
+	new.Interstitial = options.Interstitial
+	err = new.SetRedirect(options.Redirect)
 	if err != nil {
 		return nil, err
 	}
+	if options.Metadata != nil {
+		err = new.SetMetadata(options.Metadata)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return new, nil
 }
 
-func (service *Service) ResolveURL(shortID string) (*entities.ShortURL, error) {
-	url, err := service.repository.GetByID(shortID)
+func (service *Service) dedupeMode(options *ShortenOptions) DedupeMode {
+	if options.Dedupe == DefaultDedupe {
+		return service.config.Dedupe
+	}
+	return options.Dedupe
+}
+
+// dedupeKey identifies the URLs that a new URL for canonical may be reused
+// for, according to the dedupe mode. It reports false if it may not be reused.
+func (service *Service) dedupeKey(canonical string, options *ShortenOptions) (string, bool) {
+	switch service.dedupeMode(options) {
+	case NeverReuse:
+		return "", false
+	case ReuseOwn:
+		return options.Owner + " " + canonical, true
+	default:
+		return canonical, true
+	}
+}
+
+// reusableURL finds an existing URL for the canonical target that the dedupe
+// mode allows reusing, if any.
+func (service *Service) reusableURL(ctx context.Context, canonical string, options *ShortenOptions) (*entities.ShortURL, error) {
+	mode := service.dedupeMode(options)
+	if mode == NeverReuse {
+		return nil, nil
+	}
+	urls, err := service.repository.GetByURL(ctx, canonical)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, url := range urls {
+		if url.Expires.Before(now) || url.Quarantined != "" {
+			continue
+		}
+		if mode == ReuseOwn && url.Owner != options.Owner {
+			continue
+		}
+		return url, nil
+	}
+	return nil, nil
+}
+
+func (service *Service) ResolveURL(ctx context.Context, shortID string) (*entities.ShortURL, error) {
+	url, err := service.repository.GetByID(ctx, shortID)
 	if err != nil {
 		return nil, err
 	}
 	if url.Expires.Before(time.Now()) {
 		return nil, &ErrURLExpired{url.Target, url.Expires}
 	}
+	if url.Quarantined == "" && service.policy.Blocklist != nil {
+		if rule, ok := service.policy.Blocklist.Match(url.Target); ok {
+			quarantined := *url
+			quarantined.Quarantined = fmt.Sprintf("target matches blocklist rule %v", rule)
+			logger := logging.FromContext(ctx)
+			logger.Warn("Quarantined URL", "id", url.ShortID, "rule", rule)
+			// The URL is refused either way. If saving fails it is quarantined
+			// again on the next resolve.
+			err = service.repository.SaveURL(ctx, &quarantined)
+			if err != nil {
+				logger.Error("Could not save the quarantined URL", "id", url.ShortID, "error", err)
+			}
+			url = &quarantined
+		}
+	}
+	if url.Quarantined != "" {
+		return nil, &ErrURLQuarantined{url.Target, url.Quarantined}
+	}
+	return url, nil
+}
+
+// UpdateURL replaces the metadata of a URL. Only its owner may do so.
+func (service *Service) UpdateURL(ctx context.Context, shortID string, owner string, metadata *entities.Metadata) (*entities.ShortURL, error) {
+	url, err := service.ownedURL(ctx, shortID, owner)
+	if err != nil {
+		return nil, err
+	}
+	updated := *url
+	err = updated.SetMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+	err = AllowWrite(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	err = service.repository.SaveURL(ctx, &updated)
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// DeleteURL removes a URL. Only its owner may do so.
+func (service *Service) DeleteURL(ctx context.Context, shortID string, owner string) error {
+	_, err := service.ownedURL(ctx, shortID, owner)
+	if err != nil {
+		return err
+	}
+	err = AllowWrite(ctx, 1)
+	if err != nil {
+		return err
+	}
+	return service.repository.DeleteURL(ctx, shortID)
+}
+
+// ownedURL returns the URL with the given ID if owner owns it. Anonymous URLs
+// have no owner, and can't be changed by anyone.
+func (service *Service) ownedURL(ctx context.Context, shortID string, owner string) (*entities.ShortURL, error) {
+	url, err := service.repository.GetByID(ctx, shortID)
+	if err != nil {
+		return nil, err
+	}
+	if owner == "" || url.Owner != owner {
+		return nil, &ErrNotOwner{shortID}
+	}
 	return url, nil
 }
+
+// ListURLs returns a page of the stored URLs matching filter. Limits outside
+// of the accepted range are replaced with the default or the maximum.
+func (service *Service) ListURLs(ctx context.Context, filter *Filter, page *Page) (*URLPage, error) {
+	clamped := *page
+	if clamped.Limit <= 0 {
+		clamped.Limit = defaultPageLimit
+	} else if clamped.Limit > maxPageLimit {
+		clamped.Limit = maxPageLimit
+	}
+	return service.repository.ListURLs(ctx, filter, &clamped)
+}
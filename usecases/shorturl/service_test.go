@@ -1,6 +1,9 @@
 package shorturl
 
 import (
+	"context"
+	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
@@ -8,15 +11,15 @@ import (
 )
 
 func TestStoresAndRetrievesURLs(t *testing.T) {
-	service, err := NewService(newfakeRepository())
+	service, err := NewService(newfakeRepository(), nil)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
-	stored, err := service.ShortenURL("https://example.com")
+	stored, err := service.ShortenURL(context.Background(), "https://example.com", nil)
 	if err != nil {
 		t.Fatalf("did not expect error while storing: %v", err)
 	}
-	retrieved, err := service.ResolveURL(stored.ShortID)
+	retrieved, err := service.ResolveURL(context.Background(), stored.ShortID)
 	if err != nil {
 		t.Fatalf("did not expect error while retrieving: %v", err)
 	}
@@ -25,47 +28,403 @@ func TestStoresAndRetrievesURLs(t *testing.T) {
 	}
 }
 
+func TestAsksWriteGateOnlyBeforeWriting(t *testing.T) {
+	service, err := NewService(newfakeRepository(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	stored, err := service.ShortenURL(context.Background(), "https://example.com", nil)
+	if err != nil {
+		t.Fatalf("did not expect error while storing: %v", err)
+	}
+	asked := 0
+	ctx := WithWriteGate(context.Background(), func(commits int) error {
+		asked += commits
+		return &ErrWriteLimited{Wait: time.Second}
+	})
+	reused, err := service.ShortenURL(ctx, "https://example.com", nil)
+	if err != nil || reused.ShortID != stored.ShortID || asked != 0 {
+		t.Fatalf("expected the stored URL to be reused without writing, got %v, %v", reused, err)
+	}
+	_, err = service.ShortenURL(ctx, "https://example.org", nil)
+	if _, ok := err.(*ErrWriteLimited); !ok || asked != 2 {
+		t.Fatalf("expected the two commits to be refused by the gate, got %v for %v", err, asked)
+	}
+	_, err = service.ResolveURL(ctx, stored.ShortID)
+	if err != nil || asked != 2 {
+		t.Fatalf("expected reads not to ask the gate, got %v", err)
+	}
+}
+
+func TestRejectsInvalidURLsWithoutGeneratingIDs(t *testing.T) {
+	repository := newfakeRepository()
+	service, err := NewService(repository, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	asked := 0
+	ctx := WithWriteGate(context.Background(), func(commits int) error {
+		asked++
+		return nil
+	})
+	options := []*ShortenOptions{
+		{Metadata: &entities.Metadata{Tags: []string{"not a tag"}}},
+		{Redirect: entities.RedirectType(200)},
+	}
+	for _, options := range options {
+		_, err = service.ShortenURL(ctx, "https://example.com", options)
+		if err == nil {
+			t.Fatalf("expected %+v to be rejected", options)
+		}
+	}
+	if repository.n != 0 || asked != 0 {
+		t.Fatalf("expected no ID to be generated nor write asked for, got %v IDs and %v writes", repository.n, asked)
+	}
+}
+
 func TestIgnoresExpiredURLs(t *testing.T) {
-	service, err := NewService(newfakeRepository())
+	service, err := NewService(newfakeRepository(), nil)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
-	service.repository.SaveURL(&entities.ShortURL{
+	service.repository.SaveURL(context.Background(), &entities.ShortURL{
 		Target:  "https://example.com",
 		ShortID: "id",
 		Expires: time.Now().Add(-time.Second),
 	})
-	retrieved, err := service.ResolveURL("id")
+	retrieved, err := service.ResolveURL(context.Background(), "id")
 	if _, ok := err.(*ErrURLExpired); !ok {
 		t.Fatalf("expected expired error on retrieving expired url, got %v", retrieved)
 	}
 }
 
 func TestReturnsExistantOnRepeatedEntry(t *testing.T) {
-	service, err := NewService(newfakeRepository())
+	service, err := NewService(newfakeRepository(), nil)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
-	first, err := service.ShortenURL("https://example.com")
+	first, err := service.ShortenURL(context.Background(), "https://example.com", nil)
 	if err != nil {
 		t.Fatalf("did not expect error %v", err)
 	}
-	second, err := service.ShortenURL("https://example.com")
+	second, err := service.ShortenURL(context.Background(), "https://example.com", nil)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
-	if *first != *second {
+	if !reflect.DeepEqual(first, second) {
 		t.Fatalf("got nonmatching entries %v and %v", first, second)
 	}
 }
 
 func TestFailsOnNonexistantID(t *testing.T) {
-	service, err := NewService(newfakeRepository())
+	service, err := NewService(newfakeRepository(), nil)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
-	retrieved, err := service.ResolveURL("does not exist")
+	retrieved, err := service.ResolveURL(context.Background(), "does not exist")
 	if err == nil {
 		t.Fatalf("expected error on nonexistant entry, got %v", retrieved)
 	}
 }
+
+func TestReusesURLsWithTheSameCanonicalTarget(t *testing.T) {
+	service, err := NewService(newfakeRepository(), &Config{
+		Canonical: entities.CanonicalOptions{StripTracking: true},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	first, err := service.ShortenURL(context.Background(), "https://Example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, target := range []string{"https://example.com/", "https://example.com:443/?", "https://example.com/?utm_source=mail"} {
+		again, err := service.ShortenURL(context.Background(), target, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if again.ShortID != first.ShortID {
+			t.Fatalf("expected %v to reuse %v, got %v", target, first.ShortID, again.ShortID)
+		}
+	}
+	if first.Target != "https://Example.com" {
+		t.Fatalf("expected the original target to be kept, got %v", first.Target)
+	}
+}
+
+func TestAppliesDedupeMode(t *testing.T) {
+	tests := []struct {
+		configured DedupeMode
+		requested  DedupeMode
+		owner      string
+		reused     bool
+	}{
+		{configured: DefaultDedupe, requested: DefaultDedupe, owner: "someone", reused: true},
+		{configured: NeverReuse, requested: DefaultDedupe, owner: "team", reused: false},
+		{configured: AlwaysReuse, requested: NeverReuse, owner: "team", reused: false},
+		{configured: NeverReuse, requested: AlwaysReuse, owner: "someone", reused: true},
+		{configured: ReuseOwn, requested: DefaultDedupe, owner: "team", reused: true},
+		{configured: ReuseOwn, requested: DefaultDedupe, owner: "someone", reused: false},
+	}
+	for _, test := range tests {
+		service, err := NewService(newfakeRepository(), &Config{Dedupe: test.configured})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		first, err := service.ShortenURL(context.Background(), "https://example.com", &ShortenOptions{Owner: "team"})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		second, err := service.ShortenURL(context.Background(), "https://example.com", &ShortenOptions{Owner: test.owner, Dedupe: test.requested})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if reused := first.ShortID == second.ShortID; reused != test.reused {
+			t.Fatalf("expected reused to be %v for %+v", test.reused, test)
+		}
+	}
+}
+
+func TestDoesNotReuseExpiredURLs(t *testing.T) {
+	service, err := NewService(newfakeRepository(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	service.repository.SaveURL(context.Background(), &entities.ShortURL{
+		Target:    "https://example.com",
+		Canonical: "https://example.com/",
+		ShortID:   "old",
+		Expires:   time.Now().Add(-time.Second),
+	})
+	url, err := service.ShortenURL(context.Background(), "https://example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if url.ShortID == "old" {
+		t.Fatalf("reused an expired URL")
+	}
+}
+
+func TestSetsRedirectType(t *testing.T) {
+	service, err := NewService(newfakeRepository(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	url, err := service.ShortenURL(context.Background(), "https://example.com", &ShortenOptions{Redirect: entities.PermanentRedirect})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if url.Redirect != entities.PermanentRedirect {
+		t.Fatalf("expected permanent redirect, got %v", url.Redirect)
+	}
+	_, err = service.ShortenURL(context.Background(), "https://example.org", &ShortenOptions{Redirect: 200})
+	if _, ok := err.(*entities.ErrInvalidRedirect); !ok {
+		t.Fatalf("expected invalid redirect error, got %v", err)
+	}
+}
+
+func TestStoresMetadata(t *testing.T) {
+	service, err := NewService(newfakeRepository(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	metadata := &entities.Metadata{Title: "Example", Tags: []string{"docs"}, Creator: "someone"}
+	stored, err := service.ShortenURL(context.Background(), "https://example.com", &ShortenOptions{Metadata: metadata})
+	if err != nil {
+		t.Fatalf("did not expect error while storing: %v", err)
+	}
+	retrieved, err := service.ResolveURL(context.Background(), stored.ShortID)
+	if err != nil {
+		t.Fatalf("did not expect error while retrieving: %v", err)
+	}
+	if !reflect.DeepEqual(retrieved.Metadata, *metadata) {
+		t.Fatalf("expected metadata %+v, got %+v", *metadata, retrieved.Metadata)
+	}
+}
+
+func TestRejectsInvalidTags(t *testing.T) {
+	service, err := NewService(newfakeRepository(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_, err = service.ShortenURL(context.Background(), "https://example.com", &ShortenOptions{
+		Metadata: &entities.Metadata{Tags: []string{"not a tag"}},
+	})
+	if _, ok := err.(*entities.ErrInvalidTag); !ok {
+		t.Fatalf("expected invalid tag error, got %v", err)
+	}
+}
+
+func TestListsURLsMatchingFilter(t *testing.T) {
+	service, err := NewService(newfakeRepository(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	now := time.Now()
+	urls := []*entities.ShortURL{
+		{Target: "https://example.com/docs", ShortID: "a", Expires: now.Add(time.Hour), Metadata: entities.Metadata{Tags: []string{"docs"}, Creator: "ann"}},
+		{Target: "https://example.com/blog", ShortID: "b", Expires: now.Add(time.Hour), Metadata: entities.Metadata{Tags: []string{"blog"}, Creator: "bob"}},
+		{Target: "https://other.org/docs", ShortID: "c", Expires: now.Add(-time.Hour), Metadata: entities.Metadata{Tags: []string{"docs"}, Creator: "bob"}},
+	}
+	for _, url := range urls {
+		service.repository.SaveURL(context.Background(), url)
+	}
+	tests := []struct {
+		filter   Filter
+		expected []string
+	}{
+		{filter: Filter{}, expected: []string{"a", "b", "c"}},
+		{filter: Filter{Tag: "DOCS"}, expected: []string{"a", "c"}},
+		{filter: Filter{Target: "Example.com"}, expected: []string{"a", "b"}},
+		{filter: Filter{Creator: "bob"}, expected: []string{"b", "c"}},
+		{filter: Filter{Status: ActiveStatus}, expected: []string{"a", "b"}},
+		{filter: Filter{Status: ExpiredStatus}, expected: []string{"c"}},
+		{filter: Filter{Tag: "docs", Creator: "bob", Status: ActiveStatus}, expected: []string{}},
+	}
+	for _, test := range tests {
+		page, err := service.ListURLs(context.Background(), &test.filter, &Page{})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		ids := make([]string, len(page.URLs))
+		for i, url := range page.URLs {
+			ids[i] = url.ShortID
+		}
+		if !reflect.DeepEqual(ids, test.expected) {
+			t.Fatalf("expected %v for filter %+v, got %v", test.expected, test.filter, ids)
+		}
+	}
+}
+
+func TestPaginatesNewestFirst(t *testing.T) {
+	service, err := NewService(newfakeRepository(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		service.repository.SaveURL(context.Background(), &entities.ShortURL{
+			Target:  fmt.Sprintf("https://example.com/%v", i),
+			ShortID: fmt.Sprint(i),
+			Expires: now.Add(time.Hour),
+			Created: now.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	ids := make([]string, 0)
+	page := &Page{Limit: 2}
+	for {
+		result, err := service.ListURLs(context.Background(), &Filter{}, page)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(result.URLs) > 2 {
+			t.Fatalf("got %v URLs for a page limited to 2", len(result.URLs))
+		}
+		for _, url := range result.URLs {
+			ids = append(ids, url.ShortID)
+		}
+		if result.Next == nil {
+			break
+		}
+		page.After = result.Next
+	}
+	if expected := []string{"4", "3", "2", "1", "0"}; !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("expected pages to list %v, got %v", expected, ids)
+	}
+}
+
+func TestOnlyOwnerModifiesURL(t *testing.T) {
+	service, err := NewService(newfakeRepository(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	stored, err := service.ShortenURL(context.Background(), "https://example.com", &ShortenOptions{Owner: "ann"})
+	if err != nil {
+		t.Fatalf("did not expect error while storing: %v", err)
+	}
+	if stored.Owner != "ann" {
+		t.Fatalf("expected URL to be owned by ann, got %v", stored.Owner)
+	}
+	_, err = service.UpdateURL(context.Background(), stored.ShortID, "bob", &entities.Metadata{Title: "Stolen"})
+	if _, ok := err.(*ErrNotOwner); !ok {
+		t.Fatalf("expected not owner error on update, got %v", err)
+	}
+	err = service.DeleteURL(context.Background(), stored.ShortID, "bob")
+	if _, ok := err.(*ErrNotOwner); !ok {
+		t.Fatalf("expected not owner error on delete, got %v", err)
+	}
+	anonymous, err := service.ShortenURL(context.Background(), "https://anonymous.example.com", &ShortenOptions{})
+	if err != nil {
+		t.Fatalf("did not expect error while storing: %v", err)
+	}
+	err = service.DeleteURL(context.Background(), anonymous.ShortID, "")
+	if _, ok := err.(*ErrNotOwner); !ok {
+		t.Fatalf("expected anonymous URLs to be unmodifiable, got %v", err)
+	}
+	updated, err := service.UpdateURL(context.Background(), stored.ShortID, "ann", &entities.Metadata{Title: "Mine"})
+	if err != nil {
+		t.Fatalf("did not expect error while updating: %v", err)
+	}
+	if updated.Title != "Mine" || updated.Target != stored.Target {
+		t.Fatalf("unexpected updated URL %+v", updated)
+	}
+	err = service.DeleteURL(context.Background(), stored.ShortID, "ann")
+	if err != nil {
+		t.Fatalf("did not expect error while deleting: %v", err)
+	}
+	_, err = service.ResolveURL(context.Background(), stored.ShortID)
+	if _, ok := err.(*ErrRepoNotFound); !ok {
+		t.Fatalf("expected deleted URL to be gone, got %v", err)
+	}
+}
+
+func TestShortensBatches(t *testing.T) {
+	repository := newfakeRepository()
+	service, err := NewService(repository, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	existing, err := service.ShortenURL(context.Background(), "https://example.com/existing", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	results, err := service.ShortenURLs(context.Background(), []*ShortenRequest{
+		{Target: "https://example.com/a"},
+		{Target: "ftp://example.com"},
+		{Target: "https://example.com/existing"},
+		{Target: "https://EXAMPLE.com/a"},
+		{Target: "https://example.com/b", Options: &ShortenOptions{Dedupe: NeverReuse}},
+		{Target: "https://example.com/b", Options: &ShortenOptions{Dedupe: NeverReuse}},
+		{Target: "https://example.com/c", Options: &ShortenOptions{Redirect: 200}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(results) != 7 {
+		t.Fatalf("expected 7 results, got %v", len(results))
+	}
+	if _, ok := results[1].Err.(*entities.ErrInvalidURL); !ok || results[1].URL != nil {
+		t.Fatalf("expected invalid URL error, got %+v", results[1])
+	}
+	if _, ok := results[6].Err.(*entities.ErrInvalidRedirect); !ok {
+		t.Fatalf("expected invalid redirect error, got %+v", results[6])
+	}
+	if results[2].URL.ShortID != existing.ShortID {
+		t.Fatalf("expected stored URL to be reused, got %v", results[2].URL.ShortID)
+	}
+	if results[3].URL != results[0].URL {
+		t.Fatalf("expected new URL to be reused within the batch")
+	}
+	if results[4].URL == results[5].URL {
+		t.Fatalf("expected separate URLs when never reusing")
+	}
+	for _, i := range []int{0, 4, 5} {
+		stored, err := repository.GetByID(context.Background(), results[i].URL.ShortID)
+		if err != nil || stored != results[i].URL {
+			t.Fatalf("expected result %v to be stored with a generated ID, got %v", i, results[i].URL.ShortID)
+		}
+	}
+	if repository.n != 4 {
+		t.Fatalf("expected 4 generated IDs, got %v", repository.n)
+	}
+}
@@ -0,0 +1,164 @@
+package shorturl
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/carlos-marchal/shorty/entities"
+)
+
+// ConflictMode decides what happens when an imported URL has the ID of a
+// stored one.
+type ConflictMode int
+
+const (
+	// SkipConflicts keeps the stored URL and ignores the imported one.
+	SkipConflicts ConflictMode = iota
+	// OverwriteConflicts replaces the stored URL with the imported one.
+	OverwriteConflicts
+	// FailOnConflict aborts the whole import without saving anything.
+	FailOnConflict
+)
+
+// ImportRecord is a URL read from an export of this or another shortener.
+// Zero times are replaced with the defaults of a new URL. Err is set when
+// the record couldn't be read, so that it is reported as rejected.
+type ImportRecord struct {
+	ShortID      string
+	Target       string
+	Expires      time.Time
+	Created      time.Time
+	Owner        string
+	Redirect     entities.RedirectType
+	Interstitial bool
+	Metadata     entities.Metadata
+	Err          error
+}
+
+// ImportReject is a record that was not imported, at the given position of
+// the imported records.
+type ImportReject struct {
+	Index   int
+	ShortID string
+	Err     error
+}
+
+type ImportResult struct {
+	// Imported counts the saved URLs, including the Overwritten ones.
+	Imported    int
+	Overwritten int
+	Skipped     int
+	Rejected    []*ImportReject
+}
+
+type ErrImportConflict struct {
+	ID string
+}
+
+func (err *ErrImportConflict) Error() string {
+	return fmt.Sprintf("identifier %v is already taken", err.ID)
+}
+
+// ImportURLs stores the given records keeping their IDs, all in a single
+// write. Each record is validated like a new URL, and invalid ones are
+// rejected without stopping the rest.
+func (service *Service) ImportURLs(ctx context.Context, records []*ImportRecord, conflicts ConflictMode) (*ImportResult, error) {
+	stored, err := service.repository.ListURLs(ctx, new(Filter), new(Page))
+	if err != nil {
+		return nil, err
+	}
+	taken := make(map[string]bool)
+	for _, url := range stored.URLs {
+		taken[url.ShortID] = true
+	}
+	result := &ImportResult{Rejected: make([]*ImportReject, 0)}
+	urls := make([]*entities.ShortURL, 0)
+	imported := make(map[string]bool)
+	now := time.Now()
+	for i, record := range records {
+		url, err := service.importedURL(record, now)
+		if err == nil && imported[url.ShortID] {
+			err = &ErrImportConflict{url.ShortID}
+		}
+		if err != nil {
+			result.Rejected = append(result.Rejected, &ImportReject{i, record.ShortID, err})
+			continue
+		}
+		imported[url.ShortID] = true
+		if taken[url.ShortID] {
+			switch conflicts {
+			case SkipConflicts:
+				result.Skipped++
+				continue
+			case FailOnConflict:
+				return nil, &ErrImportConflict{url.ShortID}
+			default:
+				result.Overwritten++
+			}
+		}
+		urls = append(urls, url)
+	}
+	if len(urls) > 0 {
+		err = AllowWrite(ctx, 1)
+		if err != nil {
+			return nil, err
+		}
+		err = service.repository.SaveURLs(ctx, urls)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result.Imported = len(urls)
+	return result, nil
+}
+
+// importedURL builds the URL of a record, validating it like a new one.
+// Records that expired already are rejected, as they would be dropped anyway.
+func (service *Service) importedURL(record *ImportRecord, now time.Time) (*entities.ShortURL, error) {
+	if record.Err != nil {
+		return nil, record.Err
+	}
+	err := service.policy.check(record.Target)
+	if err != nil {
+		return nil, err
+	}
+	canonical, err := entities.CanonicalURL(record.Target, &service.config.Canonical)
+	if err != nil {
+		return nil, err
+	}
+	url, err := entities.NewShortURL(record.Target, record.ShortID)
+	if err != nil {
+		return nil, err
+	}
+	url.Canonical = canonical
+	if !record.Created.IsZero() {
+		url.Created = record.Created
+	}
+	if !record.Expires.IsZero() {
+		url.Expires = record.Expires
+	}
+	if url.Expires.Before(now) {
+		return nil, &ErrURLExpired{url.Target, url.Expires}
+	}
+	url.Owner = record.Owner
+	url.Interstitial = record.Interstitial
+	err = url.SetRedirect(record.Redirect)
+	if err != nil {
+		return nil, err
+	}
+	err = url.SetMetadata(&record.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	return url, nil
+}
+
+// ExportURLs returns every stored URL matching filter, newest first.
+func (service *Service) ExportURLs(ctx context.Context, filter *Filter) ([]*entities.ShortURL, error) {
+	page, err := service.repository.ListURLs(ctx, filter, new(Page))
+	if err != nil {
+		return nil, err
+	}
+	return page.URLs, nil
+}
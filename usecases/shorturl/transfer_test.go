@@ -0,0 +1,99 @@
+package shorturl
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/carlos-marchal/shorty/entities"
+)
+
+func TestImportsKeepingIDs(t *testing.T) {
+	expires := time.Now().Add(24 * time.Hour).Round(time.Second)
+	tests := []struct {
+		conflicts   ConflictMode
+		fails       bool
+		target      string
+		imported    int
+		overwritten int
+		skipped     int
+	}{
+		{conflicts: SkipConflicts, target: "https://example.com/stored", imported: 1, skipped: 1},
+		{conflicts: OverwriteConflicts, target: "https://example.com/taken", imported: 2, overwritten: 1},
+		{conflicts: FailOnConflict, fails: true, target: "https://example.com/stored"},
+	}
+	for _, test := range tests {
+		repository := newfakeRepository()
+		service, err := NewService(repository, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		stored, _ := entities.NewShortURL("https://example.com/stored", "taken")
+		repository.SaveURL(context.Background(), stored)
+		result, err := service.ImportURLs(context.Background(), []*ImportRecord{
+			{ShortID: "kept", Target: "https://example.com/kept", Expires: expires, Metadata: entities.Metadata{Tags: []string{"Docs"}}},
+			{ShortID: "taken", Target: "https://example.com/taken"},
+			{ShortID: "bad id!", Target: "https://example.com"},
+			{ShortID: "ftp", Target: "ftp://example.com"},
+			{ShortID: "old", Target: "https://example.com", Expires: time.Now().Add(-time.Hour)},
+			{ShortID: "kept", Target: "https://example.com/again"},
+			{ShortID: "unread", Err: &entities.ErrInvalidURL{}},
+		}, test.conflicts)
+		if test.fails {
+			if _, ok := err.(*ErrImportConflict); !ok {
+				t.Fatalf("expected conflict error, got %v", err)
+			}
+			if _, err := repository.GetByID(context.Background(), "kept"); err == nil {
+				t.Fatalf("expected nothing to be imported on conflict")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if result.Imported != test.imported || result.Overwritten != test.overwritten || result.Skipped != test.skipped {
+			t.Fatalf("unexpected result %+v for %+v", result, test)
+		}
+		if len(result.Rejected) != 5 {
+			t.Fatalf("expected 5 rejected records, got %v", len(result.Rejected))
+		}
+		for i, index := range []int{2, 3, 4, 5, 6} {
+			if result.Rejected[i].Index != index {
+				t.Fatalf("expected record %v to be rejected, got %v", index, result.Rejected[i].Index)
+			}
+		}
+		kept, err := repository.GetByID(context.Background(), "kept")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if !kept.Expires.Equal(expires) || len(kept.Tags) != 1 || kept.Tags[0] != "docs" {
+			t.Fatalf("expected imported fields to be kept, got %+v", kept)
+		}
+		taken, _ := repository.GetByID(context.Background(), "taken")
+		if taken.Target != test.target {
+			t.Fatalf("expected %v for the conflicting ID, got %v", test.target, taken.Target)
+		}
+	}
+}
+
+func TestExportsEveryURL(t *testing.T) {
+	repository := newfakeRepository()
+	service, err := NewService(repository, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for i := 0; i < maxPageLimit+5; i++ {
+		_, err := service.ShortenURL(context.Background(), fmt.Sprintf("https://example.com/%v", i), nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	urls, err := service.ExportURLs(context.Background(), new(Filter))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(urls) != maxPageLimit+5 {
+		t.Fatalf("expected %v URLs, got %v", maxPageLimit+5, len(urls))
+	}
+}